@@ -1,42 +1,97 @@
 package main
 
 import (
+	"expvar"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/redefik/sdccproject/apigateway/config"
 	"github.com/redefik/sdccproject/apigateway/microservice"
 	"log"
 	"net/http"
+	"os"
 )
 
-// healthCheck handles the requests coming from an external component responsible for verifying the status of the api
-// gateway
-func healthCheck(w http.ResponseWriter, _ *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// newAdminRouter creates the router of the admin API, that allows the administrators to inspect and manage the given
+// api gateway
+func newAdminRouter(gateway *microservice.Gateway) *mux.Router {
+	r := mux.NewRouter()
+	// Every request is authorized according to the access policy before reaching its handler
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/admin/routes", gateway.ListRoutes).Methods(http.MethodGet)
+	r.HandleFunc("/admin/upstreams", microservice.GetUpstreamHealth).Methods(http.MethodGet)
+	r.HandleFunc("/admin/tokens/users/{username}", microservice.RevokeUserTokens).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/lockouts", microservice.ListLockouts).Methods(http.MethodGet)
+	r.HandleFunc("/admin/lockouts", microservice.ClearLockouts).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/lockouts/users/{username}", microservice.ClearLockouts).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/lockouts/ips/{ip}", microservice.ClearLockouts).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/jobs", microservice.ListReconciliationJobs).Methods(http.MethodGet)
+	r.HandleFunc("/admin/jobs/{job}", microservice.RunReconciliationJob).Methods(http.MethodPost)
+	r.Handle("/admin/metrics", expvar.Handler()).Methods(http.MethodGet)
+	r.HandleFunc("/admin/reload", gateway.GetReloadStatus).Methods(http.MethodGet)
+	r.HandleFunc("/admin/compensations", microservice.ListCompensations).Methods(http.MethodGet)
+	r.HandleFunc("/admin/compensations/{id}", microservice.RetryCompensation).Methods(http.MethodPost)
+	r.HandleFunc("/admin/compensations/{id}", microservice.DiscardCompensation).Methods(http.MethodDelete)
+	return r
 }
 
 func main() {
 
-	// Read the listening address of the gateway and the address of the other microservices
-	err := config.SetConfigurationFromEnvironment()
+	// The configuration is read from the configuration file, the environment and the command line flags, in
+	// increasing order of precedence
+	flags, err := config.ParseFlags(os.Args[0], os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
+	// On request the effective configuration is printed, with the secrets redacted, instead of starting the gateway
+	if flags.PrintConfig {
+		configuration, err := flags.ReadConfiguration()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		_ = config.PrintConfiguration(os.Stdout, configuration)
+		return
+	}
+	// Read the configuration, together with the route table and the access policy, and find the instances of the
+	// micro-services. The routes are either proxied to a micro-service or served by a Go handler, and every request is
+	// authorized according to the access policy before reaching its handler.
+	gateway, err := microservice.NewGateway(flags.ReadConfiguration)
 	if err != nil {
 		log.Panicln(err)
 	}
-	r := mux.NewRouter()
-	// Register the handlers for the various HTTP requests
-	r.HandleFunc("/didattica-mobile/api/v1.0/users", microservice.RegisterUser).Methods(http.MethodPost)
-	r.HandleFunc("/didattica-mobile/api/v1.0/token", microservice.LoginUser).Methods(http.MethodPost)
-	r.HandleFunc("/didattica-mobile/api/v1.0/courses", microservice.CreateCourse).Methods(http.MethodPost)
-	r.HandleFunc("/didattica-mobile/api/v1.0/courses/students/{username}", microservice.FindStudentCourses).Methods(http.MethodGet)
-	r.HandleFunc("/didattica-mobile/api/v1.0/courses/{by}/{string}", microservice.FindCourse).Methods(http.MethodGet)
-	r.HandleFunc("/didattica-mobile/api/v1.0/students/{username}", microservice.UnsubscribeStudentFromCourse).Methods(http.MethodDelete)
-	r.HandleFunc("/didattica-mobile/api/v1.0/students/{username}", microservice.AddCourseToStudent).Methods(http.MethodPut)
-	r.HandleFunc("/didattica-mobile/api/v1.0/exams", microservice.CreateExam).Methods(http.MethodPost)
-	r.HandleFunc("/didattica-mobile/api/v1.0/exams/{examId}/students/{studentUsername}", microservice.ReserveExam).Methods(http.MethodPut)
-	r.HandleFunc("/didattica-mobile/api/v1.0/exams/{course}", microservice.FindExamByCourse).Methods(http.MethodGet)
-	r.HandleFunc("/didattica-mobile/api/v1.0/teachingMaterials/{courseId}", microservice.FindTeachingMaterialByCourse).Methods(http.MethodGet)
-	r.HandleFunc("/didattica-mobile/api/v1.0/teachingMaterials/download/{username}/{courseId}/{fileName}", microservice.GetDownloadLinkToFile).Methods(http.MethodGet)
-	r.HandleFunc("/didattica-mobile/api/v1.0/notification/course/{courseId}", microservice.PushCourseNotification).Methods(http.MethodPost)
-	r.HandleFunc("/", healthCheck).Methods(http.MethodGet)
+	// Load the keys used to sign the access tokens
+	err = microservice.LoadSigningKeys()
+	if err != nil {
+		log.Panicln(err)
+	}
+	// Read the tokens revoked before the last shutdown
+	err = microservice.LoadRevokedTokens()
+	if err != nil {
+		log.Panicln(err)
+	}
+	// Read the compensations that failed before the last shutdown and retry them in background
+	err = microservice.LoadCompensationQueue()
+	if err != nil {
+		log.Panicln(err)
+	}
+	microservice.StartCompensationRetries()
+	// Read the sagas interrupted by the last shutdown and complete them in background
+	err = microservice.LoadSagaLog()
+	if err != nil {
+		log.Panicln(err)
+	}
+	go microservice.RecoverSagas()
+	// The configuration, the route table and the access policy are reloaded on SIGHUP and when their files change
+	go gateway.Watch()
+	// The health of the micro-services is checked periodically, so that the unhealthy instances receive no request
+	microservice.StartHealthChecks()
+	// The admin API is served on its own listener, so that it can be kept unreachable from the clients
+	if config.Get().AdminAddress != "" {
+		adminRouter := newAdminRouter(gateway)
+		go func() {
+			log.Fatal(http.ListenAndServe(config.Get().AdminAddress, adminRouter))
+		}()
+	}
 	// Wait for incoming requests. A new goroutine is created to serve each request
-	log.Fatal(http.ListenAndServe(config.Configuration.ApiGatewayAddress, r))
+	log.Fatal(http.ListenAndServe(config.Get().ApiGatewayAddress, gateway))
 }
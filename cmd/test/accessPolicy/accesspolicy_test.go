@@ -0,0 +1,87 @@
+package accessPolicy
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"github.com/redefik/sdccproject/apigateway/mock"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// createTestGatewayAccessPolicy creates an http handler that handles the test requests
+func createTestGatewayAccessPolicy() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/teachingMaterials/download/{username}/{courseId}/{fileName}",
+		microservice.GetDownloadLinkToFile).Methods(http.MethodGet)
+	r.HandleFunc("/didattica-mobile/api/v1.0/not-in-policy", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}).Methods(http.MethodGet)
+	return r
+}
+
+// sendRequest sends a GET request with the given token to the given url and returns the response of the api gateway
+func sendRequest(url string, token string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodGet, url, nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	createTestGatewayAccessPolicy().ServeHTTP(response, request)
+	return response
+}
+
+// TestRouteNotInPolicy tests the following scenario: the client invokes a route that is not covered by the access
+// policy. Since such routes are denied, the response should be 401 Unauthorized
+func TestRouteNotInPolicy(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	admin := microservice.User{Name: "nome", Surname: "cognome", Username: "admin", Password: "password", Type: "admin", Mail: "admin@example.com"}
+	token, _ := microservice.GenerateAccessToken(admin, []byte(config.Configuration.TokenPrivateKey))
+
+	response := sendRequest("/didattica-mobile/api/v1.0/not-in-policy", token)
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestDownloadOnBehalfOfAnotherStudent tests the following scenario: a student asks for a file of a course attended by
+// another student, using the username of the other student in the URL. The owner condition of the policy is not
+// satisfied, so the response should be 401 Unauthorized
+func TestDownloadOnBehalfOfAnotherStudent(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "another_student", Password: "password", Type: "student", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+
+	// a goroutine representing the microservice listens to the requests coming from the api gateway
+	go mock.LaunchCourseManagementMock()
+	// gives the mock the time to start listening
+	time.Sleep(100 * time.Millisecond)
+
+	response := sendRequest("/didattica-mobile/api/v1.0/teachingMaterials/download/student_user/course1/file1", token)
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestUnknownRoleDenied tests the following scenario: a user with a role not granted by the policy of the route asks
+// for a file. The response should be 401 Unauthorized
+func TestUnknownRoleDenied(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "student_user", Password: "password", Type: "tutor", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+
+	response := sendRequest("/didattica-mobile/api/v1.0/teachingMaterials/download/student_user/course1/file1", token)
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
@@ -0,0 +1,109 @@
+package adminApi
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// createTestGatewayAdminApi creates an http handler that handles the test requests of the admin API. The routes of
+// the admin API itself are listed as the routes of the api gateway.
+func createTestGatewayAdminApi() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/admin/routes", microservice.ListRoutes(r)).Methods(http.MethodGet)
+	r.HandleFunc("/admin/upstreams", microservice.GetUpstreamHealth).Methods(http.MethodGet)
+	r.HandleFunc("/admin/jobs", microservice.ListReconciliationJobs).Methods(http.MethodGet)
+	r.HandleFunc("/admin/jobs/{job}", microservice.RunReconciliationJob).Methods(http.MethodPost)
+	return r
+}
+
+// sendRequest sends a request with the given method and token to the given url and returns the response of the api
+// gateway
+func sendRequest(method string, url string, userType string) *httptest.ResponseRecorder {
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "admin", Password: "password", Type: userType, Mail: "admin@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(method, url, nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	createTestGatewayAdminApi().ServeHTTP(response, request)
+	return response
+}
+
+// TestListRoutes tests the following scenario: an administrator asks for the registered routes. The api gateway should
+// respond with 200 and the routes, each one with the roles allowed to invoke it.
+func TestListRoutes(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	response := sendRequest(http.MethodGet, "/admin/routes", "admin")
+	if response.Code != http.StatusOK {
+		t.Fatal("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	var routes []microservice.RouteInfo
+	err := json.Unmarshal(response.Body.Bytes(), &routes)
+	if err != nil || len(routes) != 4 {
+		t.Fatal("Expected 4 routes but got " + response.Body.String())
+	}
+	if routes[0].Path != "/admin/routes" || len(routes[0].Roles) != 1 || routes[0].Roles[0] != "admin" {
+		t.Error("Unexpected route " + response.Body.String())
+	}
+}
+
+// TestUpstreamHealth tests the following scenario: an administrator asks for the health of the micro-services. The api
+// gateway should respond with 200 and the health of the four micro-services, whether they are reachable or not.
+func TestUpstreamHealth(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	response := sendRequest(http.MethodGet, "/admin/upstreams", "admin")
+	if response.Code != http.StatusOK {
+		t.Fatal("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	var upstreams []microservice.UpstreamHealth
+	err := json.Unmarshal(response.Body.Bytes(), &upstreams)
+	if err != nil || len(upstreams) != 4 {
+		t.Error("Expected 4 upstreams but got " + response.Body.String())
+	}
+}
+
+// TestRunReconciliationJob tests the following scenario: an administrator triggers the job removing the expired tokens,
+// so the api gateway should respond with 200. Then an unknown job is triggered, so the response should be 404.
+func TestRunReconciliationJob(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	response := sendRequest(http.MethodPost, "/admin/jobs/purge-expired-tokens", "admin")
+	if response.Code != http.StatusOK {
+		t.Fatal("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	var job microservice.ReconciliationJob
+	err := json.Unmarshal(response.Body.Bytes(), &job)
+	if err != nil || job.LastRun.IsZero() {
+		t.Error("Expected the result of the job but got " + response.Body.String())
+	}
+
+	response = sendRequest(http.MethodPost, "/admin/jobs/unknown-job", "admin")
+	if response.Code != http.StatusNotFound {
+		t.Error("Expected 404 Not Found but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestAdminApiNotAllowed tests the following scenario: a teacher asks for the list of the jobs. The admin API is
+// allowed for the administrators only, therefore the Api Gateway should respond with Unauthorized.
+func TestAdminApiNotAllowed(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	response := sendRequest(http.MethodGet, "/admin/jobs", "teacher")
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
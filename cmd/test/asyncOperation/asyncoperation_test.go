@@ -0,0 +1,158 @@
+package asyncOperation
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestGatewayAsyncOperation creates an http handler that handles the test requests
+func createTestGatewayAsyncOperation() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses", microservice.CreateCourse).Methods(http.MethodPost)
+	r.HandleFunc("/didattica-mobile/api/v1.0/operations/{id}", microservice.GetOperation).Methods(http.MethodGet)
+	return r
+}
+
+// launchUpstream starts a micro-service that answers the creations with the given status and the deletions with 200
+func launchUpstream(creationStatus int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(creationStatus)
+			_, _ = w.Write([]byte(`{"id": "courseId", "name": "Advanced Calculus"}`))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// setUp loads the test configuration, with the given micro-services
+func setUp(courseServer *httptest.Server, notificationServer *httptest.Server) {
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.CourseManagementAddress = courseServer.URL + "/"
+	config.Configuration.NotificationManagementAddress = notificationServer.URL + "/"
+}
+
+// send sends a request with the given method, path and body to the api gateway on behalf of the teacher with the
+// given username, asking for an asynchronous response
+func send(method string, path string, body []byte, username string) *httptest.ResponseRecorder {
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: username, Password: "password", Type: "teacher", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Prefer", "respond-async")
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	createTestGatewayAsyncOperation().ServeHTTP(response, request)
+	return response
+}
+
+// createCourse asks the api gateway to create a course in asynchronous mode and returns the URL of the operation
+func createCourse(t *testing.T) string {
+	response := send(http.MethodPost, "/didattica-mobile/api/v1.0/courses", []byte(`{"name": "Advanced Calculus"}`), "username")
+	if response.Code != http.StatusAccepted {
+		t.Fatal("Expected 202 Accepted but got " + strconv.Itoa(response.Code) + " " + response.Body.String())
+	}
+	var operation microservice.Operation
+	err := json.Unmarshal(response.Body.Bytes(), &operation)
+	location := response.Header().Get("Location")
+	if err != nil || operation.Id == "" || !strings.HasSuffix(location, "/operations/"+operation.Id) {
+		t.Fatal("Expected the operation and its location, got " + location + " " + response.Body.String())
+	}
+	return location
+}
+
+// waitOperation polls the operation at the given URL until it is finished, and returns it
+func waitOperation(t *testing.T, location string) microservice.Operation {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		response := send(http.MethodGet, location, nil, "username")
+		var operation microservice.Operation
+		err := json.Unmarshal(response.Body.Bytes(), &operation)
+		if response.Code != http.StatusOK || err != nil {
+			t.Fatal("Expected the operation but got " + strconv.Itoa(response.Code) + " " + response.Body.String())
+		}
+		if operation.Response != nil {
+			return operation
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the operation to finish, got ", operation)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stepStatus returns the state of the step with the given name of the given operation
+func stepStatus(operation microservice.Operation, name string) string {
+	for _, step := range operation.Steps {
+		if step.Name == name {
+			return step.Status
+		}
+	}
+	return ""
+}
+
+// TestAsyncOperationCommitted tests the following scenario: a teacher asks for the creation of a course in
+// asynchronous mode, and both micro-services create it. The api gateway should respond with 202 and the operation
+// should be committed, with the response of course management. Other users should not see the operation.
+func TestAsyncOperationCommitted(t *testing.T) {
+
+	courseServer := launchUpstream(http.StatusCreated)
+	defer courseServer.Close()
+	notificationServer := launchUpstream(http.StatusCreated)
+	defer notificationServer.Close()
+	setUp(courseServer, notificationServer)
+
+	location := createCourse(t)
+	operation := waitOperation(t, location)
+
+	if operation.Status != "committed" || operation.Response.Status != http.StatusCreated ||
+		!strings.Contains(string(operation.Response.Body), "courseId") {
+		t.Error("Expected the operation to be committed with the created course, got ", operation)
+	}
+	for _, step := range []string{microservice.CourseManagement, microservice.NotificationManagement} {
+		if status := stepStatus(operation, step); status != "committed" {
+			t.Error("Expected the step " + step + " to be committed, got " + status)
+		}
+	}
+	response := send(http.MethodGet, location, nil, "another")
+	if response.Code != http.StatusNotFound {
+		t.Error("Expected 404 Not Found but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestAsyncOperationFailed tests the following scenario: a teacher asks for the creation of a course in asynchronous
+// mode, and notification management fails to create it. The operation should fail with the error of notification
+// management, and the creation in course management should be compensated.
+func TestAsyncOperationFailed(t *testing.T) {
+
+	courseServer := launchUpstream(http.StatusCreated)
+	defer courseServer.Close()
+	notificationServer := launchUpstream(http.StatusBadRequest)
+	defer notificationServer.Close()
+	setUp(courseServer, notificationServer)
+
+	location := createCourse(t)
+	operation := waitOperation(t, location)
+
+	if operation.Status != "failed" || operation.Response.Status != http.StatusBadRequest {
+		t.Error("Expected the operation to fail with 400 Bad Request, got ", operation)
+	}
+	if status := stepStatus(operation, microservice.NotificationManagement); status != "failed" {
+		t.Error("Expected the step in notification management to be failed, got " + status)
+	}
+	if status := stepStatus(operation, microservice.CourseManagement); status != "compensated" {
+		t.Error("Expected the step in course management to be compensated, got " + status)
+	}
+}
@@ -0,0 +1,132 @@
+package circuitBreaker
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Cool-down of the circuit breakers used in the tests
+const coolDown = 200 * time.Millisecond
+
+// createTestGatewayCircuitBreaker creates an http handler that handles the test requests
+func createTestGatewayCircuitBreaker() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses", microservice.CreateCourse).Methods(http.MethodPost)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses/{by}/{string}", microservice.FindCourse).Methods(http.MethodGet)
+	return r
+}
+
+// launchUpstream starts a micro-service that answers the requests with the status code stored in the given variable
+// and counts them in the given counter. The deletions, used to undo a creation, always succeed.
+func launchUpstream(statusCode *int32, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(statusCode)))
+		_, _ = w.Write([]byte("{}"))
+	}))
+}
+
+// setUp loads the test configuration, with circuit breakers that open after two failed requests
+func setUp() {
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	settings := config.UpstreamConfig{BreakerMinRequests: 2, BreakerCoolDownMs: int(coolDown / time.Millisecond)}
+	config.Configuration.Upstreams = map[string]config.UpstreamConfig{
+		microservice.CourseManagement:       settings,
+		microservice.NotificationManagement: settings,
+	}
+	microservice.ResetCircuitBreakers()
+}
+
+// sendRequest sends a request of a teacher with the given method and body to the given url and returns the response
+// of the api gateway
+func sendRequest(method string, url string, body []byte) *httptest.ResponseRecorder {
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "teacher", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(method, url, bytes.NewBuffer(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	createTestGatewayCircuitBreaker().ServeHTTP(response, request)
+	return response
+}
+
+// TestCircuitBreakerOpensAndCloses tests the following scenario: course management answers two requests with a server
+// error, so the circuit breaker opens and the third request is rejected with 503 without contacting course management.
+// When the cool-down is over and course management is back, a trial request succeeds and the breaker closes again.
+func TestCircuitBreakerOpensAndCloses(t *testing.T) {
+
+	setUp()
+	defer microservice.ResetCircuitBreakers()
+	statusCode, requests := int32(http.StatusInternalServerError), int32(0)
+	server := launchUpstream(&statusCode, &requests)
+	defer server.Close()
+	config.Configuration.CourseManagementAddress = server.URL + "/"
+
+	for i := 0; i < 2; i++ {
+		response := sendRequest(http.MethodGet, "/didattica-mobile/api/v1.0/courses/name/seq", nil)
+		if response.Code != http.StatusInternalServerError {
+			t.Fatal("Expected 500 Internal Server Error but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+		}
+	}
+	response := sendRequest(http.MethodGet, "/didattica-mobile/api/v1.0/courses/name/seq", nil)
+	if response.Code != http.StatusServiceUnavailable {
+		t.Fatal("Expected 503 Service Unavailable but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Error("Expected 2 requests to course management but got " + strconv.Itoa(int(atomic.LoadInt32(&requests))))
+	}
+
+	time.Sleep(coolDown)
+	atomic.StoreInt32(&statusCode, http.StatusOK)
+	for i := 0; i < 2; i++ {
+		response = sendRequest(http.MethodGet, "/didattica-mobile/api/v1.0/courses/name/seq", nil)
+		if response.Code != http.StatusOK {
+			t.Fatal("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+		}
+	}
+}
+
+// TestCreateCourseWithOpenCircuitBreaker tests the following scenario: the circuit breaker of notification management
+// is open, so the creation of a course is rejected with 503 and course management is not contacted at all.
+func TestCreateCourseWithOpenCircuitBreaker(t *testing.T) {
+
+	setUp()
+	defer microservice.ResetCircuitBreakers()
+	failingStatusCode, failingRequests := int32(http.StatusInternalServerError), int32(0)
+	failingServer := launchUpstream(&failingStatusCode, &failingRequests)
+	defer failingServer.Close()
+	statusCode, requests := int32(http.StatusCreated), int32(0)
+	server := launchUpstream(&statusCode, &requests)
+	defer server.Close()
+	config.Configuration.CourseManagementAddress = server.URL + "/"
+	config.Configuration.NotificationManagementAddress = failingServer.URL + "/"
+
+	// two failed subscriptions to notification management open its circuit breaker
+	for i := 0; i < 2; i++ {
+		sendRequest(http.MethodPost, "/didattica-mobile/api/v1.0/courses", []byte(`{"name": "course"}`))
+	}
+	atomic.StoreInt32(&requests, 0)
+
+	response := sendRequest(http.MethodPost, "/didattica-mobile/api/v1.0/courses", []byte(`{"name": "course"}`))
+	if response.Code != http.StatusServiceUnavailable {
+		t.Error("Expected 503 Service Unavailable but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if atomic.LoadInt32(&requests) != 0 {
+		t.Error("Expected no request to course management but got " + strconv.Itoa(int(atomic.LoadInt32(&requests))))
+	}
+}
@@ -0,0 +1,182 @@
+package compensationQueue
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// createTestGatewayCompensationQueue creates an http handler that handles the test requests
+func createTestGatewayCompensationQueue() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses", microservice.CreateCourse).Methods(http.MethodPost)
+	r.HandleFunc("/admin/compensations", microservice.ListCompensations).Methods(http.MethodGet)
+	r.HandleFunc("/admin/compensations/{id}", microservice.RetryCompensation).Methods(http.MethodPost)
+	r.HandleFunc("/admin/compensations/{id}", microservice.DiscardCompensation).Methods(http.MethodDelete)
+	return r
+}
+
+// launchCourseManagement starts a course management micro-service that creates the courses and answers the
+// deletions with the given status
+func launchCourseManagement(deletionStatus *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"id": "courseId", "name": "Advanced Calculus"}`))
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(deletionStatus)))
+	}))
+}
+
+// launchNotificationManagement starts a notification management micro-service that fails to create the courses
+func launchNotificationManagement() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error": "internal server error"}`))
+	}))
+}
+
+// setUp loads the test configuration, with the given micro-services, the given maximum number of attempts of the
+// compensations and a compensation queue persisted in the given directory
+func setUp(directory string, courseServer *httptest.Server, notificationServer *httptest.Server, maxAttempts int) {
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.CourseManagementAddress = courseServer.URL + "/"
+	config.Configuration.NotificationManagementAddress = notificationServer.URL + "/"
+	config.Configuration.CompensationQueueFile = filepath.Join(directory, "compensations.json")
+	config.Configuration.CompensationRetry = config.CompensationRetryConfig{MaxAttempts: maxAttempts}
+	// The failures of the micro-services neither open the circuit breakers nor eject the instances during the tests
+	settings := config.UpstreamConfig{BreakerMinRequests: 100, EjectionFailures: 100}
+	config.Configuration.Upstreams = map[string]config.UpstreamConfig{
+		microservice.CourseManagement:       settings,
+		microservice.NotificationManagement: settings,
+	}
+	microservice.ResetCircuitBreakers()
+	microservice.ResetLoadBalancers()
+}
+
+// send sends a request with the given method, path and body to the api gateway on behalf of a user of the given type
+func send(method string, path string, body []byte, userType string) *httptest.ResponseRecorder {
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: userType, Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	createTestGatewayCompensationQueue().ServeHTTP(response, request)
+	return response
+}
+
+// listCompensations returns the compensation queue, as returned to the administrators
+func listCompensations(t *testing.T) microservice.CompensationQueueStatus {
+	response := send(http.MethodGet, "/admin/compensations", nil, "admin")
+	var status microservice.CompensationQueueStatus
+	err := json.Unmarshal(response.Body.Bytes(), &status)
+	if response.Code != http.StatusOK || err != nil {
+		t.Fatal("Expected the compensation queue but got " + strconv.Itoa(response.Code) + " " + response.Body.String())
+	}
+	return status
+}
+
+// createCourse asks the api gateway to create a course. The creation fails in notification management, so the
+// course has to be deleted from course management.
+func createCourse(t *testing.T) {
+	response := send(http.MethodPost, "/didattica-mobile/api/v1.0/courses", []byte(`{"name": "Advanced Calculus"}`), "teacher")
+	if response.Code != http.StatusInternalServerError {
+		t.Error("Expected 500 Internal Server Error but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestCompensationRetried tests the following scenario: a course is created in course management but not in
+// notification management, and the deletion of the course from course management fails. The api gateway should not
+// crash and the deletion should be queued. When course management recovers, the administrator retries the deletion,
+// that should succeed and leave the queue.
+func TestCompensationRetried(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "compensations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	deletionStatus := int32(http.StatusInternalServerError)
+	courseServer := launchCourseManagement(&deletionStatus)
+	defer courseServer.Close()
+	notificationServer := launchNotificationManagement()
+	defer notificationServer.Close()
+	setUp(directory, courseServer, notificationServer, 5)
+
+	createCourse(t)
+
+	status := listCompensations(t)
+	if len(status.Pending) != 1 || status.Pending[0].Step != microservice.CourseManagement || status.Pending[0].Attempts != 1 {
+		t.Fatal("Expected the deletion from course management to be queued, got ", status)
+	}
+	content, _ := ioutil.ReadFile(config.Configuration.CompensationQueueFile)
+	if !bytes.Contains(content, []byte(status.Pending[0].Id)) {
+		t.Error("Expected the queue to be persisted, got " + string(content))
+	}
+
+	atomic.StoreInt32(&deletionStatus, http.StatusOK)
+	response := send(http.MethodPost, "/admin/compensations/"+status.Pending[0].Id, nil, "admin")
+	if response.Code != http.StatusOK {
+		t.Error("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + response.Body.String())
+	}
+	if status := listCompensations(t); len(status.Pending) != 0 || len(status.DeadLetters) != 0 {
+		t.Error("Expected an empty queue, got ", status)
+	}
+}
+
+// TestCompensationDeadLetter tests the following scenario: the deletion of a course from course management fails and
+// a single attempt is allowed, so the deletion should be moved to the dead letters. A retry by the administrator
+// fails again, then the administrator discards the deletion, that should leave the queue.
+func TestCompensationDeadLetter(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "compensations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	deletionStatus := int32(http.StatusInternalServerError)
+	courseServer := launchCourseManagement(&deletionStatus)
+	defer courseServer.Close()
+	notificationServer := launchNotificationManagement()
+	defer notificationServer.Close()
+	setUp(directory, courseServer, notificationServer, 1)
+
+	createCourse(t)
+
+	status := listCompensations(t)
+	if len(status.Pending) != 0 || len(status.DeadLetters) != 1 {
+		t.Fatal("Expected the deletion from course management in the dead letters, got ", status)
+	}
+	id := status.DeadLetters[0].Id
+
+	response := send(http.MethodPost, "/admin/compensations/"+id, nil, "admin")
+	if response.Code != http.StatusBadGateway {
+		t.Error("Expected 502 Bad Gateway but got " + strconv.Itoa(response.Code) + " " + response.Body.String())
+	}
+	response = send(http.MethodDelete, "/admin/compensations/"+id, nil, "admin")
+	if response.Code != http.StatusNoContent {
+		t.Error("Expected 204 No Content but got " + strconv.Itoa(response.Code) + " " + response.Body.String())
+	}
+	if status := listCompensations(t); len(status.Pending) != 0 || len(status.DeadLetters) != 0 {
+		t.Error("Expected an empty queue, got ", status)
+	}
+	response = send(http.MethodDelete, "/admin/compensations/"+id, nil, "admin")
+	if response.Code != http.StatusNotFound {
+		t.Error("Expected 404 Not Found but got " + strconv.Itoa(response.Code) + " " + response.Body.String())
+	}
+}
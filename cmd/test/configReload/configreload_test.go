@@ -0,0 +1,134 @@
+package configReload
+
+import (
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Time the slow route of teaching material management waits before answering
+const upstreamDelay = 300 * time.Millisecond
+
+// Route tables used by the tests: the first one exposes the teaching material under /materials, the second one under
+// /documents
+const (
+	materialsRouteTable = `{"routes": [{"path": "/materials/{courseId}", "methods": ["GET"],
+		"upstream": "teachingMaterialManagement", "upstreamPath": "list/{courseId}", "public": true}]}`
+	documentsRouteTable = `{"routes": [{"path": "/documents/{courseId}", "methods": ["GET"],
+		"upstream": "teachingMaterialManagement", "upstreamPath": "list/{courseId}", "public": true}]}`
+)
+
+// setUp starts a teaching material management micro-service, that answers slowly for the course "slow", and returns a
+// gateway whose route table is read from the returned file. The returned function stops the micro-service and removes
+// the file.
+func setUp(t *testing.T) (*microservice.Gateway, string, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/teaching_material_management/api/v1.0/list/slow" {
+			time.Sleep(upstreamDelay)
+		}
+		_, _ = w.Write([]byte("[]"))
+	}))
+	file, err := ioutil.TempFile("", "routes*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	writeRouteTable(t, file.Name(), materialsRouteTable)
+
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	configuration := config.Get()
+	configuration.TeachingMaterialManagementAddress = server.URL + "/teaching_material_management/api/v1.0/"
+	configuration.RouteFile = file.Name()
+	gateway, err := microservice.NewGateway(func() (config.Config, error) {
+		return configuration, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gateway, file.Name(), func() {
+		server.Close()
+		os.Remove(file.Name())
+	}
+}
+
+// writeRouteTable writes the given route table in the given file
+func writeRouteTable(t *testing.T, file string, content string) {
+	err := ioutil.WriteFile(file, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get sends a GET request with the given path to the given gateway and returns the status code of the response
+func get(gateway http.Handler, path string) int {
+	request, _ := http.NewRequest(http.MethodGet, path, nil)
+	response := httptest.NewRecorder()
+	gateway.ServeHTTP(response, request)
+	return response.Code
+}
+
+// TestReloadRoutes tests the following scenario: the route table is modified and the configuration is reloaded, so
+// the new route should be served and the old one should not. A request in flight during the reload should be served
+// by the old route, and the reload status should report the success.
+func TestReloadRoutes(t *testing.T) {
+
+	gateway, file, tearDown := setUp(t)
+	defer tearDown()
+	if code := get(gateway, "/materials/course1"); code != http.StatusOK {
+		t.Fatal("Expected 200 OK but got " + strconv.Itoa(code) + " " + http.StatusText(code))
+	}
+
+	inFlight := make(chan int)
+	go func() {
+		inFlight <- get(gateway, "/materials/slow")
+	}()
+	time.Sleep(upstreamDelay / 3)
+	writeRouteTable(t, file, documentsRouteTable)
+	err := gateway.Reload("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := <-inFlight; code != http.StatusOK {
+		t.Error("Expected the request in flight to get 200 OK but got " + strconv.Itoa(code) + " " + http.StatusText(code))
+	}
+	if code := get(gateway, "/documents/course1"); code != http.StatusOK {
+		t.Error("Expected 200 OK from the new route but got " + strconv.Itoa(code) + " " + http.StatusText(code))
+	}
+	if code := get(gateway, "/materials/course1"); code != http.StatusNotFound {
+		t.Error("Expected 404 Not Found from the old route but got " + strconv.Itoa(code) + " " + http.StatusText(code))
+	}
+	status := gateway.Status()
+	if status.Generation != 2 || status.LastError != "" || status.LastCause != "test" {
+		t.Error("Expected the reload status to report the second configuration")
+	}
+}
+
+// TestReloadInvalidRoutes tests the following scenario: the route table is replaced by an invalid one and the
+// configuration is reloaded, so the reload should fail, the old route should still be served and the reload status
+// should report the failure.
+func TestReloadInvalidRoutes(t *testing.T) {
+
+	gateway, file, tearDown := setUp(t)
+	defer tearDown()
+
+	writeRouteTable(t, file, `{"routes": [{"path": "/documents", "methods": ["GET"], "handler": "Unknown"}]}`)
+	err := gateway.Reload("test")
+	if err == nil {
+		t.Fatal("Expected the invalid route table to be refused")
+	}
+
+	if code := get(gateway, "/materials/course1"); code != http.StatusOK {
+		t.Error("Expected 200 OK from the old route but got " + strconv.Itoa(code) + " " + http.StatusText(code))
+	}
+	status := gateway.Status()
+	if status.Generation != 1 || status.LastError == "" || status.LastFailure.IsZero() {
+		t.Error("Expected the reload status to report the failure")
+	}
+}
@@ -16,6 +16,9 @@ import (
 // newCreateTestGatewayCreateCourse creates an http handler that handles the test requests
 func createTestGatewayCreateCourse() http.Handler {
 	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
 	r.HandleFunc("/didattica-mobile/api/v1.0/courses", microservice.CreateCourse).Methods(http.MethodPost)
 	return r
 }
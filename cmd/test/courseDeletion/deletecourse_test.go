@@ -0,0 +1,209 @@
+package courseDeletion
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// createTestGatewayDeleteCourse creates an http handler that handles the test requests
+func createTestGatewayDeleteCourse() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses/{courseId}", microservice.DeleteCourse).Methods(http.MethodDelete)
+	return r
+}
+
+// upstream simulates a micro-service that records the requests it receives and answers them with the status given
+// for their method
+type upstream struct {
+	sync.Mutex
+	requests []string
+	searches []string
+	statuses map[string]int
+}
+
+// launch starts the micro-service. The teacher "nome cognome" holds the course Advanced Calculus with id courseId.
+func (u *upstream) launch() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			u.Lock()
+			u.searches = append(u.searches, r.URL.Path)
+			u.Unlock()
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`[{"id": "courseId", "name": "Advanced Calculus", "department": "Science", "year": "2018-2019"}]`))
+			return
+		}
+		u.Lock()
+		u.requests = append(u.requests, r.Method+" "+r.URL.Path)
+		u.Unlock()
+		w.WriteHeader(u.statuses[r.Method])
+		_, _ = w.Write([]byte("{}"))
+	}))
+}
+
+// received returns the requests received by the micro-service, except the ones searching courses
+func (u *upstream) received() []string {
+	u.Lock()
+	defer u.Unlock()
+	return u.requests
+}
+
+// searched returns the requests searching courses received by the micro-service
+func (u *upstream) searched() []string {
+	u.Lock()
+	defer u.Unlock()
+	return u.searches
+}
+
+// teacher is the teacher holding the course with id courseId
+var teacher = microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "teacher", Mail: "name@example.com"}
+
+// deleteCourse sends to the api gateway a request of deletion of the course with id courseId, on behalf of the
+// teacher holding it, and returns the response
+func deleteCourse(courseManagement *upstream, notificationManagement *upstream) *httptest.ResponseRecorder {
+	return deleteCourseWithBody(courseManagement, notificationManagement, `{"name": "Advanced Calculus", "department": "Science", "year": "2018-2019"}`)
+}
+
+// deleteCourseWithBody sends to the api gateway a request of deletion of the course with id courseId, on behalf of
+// the teacher holding it, with the given body, and returns the response
+func deleteCourseWithBody(courseManagement *upstream, notificationManagement *upstream, body string) *httptest.ResponseRecorder {
+	return deleteCourseAs(courseManagement, notificationManagement, teacher, "courseId", body)
+}
+
+// deleteCourseAs sends to the api gateway a request of deletion of the course with the given id, on behalf of the
+// given user, with the given body, and returns the response
+func deleteCourseAs(courseManagement *upstream, notificationManagement *upstream, user microservice.User, courseId string, body string) *httptest.ResponseRecorder {
+	courseServer := courseManagement.launch()
+	defer courseServer.Close()
+	notificationServer := notificationManagement.launch()
+	defer notificationServer.Close()
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.CourseManagementAddress = courseServer.URL + "/"
+	config.Configuration.NotificationManagementAddress = notificationServer.URL + "/"
+
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(http.MethodDelete, "/didattica-mobile/api/v1.0/courses/"+courseId, bytes.NewBufferString(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	createTestGatewayDeleteCourse().ServeHTTP(response, request)
+	return response
+}
+
+// TestDeleteCourseSuccess tests the following scenario: the teacher holding a course asks for its deletion and both
+// micro-services delete it. The course should be deleted from notification management first and then from course
+// management, and the api gateway should respond with 200.
+func TestDeleteCourseSuccess(t *testing.T) {
+
+	courseManagement := &upstream{statuses: map[string]int{http.MethodDelete: http.StatusOK}}
+	notificationManagement := &upstream{statuses: map[string]int{http.MethodDelete: http.StatusOK}}
+	response := deleteCourse(courseManagement, notificationManagement)
+
+	if response.Code != http.StatusOK {
+		t.Error("Expected 200 Ok but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if requests := courseManagement.received(); len(requests) != 1 || requests[0] != "DELETE /courses/courseId" {
+		t.Error("Expected the deletion of the course in course management, got ", requests)
+	}
+	if requests := notificationManagement.received(); len(requests) != 1 || requests[0] != "DELETE /course" {
+		t.Error("Expected the deletion of the course in notification management, got ", requests)
+	}
+}
+
+// TestDeleteCourseFailureCourseManagement tests the following scenario: the course is deleted from notification
+// management, but the deletion fails in course management. The course should be created again in notification
+// management and the error of course management should be returned to the client.
+func TestDeleteCourseFailureCourseManagement(t *testing.T) {
+
+	courseManagement := &upstream{statuses: map[string]int{http.MethodDelete: http.StatusInternalServerError}}
+	notificationManagement := &upstream{statuses: map[string]int{http.MethodDelete: http.StatusOK, http.MethodPost: http.StatusCreated}}
+	response := deleteCourse(courseManagement, notificationManagement)
+
+	if response.Code != http.StatusInternalServerError {
+		t.Error("Expected 500 Internal Server Error but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if requests := notificationManagement.received(); len(requests) != 2 || requests[1] != "POST /course" {
+		t.Error("Expected the course to be created again in notification management, got ", requests)
+	}
+}
+
+// TestDeleteCourseFailureNotificationManagement tests the following scenario: the deletion fails in notification
+// management. The course should not be deleted from course management and the error of notification management should
+// be returned to the client.
+func TestDeleteCourseFailureNotificationManagement(t *testing.T) {
+
+	courseManagement := &upstream{statuses: map[string]int{http.MethodDelete: http.StatusOK}}
+	notificationManagement := &upstream{statuses: map[string]int{http.MethodDelete: http.StatusNotFound}}
+	response := deleteCourse(courseManagement, notificationManagement)
+
+	if response.Code != http.StatusNotFound {
+		t.Error("Expected 404 Not Found but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if requests := courseManagement.received(); len(requests) != 0 {
+		t.Error("Expected no request to course management, got ", requests)
+	}
+}
+
+// TestDeleteCourseBodyOfAnotherCourse tests the following scenario: the teacher holding the course with id courseId
+// asks for its deletion, but the body describes another course. The api gateway should respond with 400 and neither
+// micro-service should delete a course.
+func TestDeleteCourseBodyOfAnotherCourse(t *testing.T) {
+
+	courseManagement := &upstream{statuses: map[string]int{http.MethodDelete: http.StatusOK}}
+	notificationManagement := &upstream{statuses: map[string]int{http.MethodDelete: http.StatusOK}}
+	response := deleteCourseWithBody(courseManagement, notificationManagement, `{"name": "Machine Learning", "department": "Computer Science", "year": "2018-2019"}`)
+
+	if response.Code != http.StatusBadRequest {
+		t.Error("Expected 400 Bad Request but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if requests := append(courseManagement.received(), notificationManagement.received()...); len(requests) != 0 {
+		t.Error("Expected no deletion, got ", requests)
+	}
+}
+
+// TestDeleteCourseForgetsOwnership tests the following scenario: the teacher holding a course deletes it, then asks
+// again for its deletion. The courses held by the teacher should be asked again to course management, since the cached
+// ones contain the deleted course.
+func TestDeleteCourseForgetsOwnership(t *testing.T) {
+
+	courseManagement := &upstream{statuses: map[string]int{http.MethodDelete: http.StatusOK}}
+	notificationManagement := &upstream{statuses: map[string]int{http.MethodDelete: http.StatusOK}}
+	response := deleteCourse(courseManagement, notificationManagement)
+	if response.Code != http.StatusOK {
+		t.Fatal("Expected 200 Ok but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+
+	courseManagement = &upstream{statuses: map[string]int{http.MethodDelete: http.StatusOK}}
+	deleteCourse(courseManagement, notificationManagement)
+	if searches := courseManagement.searched(); len(searches) == 0 || searches[0] != "/courses/teacher/nome-cognome" {
+		t.Error("Expected the courses of the teacher to be asked again, got ", searches)
+	}
+}
+
+// TestDeleteCourseNotHeldRefetchedOnce tests the following scenario: a teacher asks three times for the deletion of
+// a course that they do not hold. The courses held by the teacher should be asked to course management at the first
+// request and asked again only once while they are cached, so the third request should be rejected without asking.
+func TestDeleteCourseNotHeldRefetchedOnce(t *testing.T) {
+
+	anotherTeacher := microservice.User{Name: "altro", Surname: "docente", Username: "another", Password: "password", Type: "teacher", Mail: "another@example.com"}
+	courseManagement := &upstream{statuses: map[string]int{http.MethodDelete: http.StatusOK}}
+	notificationManagement := &upstream{statuses: map[string]int{http.MethodDelete: http.StatusOK}}
+	for i := 0; i < 3; i++ {
+		response := deleteCourseAs(courseManagement, notificationManagement, anotherTeacher, "anotherCourseId", `{"name": "Advanced Calculus", "department": "Science", "year": "2018-2019"}`)
+		if response.Code != http.StatusUnauthorized {
+			t.Fatal("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+		}
+	}
+	if searches := courseManagement.searched(); len(searches) != 2 {
+		t.Error("Expected the courses of the teacher to be asked twice, got ", searches)
+	}
+}
@@ -17,6 +17,9 @@ import (
 // createTestGatewayAddCourseToStudent creates an http handler that handles the test requests
 func createTestGatewayAddCourseToStudent() http.Handler {
 	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
 	r.HandleFunc("/didattica-mobile/api/v1.0/students/{username}",
 		microservice.AddCourseToStudent).Methods(http.MethodPut)
 	return r
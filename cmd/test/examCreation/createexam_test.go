@@ -11,11 +11,15 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 )
 
 // createTestGatewayCreateExam creates an http handler that handles the test requests
 func createTestGatewayCreateExam() http.Handler {
 	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
 	r.HandleFunc("/didattica-mobile/api/v1.0/exams", microservice.CreateExam).Methods(http.MethodPost)
 	return r
 }
@@ -134,3 +138,42 @@ func TestCreateExamWithTokenBadSigned(t *testing.T) {
 		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
 	}
 }
+
+/*TestCreateExamNotHeldCourse tests the following scenario: a teacher makes an exam creation request for a course held
+by another teacher. This operation is allowed for the teacher holding the course only, therefore the Api Gateway should
+respond with Unauthorized.*/
+func TestCreateExamNotHeldCourse(t *testing.T) {
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	// build the information of the exam to be created
+	jsonBody := simplejson.New()
+	jsonBody.Set("course", "IdAltroCorso")
+	jsonBody.Set("call", 1)
+	jsonBody.Set("date", "21-03-2019")
+	jsonBody.Set("startTime", "10:30")
+	jsonBody.Set("room", "A2")
+	jsonBody.Set("expirationDate", "20-03-2019")
+
+	// generate a token to be appended to the exam creation request
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "teacher", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+
+	// make the POST request for the exam creation
+	requestBody, _ := jsonBody.MarshalJSON()
+	request, _ := http.NewRequest(http.MethodPost, "/didattica-mobile/api/v1.0/exams", bytes.NewBuffer(requestBody))
+	request.Header.Set("Content-Type", "application/json")
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+
+	response := httptest.NewRecorder()
+	handler := createTestGatewayCreateExam()
+	// a goroutine representing the microservice listens to the requests coming from the api gateway
+	go mock.LaunchCourseManagementMock()
+	// gives the mock the time to start listening
+	time.Sleep(100 * time.Millisecond)
+	// simulates a request-response interaction between client and api gateway
+	handler.ServeHTTP(response, request)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
@@ -14,6 +14,9 @@ import (
 // reserveExam creates an http handler that handles the test requests
 func createTestGatewayReserveExam() http.Handler {
 	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
 	r.HandleFunc("/didattica-mobile/api/v1.0/exams/{examId}/students/{studentUsername}", microservice.ReserveExam).Methods(http.MethodPut)
 	return r
 }
@@ -51,7 +54,7 @@ func TestReserveExamNotExistentStudent(t *testing.T) {
 	config.SetConfigurationFromFile("../../../config/config-test.json")
 
 	// generate a token to be appended to the request
-	user := microservice.User{Name: "nome", Surname: "cognome", Username: "existent_student", Password: "password", Type: "student", Mail: "name@example.com"}
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "not_existent_student", Password: "password", Type: "student", Mail: "name@example.com"}
 	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
 
 	// make the PUT request for the exam reservation
@@ -94,3 +97,51 @@ func TestReserveExamNotExistentExam(t *testing.T) {
 		t.Error("Expected 404 Not Found but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
 	}
 }
+
+// TestReserveExamOtherStudent tests the following scenario: a student tries to make an exam reservation on behalf of
+// another student, then the response should be 401 Unauthorized
+func TestReserveExamOtherStudent(t *testing.T) {
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	// generate a token to be appended to the request
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "another_student", Password: "password", Type: "student", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+
+	// make the PUT request for the exam reservation
+	request, _ := http.NewRequest(http.MethodPut, "/didattica-mobile/api/v1.0/exams/existent_exam/students/existent_student", nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+
+	response := httptest.NewRecorder()
+	handler := createTestGatewayReserveExam()
+	// simulates a request-response interaction between client and api gateway
+	handler.ServeHTTP(response, request)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestReserveExamByAdmin tests the following scenario: an administrator makes an exam reservation on behalf of a
+// student. Since the administrators can act on behalf of any user, the response should be 200 OK
+func TestReserveExamByAdmin(t *testing.T) {
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	// generate a token to be appended to the request
+	admin := microservice.User{Name: "nome", Surname: "cognome", Username: "admin", Password: "password", Type: "admin", Mail: "admin@example.com"}
+	token, _ := microservice.GenerateAccessToken(admin, []byte(config.Configuration.TokenPrivateKey))
+
+	// make the PUT request for the exam reservation
+	request, _ := http.NewRequest(http.MethodPut, "/didattica-mobile/api/v1.0/exams/existent_exam/students/existent_student", nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+
+	response := httptest.NewRecorder()
+	handler := createTestGatewayReserveExam()
+	// a goroutine representing the microservice listens to the requests coming from the api gateway
+	go mock.LaunchCourseManagementMock()
+	// simulates a request-response interaction between client and api gateway
+	handler.ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Error("Expected 200 Ok but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
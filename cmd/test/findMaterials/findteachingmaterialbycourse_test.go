@@ -15,6 +15,9 @@ import (
 // createTestGatewayFindTeachingMaterialByCourse creates an http handler that handles the test requests
 func createTestGatewayFindTeachingMaterialByCourse() http.Handler {
 	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
 	r.HandleFunc("/didattica-mobile/api/v1.0/teachingMaterials/{courseId}",
 		microservice.FindTeachingMaterialByCourse).Methods(http.MethodGet)
 	return r
@@ -19,6 +19,9 @@ import (
 // createTestGatewayGetDownloadLink creates an http handler that handles the test requests
 func createTestGatewayGetDownloadLink() http.Handler {
 	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
 	r.HandleFunc("/didattica-mobile/api/v1.0/teachingMaterials/download/{username}/{courseId}/{fileName}",
 		microservice.GetDownloadLinkToFile).Methods(http.MethodGet)
 	return r
@@ -14,6 +14,9 @@ import (
 // createTestGatewayGetStudentCourses creates an http handler that handles the test requests
 func createTestGatewayGetStudentCourses() http.Handler {
 	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
 	r.HandleFunc("/didattica-mobile/api/v1.0/courses/students/{username}", microservice.FindStudentCourses).Methods(http.MethodGet)
 	return r
 }
@@ -0,0 +1,115 @@
+package healthCheck
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// createTestGatewayHealthCheck creates an http handler that handles the test requests
+func createTestGatewayHealthCheck() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/health/live", microservice.Liveness).Methods(http.MethodGet)
+	r.HandleFunc("/health/ready", microservice.Readiness).Methods(http.MethodGet)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses/{by}/{string}", microservice.FindCourse).Methods(http.MethodGet)
+	return r
+}
+
+// sendRequest sends a request of a student to the given url and returns the response of the api gateway
+func sendRequest(url string) *httptest.ResponseRecorder {
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "student", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(http.MethodGet, url, nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	createTestGatewayHealthCheck().ServeHTTP(response, request)
+	return response
+}
+
+// dependency returns the state of the given micro-service in the given answer of the readiness endpoint
+func dependency(response *httptest.ResponseRecorder, name string) microservice.DependencyStatus {
+	var readiness microservice.ReadinessStatus
+	_ = json.Unmarshal(response.Body.Bytes(), &readiness)
+	for _, dependency := range readiness.Dependencies {
+		if dependency.Name == name {
+			return dependency
+		}
+	}
+	return microservice.DependencyStatus{}
+}
+
+// TestLiveness tests the following scenario: an external component checks if the api gateway is running, so the
+// response should be 200 OK.
+func TestLiveness(t *testing.T) {
+
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	response := sendRequest("/health/live")
+	if response.Code != http.StatusOK {
+		t.Error("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestReadiness tests the following scenario: course management has two instances and the health checks of one of them
+// fail twice, so it becomes unhealthy and the requests reach the other instance only. Then also the other instance
+// becomes unhealthy, so the api gateway is not ready. When an instance recovers, the api gateway is ready again.
+func TestReadiness(t *testing.T) {
+
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	statusCodes := []int32{http.StatusInternalServerError, http.StatusOK}
+	requests := []int32{0, 0}
+	var instances []string
+	for i := range statusCodes {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests[i], 1)
+			w.WriteHeader(int(atomic.LoadInt32(&statusCodes[i])))
+			_, _ = w.Write([]byte("[]"))
+		}))
+		defer server.Close()
+		instances = append(instances, server.URL+"/")
+	}
+	config.Configuration.Upstreams = map[string]config.UpstreamConfig{microservice.CourseManagement: {
+		Instances: instances, HealthCheckPath: "health", HealthyThreshold: 1, UnhealthyThreshold: 2, BreakerMinRequests: 100,
+	}}
+	microservice.ResetLoadBalancers()
+	defer microservice.ResetLoadBalancers()
+
+	microservice.CheckUpstreamHealth(microservice.CourseManagement)
+	microservice.CheckUpstreamHealth(microservice.CourseManagement)
+	atomic.StoreInt32(&requests[0], 0)
+	for i := 0; i < 4; i++ {
+		sendRequest("/didattica-mobile/api/v1.0/courses/name/seq")
+	}
+	if atomic.LoadInt32(&requests[0]) != 0 {
+		t.Error("Expected no request to the unhealthy instance but got " + strconv.Itoa(int(atomic.LoadInt32(&requests[0]))))
+	}
+	response := sendRequest("/health/ready")
+	if response.Code != http.StatusOK || !dependency(response, microservice.CourseManagement).Healthy {
+		t.Error("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + response.Body.String())
+	}
+
+	atomic.StoreInt32(&statusCodes[1], http.StatusInternalServerError)
+	microservice.CheckUpstreamHealth(microservice.CourseManagement)
+	microservice.CheckUpstreamHealth(microservice.CourseManagement)
+	response = sendRequest("/health/ready")
+	if response.Code != http.StatusServiceUnavailable || dependency(response, microservice.CourseManagement).Healthy {
+		t.Error("Expected 503 Service Unavailable but got " + strconv.Itoa(response.Code) + " " + response.Body.String())
+	}
+
+	atomic.StoreInt32(&statusCodes[0], http.StatusOK)
+	microservice.CheckUpstreamHealth(microservice.CourseManagement)
+	response = sendRequest("/health/ready")
+	if response.Code != http.StatusOK {
+		t.Error("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + response.Body.String())
+	}
+}
@@ -0,0 +1,201 @@
+package idempotencyKey
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createTestGatewayIdempotencyKey creates an http handler that handles the test requests
+func createTestGatewayIdempotencyKey() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.Use(microservice.IdempotencyMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses", microservice.CreateCourse).Methods(http.MethodPost)
+	return r
+}
+
+// launchCourseManagement starts a course management micro-service that counts the courses it is asked to create and
+// answers with the status returned by the given function, called with the number of the creation
+func launchCourseManagement(creations *int32, status func(creation int32) int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		creation := atomic.AddInt32(creations, 1)
+		w.WriteHeader(status(creation))
+		_, _ = w.Write([]byte(`{"id": "course` + strconv.Itoa(int(creation)) + `", "name": "Advanced Calculus"}`))
+	}))
+}
+
+// launchNotificationManagement starts a notification management micro-service that creates the courses
+func launchNotificationManagement() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+}
+
+// setUp loads the test configuration, with the given micro-services
+func setUp(courseServer *httptest.Server, notificationServer *httptest.Server) {
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.CourseManagementAddress = courseServer.URL + "/"
+	config.Configuration.NotificationManagementAddress = notificationServer.URL + "/"
+}
+
+// newIdempotencyKey returns an idempotency key that has not been used before, so that the outcomes stored by the
+// api gateway for the previous tests are not replayed
+func newIdempotencyKey() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// createCourse asks the api gateway to create a course on behalf of the given teacher, with the given idempotency key
+func createCourse(username string, idempotencyKey string) *httptest.ResponseRecorder {
+	return createCourseWithBody(username, idempotencyKey, `{"name": "Advanced Calculus"}`)
+}
+
+// createCourseWithBody asks the api gateway to create the course described by the given body on behalf of the given
+// teacher, with the given idempotency key
+func createCourseWithBody(username string, idempotencyKey string, body string) *httptest.ResponseRecorder {
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: username, Password: "password", Type: "teacher", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(http.MethodPost, "/didattica-mobile/api/v1.0/courses", bytes.NewBuffer([]byte(body)))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Idempotency-Key", idempotencyKey)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	createTestGatewayIdempotencyKey().ServeHTTP(response, request)
+	return response
+}
+
+// TestIdempotencyKeyReplayed tests the following scenario: a teacher repeats the creation of a course with the same
+// idempotency key. The course should be created once, and the repetition should receive the stored response. The same
+// key used by another teacher should not be affected.
+func TestIdempotencyKeyReplayed(t *testing.T) {
+
+	var creations int32
+	courseServer := launchCourseManagement(&creations, func(int32) int { return http.StatusCreated })
+	defer courseServer.Close()
+	notificationServer := launchNotificationManagement()
+	defer notificationServer.Close()
+	setUp(courseServer, notificationServer)
+	idempotencyKey := newIdempotencyKey()
+
+	first := createCourse("username", idempotencyKey)
+	second := createCourse("username", idempotencyKey)
+
+	if first.Code != http.StatusCreated || second.Code != http.StatusCreated {
+		t.Fatal("Expected 201 Created twice but got " + strconv.Itoa(first.Code) + " and " + strconv.Itoa(second.Code))
+	}
+	if second.Body.String() != first.Body.String() || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected the stored response to be replayed, got " + second.Body.String())
+	}
+	if atomic.LoadInt32(&creations) != 1 {
+		t.Error("Expected the course to be created once, got " + strconv.Itoa(int(atomic.LoadInt32(&creations))))
+	}
+	other := createCourse("another", idempotencyKey)
+	if other.Code != http.StatusCreated || other.Header().Get("Idempotent-Replayed") != "" || atomic.LoadInt32(&creations) != 2 {
+		t.Error("Expected the course to be created for another teacher, got " + strconv.Itoa(other.Code))
+	}
+}
+
+// TestIdempotencyKeyDifferentBody tests the following scenario: a teacher creates a course with an idempotency key,
+// then reuses the key to create another course. The second request should be rejected with 422 and not be executed.
+func TestIdempotencyKeyDifferentBody(t *testing.T) {
+
+	var creations int32
+	courseServer := launchCourseManagement(&creations, func(int32) int { return http.StatusCreated })
+	defer courseServer.Close()
+	notificationServer := launchNotificationManagement()
+	defer notificationServer.Close()
+	setUp(courseServer, notificationServer)
+	idempotencyKey := newIdempotencyKey()
+
+	first := createCourse("username", idempotencyKey)
+	second := createCourseWithBody("username", idempotencyKey, `{"name": "Linear Algebra"}`)
+
+	if first.Code != http.StatusCreated {
+		t.Fatal("Expected 201 Created but got " + strconv.Itoa(first.Code))
+	}
+	if second.Code != http.StatusUnprocessableEntity || second.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("Expected 422 Unprocessable Entity but got " + strconv.Itoa(second.Code) + " " + second.Body.String())
+	}
+	if atomic.LoadInt32(&creations) != 1 {
+		t.Error("Expected the course to be created once, got " + strconv.Itoa(int(atomic.LoadInt32(&creations))))
+	}
+}
+
+// TestIdempotencyKeyServerError tests the following scenario: the creation of a course fails in course management with
+// a server error, then the teacher repeats it with the same idempotency key. The failure should not be stored, so the
+// course should be created by the repetition.
+func TestIdempotencyKeyServerError(t *testing.T) {
+
+	var creations int32
+	courseServer := launchCourseManagement(&creations, func(creation int32) int {
+		if creation == 1 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusCreated
+	})
+	defer courseServer.Close()
+	notificationServer := launchNotificationManagement()
+	defer notificationServer.Close()
+	setUp(courseServer, notificationServer)
+	idempotencyKey := newIdempotencyKey()
+
+	first := createCourse("username", idempotencyKey)
+	second := createCourse("username", idempotencyKey)
+
+	if first.Code != http.StatusInternalServerError {
+		t.Error("Expected 500 Internal Server Error but got " + strconv.Itoa(first.Code))
+	}
+	if second.Code != http.StatusCreated || second.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("Expected the course to be created again, got " + strconv.Itoa(second.Code) + " " + second.Body.String())
+	}
+}
+
+// TestIdempotencyKeyConcurrentDuplicate tests the following scenario: a teacher repeats the creation of a course with
+// the same idempotency key while the first request is in progress. The repetition should be rejected with 409, and
+// the course should be created once.
+func TestIdempotencyKeyConcurrentDuplicate(t *testing.T) {
+
+	var creations int32
+	received := make(chan struct{})
+	release := make(chan struct{})
+	courseServer := launchCourseManagement(&creations, func(int32) int {
+		close(received)
+		<-release
+		return http.StatusCreated
+	})
+	defer courseServer.Close()
+	notificationServer := launchNotificationManagement()
+	defer notificationServer.Close()
+	setUp(courseServer, notificationServer)
+	idempotencyKey := newIdempotencyKey()
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- createCourse("username", idempotencyKey)
+	}()
+	<-received
+	duplicate := createCourse("username", idempotencyKey)
+	close(release)
+	first := <-done
+
+	if duplicate.Code != http.StatusConflict {
+		t.Error("Expected 409 Conflict but got " + strconv.Itoa(duplicate.Code) + " " + http.StatusText(duplicate.Code))
+	}
+	if first.Code != http.StatusCreated || atomic.LoadInt32(&creations) != 1 {
+		t.Error("Expected the course to be created once, got " + strconv.Itoa(first.Code))
+	}
+}
@@ -0,0 +1,186 @@
+package layeredConfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigurationFile writes the given content in a file with the given name inside a temporary directory and
+// returns its path
+func writeConfigurationFile(t *testing.T, directory string, name string, content string) string {
+	file := filepath.Join(directory, name)
+	err := ioutil.WriteFile(file, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// readConfiguration parses the given command line arguments and reads the configuration accordingly
+func readConfiguration(t *testing.T, arguments ...string) (config.Config, error) {
+	flags, err := config.ParseFlags("apigateway", arguments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flags.ReadConfiguration()
+}
+
+const jsonConfiguration = `{
+  "apiGatewayAddress": "0.0.0.0:80",
+  "userManagementAddress": "http://user:80/user_management/api/v1.0/",
+  "courseManagementAddress": "http://course:80/course_management/api/v1.0/",
+  "teachingMaterialManagementAddress": "http://teaching:80/teaching_material_management/api/v1.0/",
+  "notificationManagementAddress": "http://notification:80/notification_management/api/v1.0/",
+  "tokenPrivateKey": "secret",
+  "refreshTokenLifetimeHours": 24
+}`
+
+// TestConfigurationPrecedence tests the following scenario: the same settings are given in the configuration file, in
+// the environment and on the command line. The environment should override the file and the flags should override
+// both, while the settings given only in the file should keep their values.
+func TestConfigurationPrecedence(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	file := writeConfigurationFile(t, directory, "config.json", jsonConfiguration)
+
+	_ = os.Setenv("USER_ADDR", "http://user-env:80/user_management/api/v1.0/")
+	defer os.Unsetenv("USER_ADDR")
+	_ = os.Setenv("COURSE_ADDR", "http://course-env:80/course_management/api/v1.0/")
+	defer os.Unsetenv("COURSE_ADDR")
+
+	configuration, err := readConfiguration(t, "--config", file, "--course-addr",
+		"http://course-flag:80/course_management/api/v1.0/", "--trust-forwarded-for")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configuration.ConfigFile != file {
+		t.Error("Expected configuration file " + file + ", got " + configuration.ConfigFile)
+	}
+	if configuration.TeachingMaterialManagementAddress != "http://teaching:80/teaching_material_management/api/v1.0/" {
+		t.Error("Expected the teaching material address of the file, got " + configuration.TeachingMaterialManagementAddress)
+	}
+	if configuration.UserManagementAddress != "http://user-env:80/user_management/api/v1.0/" {
+		t.Error("Expected the user address of the environment, got " + configuration.UserManagementAddress)
+	}
+	if configuration.CourseManagementAddress != "http://course-flag:80/course_management/api/v1.0/" {
+		t.Error("Expected the course address of the flag, got " + configuration.CourseManagementAddress)
+	}
+	if !configuration.TrustForwardedFor || configuration.RefreshTokenLifetimeHours != 24 {
+		t.Error("Expected the boolean flag and the lifetime of the file to be applied")
+	}
+	if configuration.PolicyFile != "policy.json" {
+		t.Error("Expected the default policy file, got " + configuration.PolicyFile)
+	}
+}
+
+// TestConfigurationFormats tests the following scenario: the same configuration is written in YAML and in TOML. Both
+// files should be read with the same keys as the JSON one.
+func TestConfigurationFormats(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	files := map[string]string{
+		"config.yaml": `apiGatewayAddress: "0.0.0.0:80"
+userManagementAddress: "http://user:80/user_management/api/v1.0/"
+courseManagementAddress: "http://course:80/course_management/api/v1.0/"
+teachingMaterialManagementAddress: "http://teaching:80/teaching_material_management/api/v1.0/"
+notificationManagementAddress: "http://notification:80/notification_management/api/v1.0/"
+tokenPrivateKey: "secret"
+upstreams:
+  courseManagement:
+    timeoutMs: 2500
+    instances: ["http://course-1:80/course_management/api/v1.0/"]
+`,
+		"config.toml": `apiGatewayAddress = "0.0.0.0:80"
+userManagementAddress = "http://user:80/user_management/api/v1.0/"
+courseManagementAddress = "http://course:80/course_management/api/v1.0/"
+teachingMaterialManagementAddress = "http://teaching:80/teaching_material_management/api/v1.0/"
+notificationManagementAddress = "http://notification:80/notification_management/api/v1.0/"
+tokenPrivateKey = "secret"
+
+[upstreams.courseManagement]
+timeoutMs = 2500
+instances = ["http://course-1:80/course_management/api/v1.0/"]
+`,
+	}
+	for name, content := range files {
+		file := writeConfigurationFile(t, directory, name, content)
+		configuration, err := readConfiguration(t, "--config", file)
+		if err != nil {
+			t.Error(name + ": " + err.Error())
+			continue
+		}
+		upstream := configuration.Upstreams["courseManagement"]
+		if configuration.TokenPrivateKey != "secret" || upstream.TimeoutMs != 2500 || len(upstream.Instances) != 1 {
+			t.Error(name + ": the configuration was not read correctly")
+		}
+	}
+}
+
+// TestInvalidConfiguration tests the following scenario: the configuration lacks an address and has an invalid
+// signing algorithm and an invalid integer in the environment. The error should name every problem.
+func TestInvalidConfiguration(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	file := writeConfigurationFile(t, directory, "config.json", strings.Replace(jsonConfiguration,
+		`"apiGatewayAddress": "0.0.0.0:80",`, `"tokenSigningAlgorithm": "none",`, 1))
+
+	_ = os.Setenv("LOGIN_LOCKOUT_SECONDS", "ten")
+	defer os.Unsetenv("LOGIN_LOCKOUT_SECONDS")
+
+	_, err = readConfiguration(t, "--config", file)
+	validationError, ok := err.(config.ValidationError)
+	if !ok {
+		t.Fatal("Expected a validation error, got ", err)
+	}
+	for _, field := range []string{"APIGATEWAY_ADDR", "TOKEN_SIGNING_ALGORITHM", "LOGIN_LOCKOUT_SECONDS"} {
+		if !strings.Contains(validationError.Error(), field) {
+			t.Error("Expected a problem with " + field + ", got " + validationError.Error())
+		}
+	}
+	if len(validationError.Problems) != 3 {
+		t.Error("Expected 3 problems, got ", validationError.Problems)
+	}
+}
+
+// TestPrintConfiguration tests the following scenario: the effective configuration is printed. The private key should
+// be redacted, while the other settings should be printed as they are.
+func TestPrintConfiguration(t *testing.T) {
+
+	var configuration config.Config
+	_ = json.Unmarshal([]byte(jsonConfiguration), &configuration)
+
+	var output bytes.Buffer
+	err := config.PrintConfiguration(&output, configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var printed config.Config
+	err = json.Unmarshal(output.Bytes(), &printed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output.String(), "secret") || printed.TokenPrivateKey == "" {
+		t.Error("Expected the private key to be redacted, got " + printed.TokenPrivateKey)
+	}
+	if printed.UserManagementAddress != configuration.UserManagementAddress {
+		t.Error("Expected the user address to be printed, got " + printed.UserManagementAddress)
+	}
+}
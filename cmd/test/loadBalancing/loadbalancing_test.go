@@ -0,0 +1,151 @@
+package loadBalancing
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createTestGatewayLoadBalancing creates an http handler that handles the test requests
+func createTestGatewayLoadBalancing() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses/{by}/{string}", microservice.FindCourse).Methods(http.MethodGet)
+	return r
+}
+
+// instance is an instance of course management that answers with the status code stored in statusCode and counts the
+// requests it receives
+type instance struct {
+	server     *httptest.Server
+	statusCode int32
+	requests   int32
+}
+
+// launchInstances starts the given number of instances of course management, all answering 200 OK
+func launchInstances(number int) []*instance {
+	instances := make([]*instance, number)
+	for i := range instances {
+		current := &instance{statusCode: http.StatusOK}
+		current.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&current.requests, 1)
+			w.WriteHeader(int(atomic.LoadInt32(&current.statusCode)))
+			_, _ = w.Write([]byte("[]"))
+		}))
+		instances[i] = current
+	}
+	return instances
+}
+
+// setUp loads the test configuration, with course management balanced across the given instances according to the
+// given settings. The circuit breaker does not open during the tests.
+func setUp(instances []*instance, settings config.UpstreamConfig) {
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	for _, current := range instances {
+		settings.Instances = append(settings.Instances, current.server.URL+"/")
+	}
+	settings.BreakerMinRequests = 100
+	config.Configuration.Upstreams = map[string]config.UpstreamConfig{microservice.CourseManagement: settings}
+	microservice.ResetLoadBalancers()
+	microservice.ResetCircuitBreakers()
+}
+
+// tearDown stops the given instances and the probes of the load balancers
+func tearDown(instances []*instance) {
+	microservice.ResetLoadBalancers()
+	for _, current := range instances {
+		current.server.Close()
+	}
+}
+
+// searchCourse sends a course searching request of the user with the given username and returns the response of the
+// api gateway
+func searchCourse(username string) *httptest.ResponseRecorder {
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: username, Password: "password", Type: "student", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(http.MethodGet, "/didattica-mobile/api/v1.0/courses/name/seq", nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	createTestGatewayLoadBalancing().ServeHTTP(response, request)
+	return response
+}
+
+// TestRoundRobin tests the following scenario: course management has two instances balanced in round-robin, so four
+// requests should be split evenly between them.
+func TestRoundRobin(t *testing.T) {
+
+	instances := launchInstances(2)
+	defer tearDown(instances)
+	setUp(instances, config.UpstreamConfig{Balancer: "round-robin"})
+
+	for i := 0; i < 4; i++ {
+		searchCourse("username")
+	}
+	for i, current := range instances {
+		if atomic.LoadInt32(&current.requests) != 2 {
+			t.Error("Expected 2 requests to instance " + strconv.Itoa(i) + " but got " + strconv.Itoa(int(atomic.LoadInt32(&current.requests))))
+		}
+	}
+}
+
+// TestConsistentHash tests the following scenario: course management has three instances balanced by consistent hash,
+// so all the requests of the same user should reach the same instance.
+func TestConsistentHash(t *testing.T) {
+
+	instances := launchInstances(3)
+	defer tearDown(instances)
+	setUp(instances, config.UpstreamConfig{Balancer: "consistent-hash"})
+
+	for i := 0; i < 6; i++ {
+		searchCourse("username")
+	}
+	served := 0
+	for _, current := range instances {
+		if atomic.LoadInt32(&current.requests) > 0 {
+			served++
+		}
+	}
+	if served != 1 {
+		t.Error("Expected the requests to reach 1 instance but they reached " + strconv.Itoa(served))
+	}
+}
+
+// TestEjection tests the following scenario: one of the two instances of course management fails, so it is ejected
+// after the first failure and the following requests reach the other instance only. When the instance recovers, a
+// probe succeeds and the instance receives requests again.
+func TestEjection(t *testing.T) {
+
+	instances := launchInstances(2)
+	defer tearDown(instances)
+	setUp(instances, config.UpstreamConfig{Balancer: "least-outstanding", EjectionFailures: 1, EjectionProbeIntervalMs: 50})
+	atomic.StoreInt32(&instances[0].statusCode, http.StatusInternalServerError)
+
+	for i := 0; i < 6; i++ {
+		searchCourse("username")
+	}
+	if atomic.LoadInt32(&instances[0].requests) != 1 {
+		t.Fatal("Expected 1 request to the failing instance but got " + strconv.Itoa(int(atomic.LoadInt32(&instances[0].requests))))
+	}
+
+	atomic.StoreInt32(&instances[0].statusCode, http.StatusOK)
+	// gives the probe the time to admit the instance again
+	time.Sleep(200 * time.Millisecond)
+	atomic.StoreInt32(&instances[0].requests, 0)
+	for i := 0; i < 4; i++ {
+		response := searchCourse("username")
+		if response.Code != http.StatusOK {
+			t.Error("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+		}
+	}
+	if atomic.LoadInt32(&instances[0].requests) == 0 {
+		t.Error("Expected the recovered instance to receive requests")
+	}
+}
@@ -0,0 +1,200 @@
+package loginThrottle
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/bitly/go-simplejson"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"github.com/redefik/sdccproject/apigateway/mock"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createTestGatewayLoginThrottle creates an http handler that handles the test requests
+func createTestGatewayLoginThrottle() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/token", microservice.LoginUser).Methods(http.MethodPost)
+	r.HandleFunc("/admin/lockouts", microservice.ListLockouts).Methods(http.MethodGet)
+	r.HandleFunc("/admin/lockouts/users/{username}", microservice.ClearLockouts).Methods(http.MethodDelete)
+	return r
+}
+
+// login sends an access token request with the given credentials and returns the response of the api gateway
+func login(handler http.Handler, username string, password string) *httptest.ResponseRecorder {
+	return loginFrom(handler, "10.0.0.1", username, password)
+}
+
+// loginFrom sends from the given address an access token request with the given credentials and returns the response
+// of the api gateway
+func loginFrom(handler http.Handler, address string, username string, password string) *httptest.ResponseRecorder {
+	jsonBody := simplejson.New()
+	jsonBody.Set("username", username)
+	jsonBody.Set("password", password)
+	requestBody, _ := jsonBody.MarshalJSON()
+	request, _ := http.NewRequest(http.MethodPost, "/didattica-mobile/api/v1.0/token", bytes.NewBuffer(requestBody))
+	request.Header.Set("Content-Type", "application/json")
+	request.RemoteAddr = address + ":4000"
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
+
+// TestLoginLockout tests the following scenario: the user "admin" fails the login twice and, since the threshold is
+// configured to 2 failures, is locked out. The next attempt, even with the right password, should be rejected with 429
+// and a Retry-After header. Then an administrator clears the lockout, so the login should succeed with 201.
+func TestLoginLockout(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.LoginThrottle.MaxFailuresPerUser = 2
+
+	handler := createTestGatewayLoginThrottle()
+	// a goroutine representing the microservice listens to the requests coming from the api gateway
+	go mock.LaunchUserManagementMock()
+	// gives the mock the time to start listening
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		response := login(handler, "admin", "admin_wrong_pass")
+		if response.Code != http.StatusUnauthorized {
+			t.Fatal("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+		}
+	}
+
+	response := login(handler, "admin", "admin_pass")
+	if response.Code != http.StatusTooManyRequests {
+		t.Fatal("Expected 429 Too Many Requests but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if response.Header().Get("Retry-After") == "" {
+		t.Error("Expected the Retry-After header")
+	}
+
+	// an administrator clears the lockout
+	admin := microservice.User{Name: "nome", Surname: "cognome", Username: "root", Password: "password", Type: "admin", Mail: "admin@example.com"}
+	adminToken, _ := microservice.GenerateAccessToken(admin, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(http.MethodDelete, "/admin/lockouts/users/admin", nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: adminToken})
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusNoContent {
+		t.Fatal("Expected 204 No Content but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+
+	response = login(handler, "admin", "admin_pass")
+	if response.Code != http.StatusCreated {
+		t.Error("Expected 201 Created but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestLoginLockoutConcurrentAttempts tests the following scenario: six attempts to login as the same user with a wrong
+// password arrive together, while user management is slow to answer. Since the threshold is configured to 2
+// failures, only the first two attempts should reach user management and the others should be rejected with 429.
+func TestLoginLockoutConcurrentAttempts(t *testing.T) {
+
+	var verifications int32
+	userManagement := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&verifications, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer userManagement.Close()
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.UserManagementAddress = userManagement.URL + "/"
+	config.Configuration.LoginThrottle.MaxFailuresPerUser = 2
+	handler := createTestGatewayLoginThrottle()
+	// the username has not been locked out by the previous runs of the test
+	username := "victim" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	codes := make(chan int, 6)
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- login(handler, username, "wrong_pass").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	rejected := 0
+	for code := range codes {
+		if code == http.StatusTooManyRequests {
+			rejected++
+		}
+	}
+	if atomic.LoadInt32(&verifications) != 2 || rejected != 4 {
+		t.Error("Expected 2 attempts verified and 4 rejected, got " + strconv.Itoa(int(atomic.LoadInt32(&verifications))) +
+			" verified and " + strconv.Itoa(rejected) + " rejected")
+	}
+}
+
+// TestLoginNotVerifiedNotLockingOut tests the following scenario: the threshold of the client addresses is configured
+// to 2 failures. A client fails the login once, then makes an attempt that user management cannot verify and finally
+// logs in with the right credentials twice. Only the first attempt is a failure, so the address should not be locked
+// out and both the logins should succeed with 201.
+func TestLoginNotVerifiedNotLockingOut(t *testing.T) {
+
+	userManagement := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var credentials microservice.LoginRequestBody
+		_ = json.NewDecoder(r.Body).Decode(&credentials)
+		if credentials.Username == "unavailable" {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else if credentials.Password == "right_pass" {
+			_, _ = w.Write([]byte(`{"user": {"username": "` + credentials.Username + `", "type": "student"}}`))
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer userManagement.Close()
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.UserManagementAddress = userManagement.URL + "/"
+	config.Configuration.LoginThrottle.MaxFailuresPerIP = 2
+	handler := createTestGatewayLoginThrottle()
+
+	expected := []struct {
+		username string
+		password string
+		code     int
+	}{
+		{"student", "wrong_pass", http.StatusUnauthorized},
+		{"unavailable", "right_pass", http.StatusInternalServerError},
+		{"student", "right_pass", http.StatusCreated},
+		{"student", "right_pass", http.StatusCreated},
+	}
+	for _, attempt := range expected {
+		response := loginFrom(handler, "10.0.0.2", attempt.username, attempt.password)
+		if response.Code != attempt.code {
+			t.Fatal("Expected " + strconv.Itoa(attempt.code) + " but got " + strconv.Itoa(response.Code) + " " +
+				http.StatusText(response.Code))
+		}
+	}
+}
+
+// TestListLockoutsNotAllowed tests the following scenario: a student asks for the list of the lockouts. This operation
+// is allowed for the administrators only, therefore the Api Gateway should respond with Unauthorized.
+func TestListLockoutsNotAllowed(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "student", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+
+	request, _ := http.NewRequest(http.MethodGet, "/admin/lockouts", nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	createTestGatewayLoginThrottle().ServeHTTP(response, request)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
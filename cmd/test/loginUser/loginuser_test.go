@@ -11,18 +11,22 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 )
 
 // createTestGateway creates an http handler that handles the test requests
 func createTestGatewayLoginUser() http.Handler {
 	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
 	r.HandleFunc("/didattica-mobile/api/v1.0/token", microservice.LoginUser).Methods(http.MethodPost)
 	return r
 }
 
 // TestUserLoginSuccess tests the following scenario: the client sends an access token request to the api gateway,
 // passing username "admin" and password "admin_pass" in the body.
-// The gateway makes an http GET request with the given information and sends it to the user management microservice.
+// The gateway sends the given information in the body of an http POST request to the user management microservice.
 // It is assumed that the user "admin" exists and has password "admin_pass", so the authentication should succeed
 // and the gateway should create the token responding to the client with a 201 http status code.
 func TestUserLoginSuccess(t *testing.T) {
@@ -41,6 +45,8 @@ func TestUserLoginSuccess(t *testing.T) {
 	handler := createTestGatewayLoginUser()
 	// a goroutine representing the microservice listens to the requests coming from the api gateway
 	go mock.LaunchUserManagementMock()
+	// gives the mock the time to start listening
+	time.Sleep(100 * time.Millisecond)
 	// simulates a request-response interaction between client and api gateway
 	handler.ServeHTTP(response, request)
 
@@ -52,7 +58,7 @@ func TestUserLoginSuccess(t *testing.T) {
 
 // TestUserLoginFailure tests the following scenario: the client sends an access token request to the api gateway,
 // passing username "admin" and password "admin_wrong_pass" in the body.
-// The gateway makes an http GET request with the given information and sends it to the user management microservice.
+// The gateway sends the given information in the body of an http POST request to the user management microservice.
 // It is assumed that the user "admin" exists but has password "admin_pass", so the authentication should not succeed
 // and the gateway should respond to the client with a 401 http status code.
 func TestUserLoginFailure(t *testing.T) {
@@ -71,6 +77,8 @@ func TestUserLoginFailure(t *testing.T) {
 	handler := createTestGatewayLoginUser()
 	// a goroutine representing the microservice listens to the requests coming from the api gateway
 	go mock.LaunchUserManagementMock()
+	// gives the mock the time to start listening
+	time.Sleep(100 * time.Millisecond)
 	// simulates a request-response interaction between client and api gateway
 	handler.ServeHTTP(response, request)
 
@@ -78,3 +86,70 @@ func TestUserLoginFailure(t *testing.T) {
 		t.Error("Expected 401 Not Found but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
 	}
 }
+
+// loginWithVerificationMode sends an access token request with the given credentials to the api gateway, that
+// verifies them with the user management microservice according to the given mode. It returns the response code.
+func loginWithVerificationMode(mode string, username string, password string) int {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.CredentialVerificationMode = mode
+	defer func() { config.Configuration.CredentialVerificationMode = "" }()
+
+	jsonBody := simplejson.New()
+	jsonBody.Set("username", username)
+	jsonBody.Set("password", password)
+
+	requestBody, _ := jsonBody.MarshalJSON()
+	request, _ := http.NewRequest(http.MethodPost, "/didattica-mobile/api/v1.0/token", bytes.NewBuffer(requestBody))
+	request.Header.Set("Content-Type", "application/json")
+
+	response := httptest.NewRecorder()
+	handler := createTestGatewayLoginUser()
+	// a goroutine representing the microservice listens to the requests coming from the api gateway
+	go mock.LaunchUserManagementMock()
+	// gives the mock the time to start listening
+	time.Sleep(100 * time.Millisecond)
+	// simulates a request-response interaction between client and api gateway
+	handler.ServeHTTP(response, request)
+	return response.Code
+}
+
+// TestUserLoginSuccessCredentialsInBody tests the following scenario: the gateway is configured to send the credentials
+// to the user management microservice in the body of a POST request. The user "admin" with password "admin_pass"
+// exists, so the gateway should respond with 201.
+func TestUserLoginSuccessCredentialsInBody(t *testing.T) {
+	code := loginWithVerificationMode("body", "admin", "admin_pass")
+	if code != http.StatusCreated {
+		t.Error("Expected 201 Created but got " + strconv.Itoa(code) + " " + http.StatusText(code))
+	}
+}
+
+// TestUserLoginFailureCredentialsInBody tests the following scenario: the gateway is configured to send the credentials
+// to the user management microservice in the body of a POST request. The password of the user "admin" is wrong, so the
+// gateway should respond with 401.
+func TestUserLoginFailureCredentialsInBody(t *testing.T) {
+	code := loginWithVerificationMode("body", "admin", "admin_wrong_pass")
+	if code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(code) + " " + http.StatusText(code))
+	}
+}
+
+// TestUserLoginSuccessCredentialsInBasicHeader tests the following scenario: the gateway is configured to send the
+// credentials to the user management microservice in the Authorization header according to the Basic scheme. The user
+// "admin" with password "admin_pass" exists, so the gateway should respond with 201.
+func TestUserLoginSuccessCredentialsInBasicHeader(t *testing.T) {
+	code := loginWithVerificationMode("basic", "admin", "admin_pass")
+	if code != http.StatusCreated {
+		t.Error("Expected 201 Created but got " + strconv.Itoa(code) + " " + http.StatusText(code))
+	}
+}
+
+// TestUserLoginSuccessCredentialsInPath tests the following scenario: the gateway is explicitly configured to send the
+// credentials to the user management microservice in the URL path, as in the previous versions. The user "admin" with
+// password "admin_pass" exists, so the gateway should respond with 201.
+func TestUserLoginSuccessCredentialsInPath(t *testing.T) {
+	code := loginWithVerificationMode("path", "admin", "admin_pass")
+	if code != http.StatusCreated {
+		t.Error("Expected 201 Created but got " + strconv.Itoa(code) + " " + http.StatusText(code))
+	}
+}
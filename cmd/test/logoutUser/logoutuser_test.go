@@ -0,0 +1,214 @@
+package logoutUser
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"github.com/redefik/sdccproject/apigateway/mock"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// createTestGatewayLogoutUser creates an http handler that handles the test requests
+func createTestGatewayLogoutUser() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/token", microservice.LoginUser).Methods(http.MethodPost)
+	r.HandleFunc("/didattica-mobile/api/v1.0/token", microservice.LogoutUser).Methods(http.MethodDelete)
+	r.HandleFunc("/didattica-mobile/api/v1.0/token/refresh", microservice.RefreshAccessToken).Methods(http.MethodPost)
+	r.HandleFunc("/admin/tokens/users/{username}", microservice.RevokeUserTokens).Methods(http.MethodDelete)
+	return r
+}
+
+// sendRequest sends a DELETE request with the given token to the given url and returns the response of the api gateway
+func sendRequest(handler http.Handler, url string, token string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodDelete, url, nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
+
+// TestLogoutSuccess tests the following scenario: the client logs out providing a valid token, so the gateway should
+// respond with 204. Then the same token is used again: since it has been revoked, the gateway should respond with 401.
+func TestLogoutSuccess(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	// generate a token to be appended to the logout request
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "student", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+
+	handler := createTestGatewayLogoutUser()
+	response := sendRequest(handler, "/didattica-mobile/api/v1.0/token", token)
+	if response.Code != http.StatusNoContent {
+		t.Fatal("Expected 204 No Content but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+
+	response = sendRequest(handler, "/didattica-mobile/api/v1.0/token", token)
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestRevokeUserTokensSuccess tests the following scenario: an administrator revokes all the tokens of the user
+// "revoked_user", so the gateway should respond with 204. Then the user uses a token issued before the revocation:
+// the gateway should respond with 401. Finally the user logs out with a token issued after the revocation, so the
+// gateway should respond with 204.
+func TestRevokeUserTokensSuccess(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	// generate the tokens of the administrator and of the user
+	admin := microservice.User{Name: "nome", Surname: "cognome", Username: "admin", Password: "password", Type: "admin", Mail: "admin@example.com"}
+	adminToken, _ := microservice.GenerateAccessToken(admin, []byte(config.Configuration.TokenPrivateKey))
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "revoked_user", Password: "password", Type: "student", Mail: "name@example.com"}
+	userToken, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+
+	handler := createTestGatewayLogoutUser()
+	response := sendRequest(handler, "/admin/tokens/users/revoked_user", adminToken)
+	if response.Code != http.StatusNoContent {
+		t.Fatal("Expected 204 No Content but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+
+	response = sendRequest(handler, "/didattica-mobile/api/v1.0/token", userToken)
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+
+	// a token issued after the revocation, likely in the same second, is valid
+	userToken, _ = microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	response = sendRequest(handler, "/didattica-mobile/api/v1.0/token", userToken)
+	if response.Code != http.StatusNoContent {
+		t.Error("Expected 204 No Content but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestRevokeUserTokensNotAllowed tests the following scenario: a student asks to revoke the tokens of another user.
+// This operation is allowed for the administrators only, therefore the Api Gateway should respond with Unauthorized.
+func TestRevokeUserTokensNotAllowed(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "student", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+
+	response := sendRequest(createTestGatewayLogoutUser(), "/admin/tokens/users/another_user", token)
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestLogoutWithBearerToken tests the following scenario: the client logs out providing a valid token through the
+// Authorization header instead of the cookie, so the gateway should respond with 204.
+func TestLogoutWithBearerToken(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "student", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+
+	request, _ := http.NewRequest(http.MethodDelete, "/didattica-mobile/api/v1.0/token", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	response := httptest.NewRecorder()
+	createTestGatewayLogoutUser().ServeHTTP(response, request)
+
+	if response.Code != http.StatusNoContent {
+		t.Error("Expected 204 No Content but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestLogoutTokenSourcePrecedence tests the following scenario: the client provides a token signed with a wrong key in
+// the cookie and a valid token in the Authorization header. Since the header is configured to take precedence over the
+// cookie, the gateway should accept the request and respond with 204.
+func TestLogoutTokenSourcePrecedence(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.TokenSourcePrecedence = "header"
+	defer func() { config.Configuration.TokenSourcePrecedence = "" }()
+
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "student", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	wrongToken, _ := microservice.GenerateAccessToken(user, []byte("wrong-signing-key"))
+
+	request, _ := http.NewRequest(http.MethodDelete, "/didattica-mobile/api/v1.0/token", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.AddCookie(&http.Cookie{Name: "token", Value: wrongToken})
+	response := httptest.NewRecorder()
+	createTestGatewayLogoutUser().ServeHTTP(response, request)
+
+	if response.Code != http.StatusNoContent {
+		t.Error("Expected 204 No Content but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestLogoutInvalidBearerToken tests the following scenario: the client logs out providing through the Authorization
+// header a string that is not a token, then a token signed with a wrong key. The gateway should respond with 400 and
+// 401 respectively.
+func TestLogoutInvalidBearerToken(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "student", Mail: "name@example.com"}
+	wrongToken, _ := microservice.GenerateAccessToken(user, []byte("wrong-signing-key"))
+
+	expected := map[string]int{"abc": http.StatusBadRequest, wrongToken: http.StatusUnauthorized}
+	for token, code := range expected {
+		request, _ := http.NewRequest(http.MethodDelete, "/didattica-mobile/api/v1.0/token", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		response := httptest.NewRecorder()
+		createTestGatewayLogoutUser().ServeHTTP(response, request)
+
+		if response.Code != code {
+			t.Error("Expected " + strconv.Itoa(code) + " but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+		}
+	}
+}
+
+// TestLogoutBearerClientRevokesRefreshToken tests the following scenario: a client that does not use the cookies logs
+// in, then logs out providing the access token through the Authorization header and the refresh token in the body.
+// The gateway should respond with 204, and the refresh token should not be accepted anymore.
+func TestLogoutBearerClientRevokesRefreshToken(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+	handler := createTestGatewayLogoutUser()
+
+	// a goroutine representing the microservice listens to the requests coming from the api gateway
+	go mock.LaunchUserManagementMock()
+	// gives the mock the time to start listening
+	time.Sleep(100 * time.Millisecond)
+	request, _ := http.NewRequest(http.MethodPost, "/didattica-mobile/api/v1.0/token", bytes.NewBuffer([]byte(`{"username": "admin", "password": "admin_pass"}`)))
+	request.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusCreated {
+		t.Fatal("Expected 201 Created but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	var tokens microservice.TokenResponseBody
+	_ = json.NewDecoder(response.Body).Decode(&tokens)
+	refreshRequestBody := []byte(`{"refreshToken": "` + tokens.RefreshToken + `"}`)
+
+	request, _ = http.NewRequest(http.MethodDelete, "/didattica-mobile/api/v1.0/token", bytes.NewBuffer(refreshRequestBody))
+	request.Header.Set("Authorization", "Bearer "+tokens.Token)
+	request.Header.Set("Content-Type", "application/json")
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusNoContent {
+		t.Fatal("Expected 204 No Content but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+
+	request, _ = http.NewRequest(http.MethodPost, "/didattica-mobile/api/v1.0/token/refresh", bytes.NewBuffer(refreshRequestBody))
+	request.Header.Set("Content-Type", "application/json")
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
@@ -11,11 +11,15 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 )
 
 // createTestPushNotification creates an http handler that handles the test requests
 func createTestGatewayPushNotification() http.Handler {
 	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
 	r.HandleFunc("/didattica-mobile/api/v1.0/notification/course/{courseId}", microservice.PushCourseNotification).Methods(http.MethodPost)
 	return r
 }
@@ -78,3 +82,34 @@ func TestPushNotificationPermissionDenied(t *testing.T) {
 		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
 	}
 }
+
+// TestPushNotificationNotHeldCourse tests the following scenario: a teacher tries to push a notification about a course
+// held by another teacher. So the response should be 401 Unauthorized
+func TestPushNotificationNotHeldCourse(t *testing.T) {
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	jsonBody := simplejson.New()
+	jsonBody.Set("message", "courseMessage")
+
+	// generate a token to be appended to the notification push request
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "teacher", Password: "password", Type: "teacher", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+
+	requestBody, _ := jsonBody.MarshalJSON()
+	request, _ := http.NewRequest(http.MethodPost, "/didattica-mobile/api/v1.0/notification/course/anotherCourseId", bytes.NewBuffer(requestBody))
+	request.Header.Set("Content-Type", "application/json")
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+
+	response := httptest.NewRecorder()
+	handler := createTestGatewayPushNotification()
+	// a goroutine representing the microservice listens to the requests coming from the api gateway
+	go mock.LaunchCourseManagementMock()
+	// gives the mock the time to start listening
+	time.Sleep(100 * time.Millisecond)
+	// simulates a request-response interaction between client and api gateway
+	handler.ServeHTTP(response, request)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
@@ -0,0 +1,120 @@
+package refreshToken
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/bitly/go-simplejson"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"github.com/redefik/sdccproject/apigateway/mock"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// createTestGatewayRefreshToken creates an http handler that handles the test requests
+func createTestGatewayRefreshToken() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/token", microservice.LoginUser).Methods(http.MethodPost)
+	r.HandleFunc("/didattica-mobile/api/v1.0/token/refresh", microservice.RefreshAccessToken).Methods(http.MethodPost)
+	return r
+}
+
+// refresh sends a refresh request carrying the given refresh token and returns the response of the api gateway
+func refresh(handler http.Handler, refreshToken string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPost, "/didattica-mobile/api/v1.0/token/refresh", nil)
+	request.AddCookie(&http.Cookie{Name: "refreshToken", Value: refreshToken})
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
+
+// getCookie returns the value of the cookie with the given name set by the api gateway in the response
+func getCookie(response *httptest.ResponseRecorder, name string) string {
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// TestRefreshTokenInvalid tests the following scenario: the client sends a refresh request with a refresh token that
+// has never been issued by the api gateway. The gateway should respond with 401.
+func TestRefreshTokenInvalid(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	handler := createTestGatewayRefreshToken()
+	// a goroutine representing the microservice listens to the requests coming from the api gateway
+	go mock.LaunchUserManagementMock()
+	// simulates a request-response interaction between client and api gateway
+	response := refresh(handler, "notIssuedRefreshToken")
+
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestRefreshTokenRotation tests the following scenario: the user "admin" logs in and receives an access token and a
+// refresh token. The refresh token is exchanged for a new pair of tokens, so the gateway should respond with 201.
+// Then the already consumed refresh token is presented again: the gateway should detect the reuse and respond with
+// 401. As a consequence, also the refresh token obtained by rotation should be no more valid.
+func TestRefreshTokenRotation(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	jsonBody := simplejson.New()
+	jsonBody.Set("username", "admin")
+	jsonBody.Set("password", "admin_pass")
+	requestBody, _ := jsonBody.MarshalJSON()
+	request, _ := http.NewRequest(http.MethodPost, "/didattica-mobile/api/v1.0/token", bytes.NewBuffer(requestBody))
+	request.Header.Set("Content-Type", "application/json")
+
+	response := httptest.NewRecorder()
+	handler := createTestGatewayRefreshToken()
+	// a goroutine representing the microservice listens to the requests coming from the api gateway
+	go mock.LaunchUserManagementMock()
+	// gives the mock the time to start listening
+	time.Sleep(100 * time.Millisecond)
+	// simulates a request-response interaction between client and api gateway
+	handler.ServeHTTP(response, request)
+
+	if response.Code != http.StatusCreated {
+		t.Fatal("Expected 201 Created but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	refreshToken := getCookie(response, "refreshToken")
+	if refreshToken == "" {
+		t.Fatal("Expected a refresh token in the login response")
+	}
+	// the tokens are returned in the body of the response too
+	var responseBody microservice.TokenResponseBody
+	_ = json.NewDecoder(response.Body).Decode(&responseBody)
+	if responseBody.RefreshToken != refreshToken || responseBody.Token != getCookie(response, "token") {
+		t.Fatal("Expected the tokens in the body of the login response")
+	}
+
+	response = refresh(handler, refreshToken)
+	if response.Code != http.StatusCreated {
+		t.Fatal("Expected 201 Created but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	rotatedRefreshToken := getCookie(response, "refreshToken")
+	if getCookie(response, "token") == "" || rotatedRefreshToken == "" || rotatedRefreshToken == refreshToken {
+		t.Fatal("Expected a new access token and a new refresh token")
+	}
+
+	response = refresh(handler, refreshToken)
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	response = refresh(handler, rotatedRefreshToken)
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
@@ -0,0 +1,138 @@
+package routeTable
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// createTestGatewayRouteTable creates an http handler whose routes are read from the configured route table
+func createTestGatewayRouteTable(t *testing.T) http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	err := microservice.LoadPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Use(microservice.AuthorizationMiddleware)
+	err = microservice.RegisterRoutes(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// launchTeachingMaterialManagement starts a teaching material management micro-service that answers 200 OK with the
+// path it received
+func launchTeachingMaterialManagement() *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	config.Configuration.TeachingMaterialManagementAddress = server.URL + "/teaching_material_management/api/v1.0/"
+	return server
+}
+
+// writeRouteFile writes the given route table in a temporary file with the given extension and uses it as the route
+// file. The returned function removes the file.
+func writeRouteFile(t *testing.T, extension string, content string) func() {
+	file, err := ioutil.TempFile("", "routes*"+extension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString(content)
+	file.Close()
+	config.Configuration.RouteFile = file.Name()
+	return func() {
+		os.Remove(file.Name())
+	}
+}
+
+// newRequest returns a request of a student with the given method and path
+func newRequest(method string, path string) *http.Request {
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "student", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(method, path, nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	return request
+}
+
+// TestDeclaredUpstreamRoute tests the following scenario: the route listing the teaching material of a course is
+// declared in the route table of the api gateway, so the request should be proxied to the rewritten path of teaching
+// material management without a Go handler.
+func TestDeclaredUpstreamRoute(t *testing.T) {
+
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	server := launchTeachingMaterialManagement()
+	defer server.Close()
+	microservice.ResetLoadBalancers()
+	microservice.ResetCircuitBreakers()
+
+	response := httptest.NewRecorder()
+	createTestGatewayRouteTable(t).ServeHTTP(response, newRequest(http.MethodGet, "/didattica-mobile/api/v1.0/teachingMaterials/course1"))
+
+	if response.Code != http.StatusOK {
+		t.Fatal("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if response.Body.String() != "/teaching_material_management/api/v1.0/list/course1" {
+		t.Error("Expected the rewritten path but got " + response.Body.String())
+	}
+}
+
+// TestYAMLRouteTable tests the following scenario: the route table is written in YAML and declares a public route and
+// a route allowed to teachers only. The public route should be served to anyone, while a student should be denied the
+// other one.
+func TestYAMLRouteTable(t *testing.T) {
+
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	server := launchTeachingMaterialManagement()
+	defer server.Close()
+	microservice.ResetLoadBalancers()
+	microservice.ResetCircuitBreakers()
+	defer writeRouteFile(t, ".yaml", `
+routes:
+  - path: /materials/{courseId}
+    methods: [GET]
+    upstream: teachingMaterialManagement
+    upstreamPath: list/{courseId}
+    public: true
+  - path: /teachers/materials/{courseId}
+    methods: [GET]
+    upstream: teachingMaterialManagement
+    upstreamPath: list/{courseId}
+    roles: [teacher]
+`)()
+	handler := createTestGatewayRouteTable(t)
+
+	request, _ := http.NewRequest(http.MethodGet, "/materials/course1", nil)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Error("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, newRequest(http.MethodGet, "/teachers/materials/course1"))
+	if response.Code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
+
+// TestInvalidRouteTable tests the following scenario: a route of the route table refers to an unknown Go handler, so
+// the route table should be refused.
+func TestInvalidRouteTable(t *testing.T) {
+
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	defer writeRouteFile(t, ".json", `{"routes": [{"path": "/unknown", "methods": ["GET"], "handler": "Unknown"}]}`)()
+
+	err := microservice.RegisterRoutes(mux.NewRouter())
+	if err == nil {
+		t.Error("Expected the route table to be refused")
+	}
+}
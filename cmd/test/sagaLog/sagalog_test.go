@@ -0,0 +1,366 @@
+package sagaLog
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// upstream simulates a micro-service that records the requests it receives and answers 200 OK, or the given status
+// to the deletions, except to the course searching requests, answered with the course Advanced Calculus with id courseId
+type upstream struct {
+	sync.Mutex
+	requests     []string
+	deleteStatus int
+}
+
+// launch starts the micro-service
+func (u *upstream) launch() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(`[{"id": "courseId", "name": "Advanced Calculus", "department": "Science", "year": "2018-2019"}]`))
+			return
+		}
+		u.Lock()
+		u.requests = append(u.requests, r.Method+" "+r.URL.Path)
+		u.Unlock()
+		if r.Method == http.MethodDelete && u.deleteStatus != 0 {
+			w.WriteHeader(u.deleteStatus)
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+}
+
+// received returns the requests received by the micro-service, except the ones searching courses
+func (u *upstream) received() []string {
+	u.Lock()
+	defer u.Unlock()
+	return u.requests
+}
+
+// setUp loads the test configuration, with the given micro-services and a saga log in a temporary directory
+// containing the given records. It returns the path of the saga log.
+func setUp(t *testing.T, directory string, courseServer *httptest.Server, notificationServer *httptest.Server, records string) string {
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.CourseManagementAddress = courseServer.URL + "/"
+	config.Configuration.NotificationManagementAddress = notificationServer.URL + "/"
+	config.Configuration.SagaLogFile = filepath.Join(directory, "sagas.log")
+	err := ioutil.WriteFile(config.Configuration.SagaLogFile, []byte(records), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = microservice.LoadSagaLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config.Configuration.SagaLogFile
+}
+
+// readSagaLog returns the content of the saga log after compacting it
+func readSagaLog(t *testing.T, sagaLogFile string) string {
+	err := microservice.LoadSagaLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(sagaLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// queuedCompensations returns the number of compensations of the given execution waiting to be retried or dead
+func queuedCompensations(t *testing.T, execution string) int {
+	recorder := httptest.NewRecorder()
+	microservice.ListCompensations(recorder, nil)
+	var status microservice.CompensationQueueStatus
+	err := json.NewDecoder(recorder.Body).Decode(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := 0
+	for _, entry := range append(status.Pending, status.DeadLetters...) {
+		if entry.Execution == execution {
+			queued++
+		}
+	}
+	return queued
+}
+
+// TestRecoverByCompensation tests the following scenario: the api gateway crashed while subscribing a student to a
+// course, after course management completed the subscription and while notification management was registering it.
+// At the next startup both the subscriptions should be removed, and the execution should disappear from the log.
+func TestRecoverByCompensation(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "sagas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	courseManagement, notificationManagement := &upstream{}, &upstream{}
+	courseServer, notificationServer := courseManagement.launch(), notificationManagement.launch()
+	defer courseServer.Close()
+	defer notificationServer.Close()
+	sagaLogFile := setUp(t, directory, courseServer, notificationServer,
+		`{"id":"s1","saga":"subscribeStudent","event":"started","parameters":{"username":"student","mail":"student@example.com","courseId":"courseId","course":"{\"name\":\"Advanced Calculus\"}"}}
+{"id":"s1","event":"step started","step":"courseManagement"}
+{"id":"s1","event":"step started","step":"notificationManagement"}
+{"id":"s1","event":"step completed","step":"courseManagement","result":"e30="}
+`)
+
+	microservice.RecoverSagas()
+
+	if requests := courseManagement.received(); len(requests) != 1 || requests[0] != "DELETE /students/student/courses/courseId" {
+		t.Error("Expected the subscription to be removed from course management, got ", requests)
+	}
+	if requests := notificationManagement.received(); len(requests) != 1 || requests[0] != "DELETE /course/student/student@example.com" {
+		t.Error("Expected the subscription to be removed from notification management, got ", requests)
+	}
+	if content := readSagaLog(t, sagaLogFile); content != "" {
+		t.Error("Expected the recovered execution to be removed from the log, got " + content)
+	}
+}
+
+// TestRecoverCourseCreation tests the following scenario: the api gateway crashed while creating a course, while both
+// micro-services were creating it. At the next startup the course should be deleted from both micro-services, looking
+// up in course management the id of the course, and the execution should disappear from the log.
+func TestRecoverCourseCreation(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "sagas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	courseManagement, notificationManagement := &upstream{}, &upstream{}
+	courseServer, notificationServer := courseManagement.launch(), notificationManagement.launch()
+	defer courseServer.Close()
+	defer notificationServer.Close()
+	sagaLogFile := setUp(t, directory, courseServer, notificationServer,
+		`{"id":"s3","saga":"createCourse","event":"started","parameters":{"course":"{\"name\":\"Advanced Calculus\",\"department\":\"Science\",\"year\":\"2018-2019\"}"}}
+{"id":"s3","event":"step started","step":"courseManagement"}
+{"id":"s3","event":"step started","step":"notificationManagement"}
+`)
+
+	microservice.RecoverSagas()
+
+	if requests := courseManagement.received(); len(requests) != 1 || requests[0] != "DELETE /courses/courseId" {
+		t.Error("Expected the course to be deleted from course management, got ", requests)
+	}
+	if requests := notificationManagement.received(); len(requests) != 1 || requests[0] != "DELETE /course" {
+		t.Error("Expected the course to be deleted from notification management, got ", requests)
+	}
+	if content := readSagaLog(t, sagaLogFile); content != "" {
+		t.Error("Expected the recovered execution to be removed from the log, got " + content)
+	}
+}
+
+// TestRecoverByResuming tests the following scenario: the api gateway crashed while deleting a course, after
+// notification management deleted it and while course management was deleting it. At the next startup the deletion
+// should be sent again to course management, and the course should not be created again in notification management.
+func TestRecoverByResuming(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "sagas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	courseManagement, notificationManagement := &upstream{}, &upstream{}
+	courseServer, notificationServer := courseManagement.launch(), notificationManagement.launch()
+	defer courseServer.Close()
+	defer notificationServer.Close()
+	sagaLogFile := setUp(t, directory, courseServer, notificationServer,
+		`{"id":"s2","saga":"deleteCourse","event":"started","parameters":{"courseId":"courseId","course":"{\"name\":\"Advanced Calculus\"}"}}
+{"id":"s2","event":"step started","step":"notificationManagement"}
+{"id":"s2","event":"step completed","step":"notificationManagement","result":"e30="}
+{"id":"s2","event":"step started","step":"courseManagement"}
+{"id":"s2","event":"step started","step":"courseMan`)
+
+	microservice.RecoverSagas()
+
+	if requests := courseManagement.received(); len(requests) != 1 || requests[0] != "DELETE /courses/courseId" {
+		t.Error("Expected the course to be deleted from course management, got ", requests)
+	}
+	if requests := notificationManagement.received(); len(requests) != 0 {
+		t.Error("Expected no request to notification management, got ", requests)
+	}
+	if content := readSagaLog(t, sagaLogFile); content != "" {
+		t.Error("Expected the recovered execution to be removed from the log, got " + content)
+	}
+}
+
+// TestRecoverByResumingDeletedCourse tests the following scenario: the api gateway crashed while deleting a course,
+// after course management deleted it but before the deletion was recorded. At the next startup the deletion sent again
+// to course management is answered with 404, so the saga should be committed and the course should not be created
+// again in notification management.
+func TestRecoverByResumingDeletedCourse(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "sagas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	courseManagement, notificationManagement := &upstream{deleteStatus: http.StatusNotFound}, &upstream{}
+	courseServer, notificationServer := courseManagement.launch(), notificationManagement.launch()
+	defer courseServer.Close()
+	defer notificationServer.Close()
+	sagaLogFile := setUp(t, directory, courseServer, notificationServer,
+		`{"id":"s4","saga":"deleteCourse","event":"started","parameters":{"courseId":"courseId","course":"{\"name\":\"Advanced Calculus\"}"}}
+{"id":"s4","event":"step started","step":"notificationManagement"}
+{"id":"s4","event":"step completed","step":"notificationManagement","result":"e30="}
+{"id":"s4","event":"step started","step":"courseManagement"}
+`)
+
+	microservice.RecoverSagas()
+
+	if requests := courseManagement.received(); len(requests) != 1 || requests[0] != "DELETE /courses/courseId" {
+		t.Error("Expected the course to be deleted from course management, got ", requests)
+	}
+	if requests := notificationManagement.received(); len(requests) != 0 {
+		t.Error("Expected no request to notification management, got ", requests)
+	}
+	if content := readSagaLog(t, sagaLogFile); content != "" {
+		t.Error("Expected the recovered execution to be removed from the log, got " + content)
+	}
+}
+
+// TestRecoverSubscriptionNotReached tests the following scenario: the api gateway crashed while subscribing a student
+// to a course, before the requests reached the micro-services. At the next startup the removal of the subscriptions,
+// answered with 404 Not Found, should be considered completed, so the execution should disappear from the log without
+// queueing any compensation.
+func TestRecoverSubscriptionNotReached(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "sagas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	courseManagement := &upstream{deleteStatus: http.StatusNotFound}
+	notificationManagement := &upstream{deleteStatus: http.StatusNotFound}
+	courseServer, notificationServer := courseManagement.launch(), notificationManagement.launch()
+	defer courseServer.Close()
+	defer notificationServer.Close()
+	sagaLogFile := setUp(t, directory, courseServer, notificationServer,
+		`{"id":"s5","saga":"subscribeStudent","event":"started","parameters":{"username":"student","mail":"student@example.com","courseId":"courseId","course":"{\"name\":\"Advanced Calculus\"}"}}
+{"id":"s5","event":"step started","step":"courseManagement"}
+{"id":"s5","event":"step started","step":"notificationManagement"}
+`)
+
+	microservice.RecoverSagas()
+
+	if requests := courseManagement.received(); len(requests) != 1 || requests[0] != "DELETE /students/student/courses/courseId" {
+		t.Error("Expected the subscription to be removed from course management, got ", requests)
+	}
+	if requests := notificationManagement.received(); len(requests) != 1 || requests[0] != "DELETE /course/student/student@example.com" {
+		t.Error("Expected the subscription to be removed from notification management, got ", requests)
+	}
+	if content := readSagaLog(t, sagaLogFile); content != "" {
+		t.Error("Expected the recovered execution to be removed from the log, got " + content)
+	}
+	if queued := queuedCompensations(t, "s5"); queued != 0 {
+		t.Error("Expected no compensation to be queued, got ", queued)
+	}
+}
+
+// TestRecoverQueuedCompensation tests the following scenario: the api gateway crashed while compensating a subscription
+// rejected by notification management, after the compensation in course management failed and was put in the queue.
+// At the next startup the compensation should not be attempted again nor queued twice, and the execution should
+// disappear from the log.
+func TestRecoverQueuedCompensation(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "sagas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	courseManagement, notificationManagement := &upstream{}, &upstream{}
+	courseServer, notificationServer := courseManagement.launch(), notificationManagement.launch()
+	defer courseServer.Close()
+	defer notificationServer.Close()
+	config.Configuration.CompensationQueueFile = filepath.Join(directory, "compensations.json")
+	defer func() { config.Configuration.CompensationQueueFile = "" }()
+	err = ioutil.WriteFile(config.Configuration.CompensationQueueFile, []byte(`{"deadLetters":{"c6":{"id":"c6",
+"saga":"subscribeStudent","execution":"s6","step":"courseManagement","parameters":{"username":"student",
+"mail":"student@example.com","courseId":"courseId"},"attempts":5}}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = microservice.LoadCompensationQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sagaLogFile := setUp(t, directory, courseServer, notificationServer,
+		`{"id":"s6","saga":"subscribeStudent","event":"started","parameters":{"username":"student","mail":"student@example.com","courseId":"courseId","course":"{\"name\":\"Advanced Calculus\"}"}}
+{"id":"s6","event":"step started","step":"courseManagement"}
+{"id":"s6","event":"step completed","step":"courseManagement","result":"e30="}
+{"id":"s6","event":"step started","step":"notificationManagement"}
+{"id":"s6","event":"step failed","step":"notificationManagement"}
+{"id":"s6","event":"compensation failed","step":"courseManagement"}
+`)
+
+	microservice.RecoverSagas()
+
+	if requests := courseManagement.received(); len(requests) != 0 {
+		t.Error("Expected no request to course management, got ", requests)
+	}
+	if requests := notificationManagement.received(); len(requests) != 0 {
+		t.Error("Expected no request to notification management, got ", requests)
+	}
+	if content := readSagaLog(t, sagaLogFile); content != "" {
+		t.Error("Expected the recovered execution to be removed from the log, got " + content)
+	}
+	if queued := queuedCompensations(t, "s6"); queued != 1 {
+		t.Error("Expected the compensation to be queued once, got ", queued)
+	}
+}
+
+// TestRecordExecution tests the following scenario: a course is deleted while the saga log is enabled. The execution
+// should be recorded in the log until it is committed.
+func TestRecordExecution(t *testing.T) {
+
+	directory, err := ioutil.TempDir("", "sagas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	courseManagement, notificationManagement := &upstream{}, &upstream{}
+	courseServer, notificationServer := courseManagement.launch(), notificationManagement.launch()
+	defer courseServer.Close()
+	defer notificationServer.Close()
+	sagaLogFile := setUp(t, directory, courseServer, notificationServer, "")
+
+	r := mux.NewRouter()
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses/{courseId}", microservice.DeleteCourse).Methods(http.MethodDelete)
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "teacher", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	body := []byte(`{"name": "Advanced Calculus", "department": "Science", "year": "2018-2019"}`)
+	request, _ := http.NewRequest(http.MethodDelete, "/didattica-mobile/api/v1.0/courses/courseId", bytes.NewBuffer(body))
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatal("Expected 200 OK but got ", response.Code)
+	}
+	content, err := ioutil.ReadFile(sagaLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range []string{`"saga":"deleteCourse","event":"started"`, `"event":"step completed","step":"notificationManagement"`,
+		`"event":"step completed","step":"courseManagement"`, `"event":"committed"`} {
+		if !strings.Contains(string(content), event) {
+			t.Error("Expected the event " + event + " in the log, got " + string(content))
+		}
+	}
+}
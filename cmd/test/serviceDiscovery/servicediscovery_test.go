@@ -0,0 +1,129 @@
+package serviceDiscovery
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createTestGatewayServiceDiscovery creates an http handler that handles the test requests
+func createTestGatewayServiceDiscovery() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses/{by}/{string}", microservice.FindCourse).Methods(http.MethodGet)
+	return r
+}
+
+// launchInstance starts an instance of course management that answers 200 OK and counts the requests it receives
+func launchInstance(requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("[]"))
+	}))
+}
+
+// writeInstances writes in the given file the given instances of course management, marking the file as modified at
+// the given time
+func writeInstances(t *testing.T, file string, modified time.Time, instances ...string) {
+	content, _ := json.Marshal(map[string][]string{microservice.CourseManagement: instances})
+	err := ioutil.WriteFile(file, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(file, modified, modified)
+}
+
+// searchCourse sends a course searching request and returns the response of the api gateway
+func searchCourse() *httptest.ResponseRecorder {
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "student", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(http.MethodGet, "/didattica-mobile/api/v1.0/courses/name/seq", nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	createTestGatewayServiceDiscovery().ServeHTTP(response, request)
+	return response
+}
+
+// TestFileDiscovery tests the following scenario: the instances of course management are listed in a file, so the
+// requests should reach the listed instance rather than the configured address. When the file is rewritten with
+// another instance, the following requests should reach the new one without restarting the api gateway.
+func TestFileDiscovery(t *testing.T) {
+
+	var firstRequests, secondRequests int32
+	first := launchInstance(&firstRequests)
+	defer first.Close()
+	second := launchInstance(&secondRequests)
+	defer second.Close()
+	file, err := ioutil.TempFile("", "instances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	writeInstances(t, file.Name(), time.Now().Add(-time.Minute), first.URL+"/")
+
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.Discovery = "file"
+	config.Configuration.DiscoveryFile = file.Name()
+	config.Configuration.DiscoveryRefreshSeconds = 3600
+	microservice.ResetLoadBalancers()
+	microservice.ResetCircuitBreakers()
+	err = microservice.StartDiscovery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		config.Configuration.Discovery = ""
+		_ = microservice.StartDiscovery()
+		microservice.ResetLoadBalancers()
+	}()
+
+	response := searchCourse()
+	if response.Code != http.StatusOK {
+		t.Fatal("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if atomic.LoadInt32(&firstRequests) != 1 {
+		t.Fatal("Expected 1 request to the listed instance but got " + strconv.Itoa(int(atomic.LoadInt32(&firstRequests))))
+	}
+
+	writeInstances(t, file.Name(), time.Now(), second.URL+"/")
+	err = microservice.RefreshDiscovery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = searchCourse()
+	if response.Code != http.StatusOK {
+		t.Fatal("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if atomic.LoadInt32(&secondRequests) != 1 || atomic.LoadInt32(&firstRequests) != 1 {
+		t.Error("Expected the request to reach the new instance only")
+	}
+}
+
+// TestUnknownDiscovery tests the following scenario: the configured kind of service discovery does not exist, so the
+// discovery should not start.
+func TestUnknownDiscovery(t *testing.T) {
+
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.Discovery = "zookeeper"
+	defer func() {
+		config.Configuration.Discovery = ""
+	}()
+
+	err := microservice.StartDiscovery()
+	if err != microservice.UnknownDiscovery {
+		t.Error("Expected the unknown discovery to be refused")
+	}
+}
@@ -0,0 +1,119 @@
+package signingKeys
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// createTestGatewaySigningKeys creates an http handler that handles the test requests. The logout endpoint is used to
+// verify that the access tokens are accepted by the api gateway.
+func createTestGatewaySigningKeys() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/token", microservice.LogoutUser).Methods(http.MethodDelete)
+	r.HandleFunc("/.well-known/jwks.json", microservice.GetJSONWebKeySet).Methods(http.MethodGet)
+	return r
+}
+
+// getKeySet returns the kids of the keys published by the api gateway
+func getKeySet(t *testing.T, handler http.Handler) []string {
+	request, _ := http.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatal("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	var keySet struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+		} `json:"keys"`
+	}
+	_ = json.NewDecoder(response.Body).Decode(&keySet)
+	var kids []string
+	for _, key := range keySet.Keys {
+		kids = append(kids, key.Kid)
+	}
+	return kids
+}
+
+// logout sends a logout request with the given token and returns the response code of the api gateway
+func logout(handler http.Handler, token string) int {
+	request, _ := http.NewRequest(http.MethodDelete, "/didattica-mobile/api/v1.0/token", nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response.Code
+}
+
+// TestSigningKeysRotation tests the following scenario: the api gateway signs the tokens with RS256 and a token is
+// issued. Then the signing key is rotated: the key set published by the gateway should contain both the new key and the
+// retired one, and the token signed with the retired key should be still accepted.
+func TestSigningKeysRotation(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.TokenSigningAlgorithm = "RS256"
+	err := microservice.LoadSigningKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := createTestGatewaySigningKeys()
+	if len(getKeySet(t, handler)) != 1 {
+		t.Fatal("Expected 1 published key")
+	}
+
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "student", Mail: "name@example.com"}
+	token, err := microservice.SignAccessToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = microservice.RotateSigningKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(getKeySet(t, handler)) != 2 {
+		t.Fatal("Expected 2 published keys after rotation")
+	}
+
+	code := logout(handler, token)
+	if code != http.StatusNoContent {
+		t.Error("Expected 204 No Content but got " + strconv.Itoa(code) + " " + http.StatusText(code))
+	}
+}
+
+// TestSigningKeysSharedSecretRejected tests the following scenario: the api gateway signs the tokens with ES256 and the
+// client provides a token signed with the shared secret. The gateway should not accept it and respond with 401.
+func TestSigningKeysSharedSecretRejected(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.TokenSigningAlgorithm = "ES256"
+	err := microservice.LoadSigningKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := createTestGatewaySigningKeys()
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "student", Mail: "name@example.com"}
+
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	code := logout(handler, token)
+	if code != http.StatusUnauthorized {
+		t.Error("Expected 401 Unauthorized but got " + strconv.Itoa(code) + " " + http.StatusText(code))
+	}
+
+	token, _ = microservice.SignAccessToken(user)
+	code = logout(handler, token)
+	if code != http.StatusNoContent {
+		t.Error("Expected 204 No Content but got " + strconv.Itoa(code) + " " + http.StatusText(code))
+	}
+}
@@ -0,0 +1,164 @@
+package streamingProxy
+
+import (
+	"bufio"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// createTestGatewayStreamingProxy creates an http handler that handles the test requests
+func createTestGatewayStreamingProxy() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses/{by}/{string}", microservice.FindCourse).Methods(http.MethodGet)
+	return r
+}
+
+// setUp loads the test configuration, with course management at the address of the given server
+func setUp(server *httptest.Server) {
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.CourseManagementAddress = server.URL + "/course_management/api/v1.0/"
+	microservice.ResetLoadBalancers()
+	microservice.ResetCircuitBreakers()
+	microservice.ResetUpstreamClients()
+}
+
+// newSearchCourseRequest returns a course searching request of a student, sent to the given base URL
+func newSearchCourseRequest(baseURL string) *http.Request {
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "student", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(http.MethodGet, baseURL+"/didattica-mobile/api/v1.0/courses/name/seq?page=2", nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	return request
+}
+
+// TestProxyHeaders tests the following scenario: a course searching request with a query string, a range and a custom
+// header is proxied to course management. The micro-service should receive the query string and the range but neither
+// the token nor the custom header, and the client should receive the content type, the headers and the trailers of the
+// micro-service.
+func TestProxyHeaders(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/course_management/api/v1.0/courses/name/seq" || r.URL.RawQuery != "page=2" {
+			t.Error("Expected the path and the query string to be preserved but got " + r.URL.String())
+		}
+		if r.Header.Get("Range") != "bytes=0-99" {
+			t.Error("Expected the range to be forwarded")
+		}
+		if r.Header.Get("Cookie") != "" || r.Header.Get("X-Custom") != "" {
+			t.Error("Expected the token and the custom header not to be forwarded")
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Upstream", "course management")
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write([]byte("content"))
+		w.Header().Set("X-Checksum", "checksum")
+	}))
+	defer server.Close()
+	setUp(server)
+
+	request := newSearchCourseRequest("")
+	request.Header.Set("Range", "bytes=0-99")
+	request.Header.Set("X-Custom", "custom")
+	response := httptest.NewRecorder()
+	createTestGatewayStreamingProxy().ServeHTTP(response, request)
+
+	result := response.Result()
+	if result.StatusCode != http.StatusPartialContent {
+		t.Error("Expected 206 Partial Content but got " + strconv.Itoa(result.StatusCode) + " " + http.StatusText(result.StatusCode))
+	}
+	if result.Header.Get("Content-Type") != "text/plain" || result.Header.Get("X-Upstream") != "course management" {
+		t.Error("Expected the headers of the micro-service but got " + result.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(result.Body)
+	if string(body) != "content" {
+		t.Error("Expected the body of the micro-service but got " + string(body))
+	}
+	if result.Trailer.Get("X-Checksum") != "checksum" {
+		t.Error("Expected the trailer of the micro-service")
+	}
+}
+
+// TestProxyStreaming tests the following scenario: course management sends the first line of its response and waits
+// for the client to receive it before sending the second one. The api gateway should stream the response instead of
+// waiting for the whole body.
+func TestProxyStreaming(t *testing.T) {
+
+	received := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+		}
+		_, _ = w.Write([]byte("second\n"))
+	}))
+	defer server.Close()
+	setUp(server)
+	gateway := httptest.NewServer(createTestGatewayStreamingProxy())
+	defer gateway.Close()
+
+	start := time.Now()
+	response, err := http.DefaultClient.Do(newSearchCourseRequest(gateway.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	reader := bufio.NewReader(response.Body)
+	line, _ := reader.ReadString('\n')
+	if line != "first\n" {
+		t.Fatal("Expected the first line but got " + line)
+	}
+	if time.Since(start) >= 5*time.Second {
+		t.Error("Expected the first line before the end of the response")
+	}
+	close(received)
+	line, _ = reader.ReadString('\n')
+	if line != "second\n" {
+		t.Error("Expected the second line but got " + line)
+	}
+}
+
+// TestProxySlowBody tests the following scenario: course management sends the headers of its response at once, then
+// takes longer than the overall timeout of its client to send the body. The api gateway should not cut off the body,
+// since only the connection and the wait for the headers are bounded for the proxied requests.
+func TestProxySlowBody(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 3; i++ {
+			_, _ = w.Write([]byte("line\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	setUp(server)
+	config.Configuration.Upstreams = map[string]config.UpstreamConfig{microservice.CourseManagement: {TimeoutMs: 100}}
+	defer microservice.ResetUpstreamClients()
+	gateway := httptest.NewServer(createTestGatewayStreamingProxy())
+	defer gateway.Close()
+
+	response, err := http.DefaultClient.Do(newSearchCourseRequest(gateway.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil || string(body) != "line\nline\nline\n" {
+		t.Error("Expected the whole body of the micro-service but got ", string(body), err)
+	}
+}
@@ -0,0 +1,107 @@
+package upstreamClient
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Time the slow micro-service waits before answering
+const upstreamDelay = 2 * time.Second
+
+// createTestGatewayUpstreamClient creates an http handler that handles the test requests
+func createTestGatewayUpstreamClient() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses/{by}/{string}", microservice.FindCourse).Methods(http.MethodGet)
+	return r
+}
+
+// launchSlowCourseManagement starts a course management micro-service that answers after upstreamDelay, unless the
+// request is aborted before. The aborted requests are notified on the returned channel.
+func launchSlowCourseManagement() (*httptest.Server, chan bool) {
+	aborted := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(upstreamDelay):
+			w.WriteHeader(http.StatusOK)
+		case <-r.Context().Done():
+			aborted <- true
+		}
+	}))
+	config.Configuration.CourseManagementAddress = server.URL + "/course_management/api/v1.0/"
+	return server, aborted
+}
+
+// newSearchCourseRequest returns a course searching request of a teacher
+func newSearchCourseRequest() *http.Request {
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "teacher", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(http.MethodGet, "/didattica-mobile/api/v1.0/courses/name/seq", nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	return request
+}
+
+// TestUpstreamTimeout tests the following scenario: the course management micro-service is configured with a timeout
+// of 100 ms for the headers of the response but it answers after two seconds. The api gateway should give up when the timeout expires and respond with
+// 500 Internal Server Error.
+func TestUpstreamTimeout(t *testing.T) {
+
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.Upstreams = map[string]config.UpstreamConfig{microservice.CourseManagement: {ResponseHeaderTimeoutMs: 100}}
+	microservice.ResetUpstreamClients()
+	defer microservice.ResetUpstreamClients()
+	server, aborted := launchSlowCourseManagement()
+	defer server.Close()
+
+	response := httptest.NewRecorder()
+	start := time.Now()
+	createTestGatewayUpstreamClient().ServeHTTP(response, newSearchCourseRequest())
+
+	if response.Code != http.StatusInternalServerError {
+		t.Error("Expected 500 Internal Server Error but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if time.Since(start) >= upstreamDelay {
+		t.Error("Expected the request to be aborted when the timeout expires")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(upstreamDelay):
+		t.Error("Expected the micro-service to see the request aborted")
+	}
+}
+
+// TestClientDisconnection tests the following scenario: the client disconnects while the api gateway waits for the
+// answer of the course management micro-service. The request to the micro-service should be aborted.
+func TestClientDisconnection(t *testing.T) {
+
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	microservice.ResetUpstreamClients()
+	defer microservice.ResetUpstreamClients()
+	server, aborted := launchSlowCourseManagement()
+	defer server.Close()
+
+	// the client disconnects after 100 ms
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	response := httptest.NewRecorder()
+	start := time.Now()
+	createTestGatewayUpstreamClient().ServeHTTP(response, newSearchCourseRequest().WithContext(ctx))
+
+	if time.Since(start) >= upstreamDelay {
+		t.Error("Expected the request to be aborted when the client disconnects")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(upstreamDelay):
+		t.Error("Expected the micro-service to see the request aborted")
+	}
+}
@@ -0,0 +1,158 @@
+package upstreamRetry
+
+import (
+	"bytes"
+	"expvar"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"github.com/redefik/sdccproject/apigateway/microservice"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// createTestGatewayUpstreamRetry creates an http handler that handles the test requests
+func createTestGatewayUpstreamRetry() http.Handler {
+	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
+	r.HandleFunc("/didattica-mobile/api/v1.0/users", microservice.RegisterUser).Methods(http.MethodPost)
+	r.HandleFunc("/didattica-mobile/api/v1.0/courses/{by}/{string}", microservice.FindCourse).Methods(http.MethodGet)
+	return r
+}
+
+// launchFlakyUpstream starts a micro-service that answers 503 Service Unavailable to the given number of requests and
+// then 200 OK. The requests received are counted in the given counter.
+func launchFlakyUpstream(failures int32, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(requests, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("{}"))
+	}))
+}
+
+// setUp loads the test configuration, with a default retry policy of three attempts and a short backoff. The circuit
+// breakers do not open during the tests.
+func setUp(server *httptest.Server) {
+	_ = config.SetConfigurationFromFile("../../../config/config-test.json")
+	config.Configuration.RetryPolicies = map[string]config.RetryConfig{"*": {MaxAttempts: 3, InitialBackoffMs: 1, MaxBackoffMs: 5}}
+	settings := config.UpstreamConfig{BreakerMinRequests: 100}
+	config.Configuration.Upstreams = map[string]config.UpstreamConfig{
+		microservice.UserManagement:   settings,
+		microservice.CourseManagement: settings,
+	}
+	microservice.ResetCircuitBreakers()
+	config.Configuration.UserManagementAddress = server.URL + "/"
+	config.Configuration.CourseManagementAddress = server.URL + "/"
+}
+
+// newSearchCourseRequest returns a course searching request of a teacher
+func newSearchCourseRequest() *http.Request {
+	user := microservice.User{Name: "nome", Surname: "cognome", Username: "username", Password: "password", Type: "teacher", Mail: "name@example.com"}
+	token, _ := microservice.GenerateAccessToken(user, []byte(config.Configuration.TokenPrivateKey))
+	request, _ := http.NewRequest(http.MethodGet, "/didattica-mobile/api/v1.0/courses/name/seq", nil)
+	request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	return request
+}
+
+// newRegistrationRequest returns a registration request of a student, with the given idempotency key if not empty
+func newRegistrationRequest(idempotencyKey string) *http.Request {
+	body := []byte(`{"name": "nome", "surname": "cognome", "username": "username", "password": "password", "type": "student", "mail": "name@example.com"}`)
+	request, _ := http.NewRequest(http.MethodPost, "/didattica-mobile/api/v1.0/users", bytes.NewBuffer(body))
+	request.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		request.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	return request
+}
+
+// TestRetryGet tests the following scenario: course management answers 503 to the first two requests. The course
+// searching request is idempotent, so the api gateway repeats it and responds with 200.
+func TestRetryGet(t *testing.T) {
+
+	requests := int32(0)
+	server := launchFlakyUpstream(2, &requests)
+	defer server.Close()
+	setUp(server)
+	retriesBefore := expvar.Get("upstreamRetries").(*expvar.Map).Get(microservice.CourseManagement)
+
+	response := httptest.NewRecorder()
+	createTestGatewayUpstreamRetry().ServeHTTP(response, newSearchCourseRequest())
+
+	if response.Code != http.StatusOK {
+		t.Error("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Error("Expected 3 requests but got " + strconv.Itoa(int(atomic.LoadInt32(&requests))))
+	}
+	retries := expvar.Get("upstreamRetries").(*expvar.Map).Get(microservice.CourseManagement)
+	if retries == nil || (retriesBefore != nil && retries.String() == retriesBefore.String()) {
+		t.Error("Expected the retries to be counted in the metrics")
+	}
+}
+
+// TestRetryExhausted tests the following scenario: course management answers 503 to the first five requests, so the
+// api gateway gives up after three attempts and forwards the last response.
+func TestRetryExhausted(t *testing.T) {
+
+	requests := int32(0)
+	server := launchFlakyUpstream(5, &requests)
+	defer server.Close()
+	setUp(server)
+
+	response := httptest.NewRecorder()
+	createTestGatewayUpstreamRetry().ServeHTTP(response, newSearchCourseRequest())
+
+	if response.Code != http.StatusServiceUnavailable {
+		t.Error("Expected 503 Service Unavailable but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if atomic.LoadInt32(&requests) != 3 {
+		t.Error("Expected 3 requests but got " + strconv.Itoa(int(atomic.LoadInt32(&requests))))
+	}
+}
+
+// TestNoRetryPost tests the following scenario: user management answers 503 to the first request of registration. The
+// request is a POST without idempotency key, so it is not repeated.
+func TestNoRetryPost(t *testing.T) {
+
+	requests := int32(0)
+	server := launchFlakyUpstream(1, &requests)
+	defer server.Close()
+	setUp(server)
+
+	response := httptest.NewRecorder()
+	createTestGatewayUpstreamRetry().ServeHTTP(response, newRegistrationRequest(""))
+
+	if response.Code != http.StatusServiceUnavailable {
+		t.Error("Expected 503 Service Unavailable but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Error("Expected 1 request but got " + strconv.Itoa(int(atomic.LoadInt32(&requests))))
+	}
+}
+
+// TestRetryPostWithIdempotencyKey tests the following scenario: user management answers 503 to the first request of
+// registration. The request carries an idempotency key, so it is repeated and the api gateway responds with 200.
+func TestRetryPostWithIdempotencyKey(t *testing.T) {
+
+	requests := int32(0)
+	server := launchFlakyUpstream(1, &requests)
+	defer server.Close()
+	setUp(server)
+
+	response := httptest.NewRecorder()
+	createTestGatewayUpstreamRetry().ServeHTTP(response, newRegistrationRequest("registration-1"))
+
+	if response.Code != http.StatusOK {
+		t.Error("Expected 200 OK but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Error("Expected 2 requests but got " + strconv.Itoa(int(atomic.LoadInt32(&requests))))
+	}
+}
@@ -16,6 +16,9 @@ import (
 // createTestGateway creates an http handler that handles the test requests
 func createTestGatewayRegisterUser() http.Handler {
 	r := mux.NewRouter()
+	// the requests are authorized according to the access policy of the api gateway
+	_ = microservice.LoadPolicy()
+	r.Use(microservice.AuthorizationMiddleware)
 	r.HandleFunc("/didattica-mobile/api/v1.0/users", microservice.RegisterUser).Methods(http.MethodPost)
 	return r
 }
@@ -49,3 +52,29 @@ func TestRegisterUserSuccess(t *testing.T) {
 	}
 
 }
+
+// TestRegisterAdminNotAllowed tests the following scenario: the client tries to register an user of type admin. Since
+// the administrators cannot register themselves, the api gateway should respond with 403 without contacting the
+// user-management microservice.
+func TestRegisterAdminNotAllowed(t *testing.T) {
+
+	config.SetConfigurationFromFile("../../../config/config-test.json")
+
+	jsonBody := simplejson.New()
+	jsonBody.Set("username", "user")
+	jsonBody.Set("password", "pass")
+	jsonBody.Set("name", "name")
+	jsonBody.Set("surname", "surname")
+	jsonBody.Set("type", "admin")
+
+	requestBody, _ := jsonBody.MarshalJSON()
+	request, _ := http.NewRequest(http.MethodPost, "/didattica-mobile/api/v1.0/users", bytes.NewBuffer(requestBody))
+	request.Header.Set("Content-Type", "application/json")
+
+	response := httptest.NewRecorder()
+	createTestGatewayRegisterUser().ServeHTTP(response, request)
+
+	if response.Code != http.StatusForbidden {
+		t.Error("Expected 403 Forbidden but got " + strconv.Itoa(response.Code) + " " + http.StatusText(response.Code))
+	}
+}
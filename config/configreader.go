@@ -1,73 +1,125 @@
 package config
 
 import (
-	"encoding/json"
-	"errors"
-	"io/ioutil"
-	"os"
+	"sync"
 )
 
-// Contains the configurable options of the api gateway
+// Contains the configurable options of the api gateway. While the api gateway is running it is read through Get and
+// replaced through Swap, so that a reload does not interfere with the requests being served.
 var Configuration Config
 
+var configurationLock sync.RWMutex
+
 // Encapsulates the fields of the configuration file
 type Config struct {
 	ApiGatewayAddress                 string
+	AdminAddress                      string
 	UserManagementAddress             string
 	CourseManagementAddress           string
 	TeachingMaterialManagementAddress string
 	NotificationManagementAddress     string
 	TokenPrivateKey                   string
+	RefreshTokenLifetimeHours         int
+	RevocationStoreFile               string
+	SagaLogFile                       string
+	CompensationQueueFile             string
+	CompensationRetry                 CompensationRetryConfig
+	OperationRetentionSeconds         int
+	IdempotencyKeyTTLSeconds          int
+	TokenSigningAlgorithm             string
+	TokenSigningKeysDirectory         string
+	TokenKeyRotationHours             int
+	TokenSourcePrecedence             string
+	CredentialVerificationMode        string
+	LoginThrottle                     LoginThrottleConfig
+	TrustForwardedFor                 bool
+	CourseOwnershipCacheSeconds       int
+	PolicyFile                        string
+	RouteFile                         string
+	ConfigFile                        string
+	Upstreams                         map[string]UpstreamConfig
+	RetryPolicies                     map[string]RetryConfig
+	Discovery                         string
+	DiscoveryFile                     string
+	DiscoveryRefreshSeconds           int
+}
+
+// Encapsulates the settings of the client used to contact a micro-service, of its circuit breaker, of its load
+// balancer and of its health checks. The durations are in milliseconds. The zero values are replaced by default ones, except for the connection
+// limits where zero means no limit. When no instance is listed, the micro-service has the single instance at its address.
+// The SRV record is used to find the instances when the service discovery is done through the DNS.
+type UpstreamConfig struct {
+	ConnectTimeoutMs        int
+	ResponseHeaderTimeoutMs int
+	TimeoutMs               int
+	MaxIdleConns            int
+	MaxIdleConnsPerHost     int
+	MaxConnsPerHost         int
+	IdleConnTimeoutMs       int
+	KeepAliveMs             int
+	DisableKeepAlives       bool
+	BreakerFailureRatio     float64
+	BreakerMinRequests      int
+	BreakerWindowMs         int
+	BreakerCoolDownMs       int
+	BreakerHalfOpenRequests int
+	Instances               []string
+	Balancer                string
+	EjectionFailures        int
+	EjectionProbeIntervalMs int
+	SRVName                 string
+	HealthCheckPath         string
+	HealthCheckIntervalMs   int
+	HealthyThreshold        int
+	UnhealthyThreshold      int
 }
 
+// Encapsulates the retry policy of the requests sent to the micro-services on behalf of a route. The backoffs are in
+// milliseconds; the retryable errors are "connection" and "timeout". The zero values are replaced by default ones.
+type RetryConfig struct {
+	MaxAttempts       int
+	InitialBackoffMs  int
+	MaxBackoffMs      int
+	RetryableStatuses []int
+	RetryableErrors   []string
+}
+
+// Encapsulates the settings of the retries of the failed compensations of the sagas. The backoffs are in
+// milliseconds. The zero values are replaced by default ones.
+type CompensationRetryConfig struct {
+	MaxAttempts      int
+	InitialBackoffMs int
+	MaxBackoffMs     int
+}
+
+// Encapsulates the thresholds of the protection against brute-force login attempts. The zero values are replaced by
+// default ones.
+type LoginThrottleConfig struct {
+	MaxFailuresPerUser   int
+	MaxFailuresPerIP     int
+	FailureWindowMinutes int
+	LockoutSeconds       int
+	MaxLockoutMinutes    int
+}
+
+// SetConfigurationFromFile reads the given configuration file over the configuration in use. The fields missing in the
+// file keep their values.
 func SetConfigurationFromFile(configFile string) error {
-	jsonFile, err := os.Open(configFile)
-	if err != nil {
-		return err
-	}
-	defer jsonFile.Close()
-	bytes, err := ioutil.ReadAll(jsonFile)
-	if err != nil {
-		return err
-	}
-	err = json.Unmarshal(bytes, &Configuration)
-	if err != nil {
-		return err
-	}
-	return nil
+	configurationLock.Lock()
+	defer configurationLock.Unlock()
+	return readConfigurationFile(configFile, &Configuration)
+}
+
+// Get returns a snapshot of the configuration in use
+func Get() Config {
+	configurationLock.RLock()
+	defer configurationLock.RUnlock()
+	return Configuration
 }
 
-// Reads the configuration parameters from environment variables and stores them into the Config struct
-func SetConfigurationFromEnvironment() error {
-	gatewayAddress, present := os.LookupEnv("APIGATEWAY_ADDR")
-	if !present {
-		return errors.New("couldn't load configuration parameters")
-	}
-	Configuration.ApiGatewayAddress = gatewayAddress
-	userManagementAddress, present := os.LookupEnv("USER_ADDR")
-	if !present {
-		return errors.New("couldn't load configuration parameters")
-	}
-	Configuration.UserManagementAddress = userManagementAddress
-	courseManagementAddress, present := os.LookupEnv("COURSE_ADDR")
-	if !present {
-		return errors.New("couldn't load configuration parameters")
-	}
-	Configuration.CourseManagementAddress = courseManagementAddress
-	teachingMaterialManagementAddress, present := os.LookupEnv("TEACHING_ADDR")
-	if !present {
-		return errors.New("couldn't load configuration parameters")
-	}
-	Configuration.TeachingMaterialManagementAddress = teachingMaterialManagementAddress
-	notificationManagementAddress, present := os.LookupEnv("NOTIFICATION_ADDR")
-	if !present {
-		return errors.New("couldn't load configuration parameters")
-	}
-	Configuration.NotificationManagementAddress = notificationManagementAddress
-	tokenPrivateKey, present := os.LookupEnv("TOKEN_PRIVATE_KEY")
-	if !present {
-		return errors.New("couldn't load configuration parameters")
-	}
-	Configuration.TokenPrivateKey = tokenPrivateKey
-	return nil
+// Swap puts the given configuration in use in place of the current one
+func Swap(newConfiguration Config) {
+	configurationLock.Lock()
+	defer configurationLock.Unlock()
+	Configuration = newConfiguration
 }
@@ -0,0 +1,256 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Value printed in place of the secrets
+const redacted = "********"
+
+// setting is an option of the api gateway that can be set through an environment variable or through the command
+// line flag with the same name, lowercase and with dashes, e.g. USER_ADDR and --user-addr. The field is a *string, a
+// *int, a *bool or a pointer to a value given in JSON.
+type setting struct {
+	name   string
+	field  interface{}
+	secret bool
+}
+
+// Flags contains the command line flags of the api gateway
+type Flags struct {
+	ConfigFile  string
+	PrintConfig bool
+	values      map[string]string
+}
+
+// settingsOf returns the settings of the given configuration, pointing to its fields
+func settingsOf(configuration *Config) []setting {
+	return []setting{
+		{name: "APIGATEWAY_ADDR", field: &configuration.ApiGatewayAddress},
+		{name: "ADMIN_ADDR", field: &configuration.AdminAddress},
+		{name: "USER_ADDR", field: &configuration.UserManagementAddress},
+		{name: "COURSE_ADDR", field: &configuration.CourseManagementAddress},
+		{name: "TEACHING_ADDR", field: &configuration.TeachingMaterialManagementAddress},
+		{name: "NOTIFICATION_ADDR", field: &configuration.NotificationManagementAddress},
+		{name: "TOKEN_PRIVATE_KEY", field: &configuration.TokenPrivateKey, secret: true},
+		{name: "REFRESH_TOKEN_LIFETIME_HOURS", field: &configuration.RefreshTokenLifetimeHours},
+		{name: "REVOCATION_STORE_FILE", field: &configuration.RevocationStoreFile},
+		{name: "SAGA_LOG_FILE", field: &configuration.SagaLogFile},
+		{name: "COMPENSATION_QUEUE_FILE", field: &configuration.CompensationQueueFile},
+		{name: "COMPENSATION_MAX_ATTEMPTS", field: &configuration.CompensationRetry.MaxAttempts},
+		{name: "COMPENSATION_INITIAL_BACKOFF_MS", field: &configuration.CompensationRetry.InitialBackoffMs},
+		{name: "COMPENSATION_MAX_BACKOFF_MS", field: &configuration.CompensationRetry.MaxBackoffMs},
+		{name: "OPERATION_RETENTION_SECONDS", field: &configuration.OperationRetentionSeconds},
+		{name: "IDEMPOTENCY_KEY_TTL_SECONDS", field: &configuration.IdempotencyKeyTTLSeconds},
+		{name: "TOKEN_SIGNING_ALGORITHM", field: &configuration.TokenSigningAlgorithm},
+		{name: "TOKEN_SIGNING_KEYS_DIR", field: &configuration.TokenSigningKeysDirectory},
+		{name: "TOKEN_KEY_ROTATION_HOURS", field: &configuration.TokenKeyRotationHours},
+		{name: "TOKEN_SOURCE_PRECEDENCE", field: &configuration.TokenSourcePrecedence},
+		{name: "CREDENTIAL_VERIFICATION_MODE", field: &configuration.CredentialVerificationMode},
+		{name: "LOGIN_MAX_FAILURES_PER_USER", field: &configuration.LoginThrottle.MaxFailuresPerUser},
+		{name: "LOGIN_MAX_FAILURES_PER_IP", field: &configuration.LoginThrottle.MaxFailuresPerIP},
+		{name: "LOGIN_FAILURE_WINDOW_MINUTES", field: &configuration.LoginThrottle.FailureWindowMinutes},
+		{name: "LOGIN_LOCKOUT_SECONDS", field: &configuration.LoginThrottle.LockoutSeconds},
+		{name: "LOGIN_MAX_LOCKOUT_MINUTES", field: &configuration.LoginThrottle.MaxLockoutMinutes},
+		{name: "TRUST_FORWARDED_FOR", field: &configuration.TrustForwardedFor},
+		{name: "COURSE_OWNERSHIP_CACHE_SECONDS", field: &configuration.CourseOwnershipCacheSeconds},
+		{name: "UPSTREAMS", field: &configuration.Upstreams},
+		{name: "RETRY_POLICIES", field: &configuration.RetryPolicies},
+		{name: "DISCOVERY", field: &configuration.Discovery},
+		{name: "DISCOVERY_FILE", field: &configuration.DiscoveryFile},
+		{name: "DISCOVERY_REFRESH_SECONDS", field: &configuration.DiscoveryRefreshSeconds},
+		{name: "POLICY_FILE", field: &configuration.PolicyFile},
+		{name: "ROUTE_FILE", field: &configuration.RouteFile},
+	}
+}
+
+// flagName returns the name of the command line flag of the given setting
+func flagName(name string) string {
+	return strings.Replace(strings.ToLower(name), "_", "-", -1)
+}
+
+// set parses the given value and stores it in the field of the setting
+func (s setting) set(value string) error {
+	switch field := s.field.(type) {
+	case *string:
+		*field = value
+	case *int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field = number
+	case *bool:
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*field = flag
+	default:
+		err := json.Unmarshal([]byte(value), field)
+		if err != nil {
+			return fmt.Errorf("invalid JSON: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// flagValue records the value given to a command line flag, that is applied when the configuration is read. The
+// boolean flags can be given without a value.
+type flagValue struct {
+	name    string
+	boolean bool
+	values  map[string]string
+}
+
+func (value flagValue) String() string {
+	return value.values[value.name]
+}
+
+func (value flagValue) Set(s string) error {
+	value.values[value.name] = s
+	return nil
+}
+
+func (value flagValue) IsBoolFlag() bool {
+	return value.boolean
+}
+
+// ParseFlags parses the given command line arguments of the program with the given name. Besides a flag for every
+// setting, --config gives the configuration file (CONFIG_FILE by default) and --print-config asks to print the
+// effective configuration instead of starting the api gateway.
+func ParseFlags(program string, arguments []string) (Flags, error) {
+	flags := Flags{values: make(map[string]string)}
+	flagSet := flag.NewFlagSet(program, flag.ContinueOnError)
+	flagSet.StringVar(&flags.ConfigFile, "config", os.Getenv("CONFIG_FILE"),
+		"configuration file, in JSON, YAML or TOML according to its extension")
+	flagSet.BoolVar(&flags.PrintConfig, "print-config", false,
+		"print the effective configuration, with the secrets redacted, and exit")
+	for _, s := range settingsOf(&Config{}) {
+		_, boolean := s.field.(*bool)
+		flagSet.Var(flagValue{name: s.name, boolean: boolean, values: flags.values}, flagName(s.name), "overrides "+s.name)
+	}
+	err := flagSet.Parse(arguments)
+	return flags, err
+}
+
+// defaultConfiguration returns the configuration before any source is read
+func defaultConfiguration() Config {
+	return Config{PolicyFile: "policy.json", RouteFile: "routes.json"}
+}
+
+// ReadConfiguration reads the configuration from its sources, each one overriding the previous ones: the defaults,
+// the configuration file, the environment variables and the command line flags. The configuration is validated, and
+// a ValidationError naming every missing or invalid field is returned if it is not valid.
+func (flags Flags) ReadConfiguration() (Config, error) {
+	configuration := defaultConfiguration()
+	var problems []string
+	if flags.ConfigFile != "" {
+		err := readConfigurationFile(flags.ConfigFile, &configuration)
+		if err != nil {
+			return configuration, err
+		}
+		configuration.ConfigFile = flags.ConfigFile
+	}
+	for _, s := range settingsOf(&configuration) {
+		value, present := os.LookupEnv(s.name)
+		if !present {
+			continue
+		}
+		err := s.set(value)
+		if err != nil {
+			problems = append(problems, "invalid "+s.name+": "+err.Error())
+		}
+	}
+	for _, s := range settingsOf(&configuration) {
+		value, present := flags.values[s.name]
+		if !present {
+			continue
+		}
+		err := s.set(value)
+		if err != nil {
+			problems = append(problems, "invalid --"+flagName(s.name)+": "+err.Error())
+		}
+	}
+	problems = append(problems, validate(configuration)...)
+	if len(problems) > 0 {
+		return configuration, ValidationError{Problems: problems}
+	}
+	return configuration, nil
+}
+
+// readConfigurationFile reads the given file over the given configuration, in YAML if the extension of the file is
+// .yaml or .yml, in TOML if it is .toml and in JSON otherwise. The keys are the names of the fields of Config, e.g.
+// courseManagementAddress, whatever the format is. The fields missing in the file keep their values.
+func readConfigurationFile(configFile string, configuration *Config) error {
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	var document interface{}
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &document)
+	case ".toml":
+		var table map[string]interface{}
+		_, err = toml.Decode(string(content), &table)
+		document = table
+	default:
+		return json.Unmarshal(content, configuration)
+	}
+	if err != nil {
+		return err
+	}
+	// The YAML and TOML documents are converted to JSON, so that their keys are matched to the fields as in JSON
+	content, err = json.Marshal(jsonCompatible(document))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, configuration)
+}
+
+// jsonCompatible returns the given decoded document with the maps having non-string keys, as decoded from YAML,
+// converted to maps with string keys
+func jsonCompatible(document interface{}) interface{} {
+	switch value := document.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{})
+		for key, element := range value {
+			converted[fmt.Sprint(key)] = jsonCompatible(element)
+		}
+		return converted
+	case map[string]interface{}:
+		for key, element := range value {
+			value[key] = jsonCompatible(element)
+		}
+		return value
+	case []interface{}:
+		for i, element := range value {
+			value[i] = jsonCompatible(element)
+		}
+		return value
+	}
+	return document
+}
+
+// PrintConfiguration writes the given configuration to the given writer in JSON, with the secrets redacted
+func PrintConfiguration(w io.Writer, configuration Config) error {
+	for _, s := range settingsOf(&configuration) {
+		if field, ok := s.field.(*string); ok && s.secret && *field != "" {
+			*field = redacted
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(configuration)
+}
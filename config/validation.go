@@ -0,0 +1,118 @@
+package config
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ValidationError lists the problems found validating the configuration, each one naming the field involved
+type ValidationError struct {
+	Problems []string
+}
+
+func (err ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(err.Problems, "; ")
+}
+
+// validate returns the problems of the given configuration, or nil if it is valid
+func validate(configuration Config) []string {
+	var problems []string
+	required := func(name string, value string) bool {
+		if strings.TrimSpace(value) == "" {
+			problems = append(problems, "missing "+name)
+			return false
+		}
+		return true
+	}
+	listeningAddress := func(name string, value string) {
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			problems = append(problems, "invalid "+name+": "+err.Error())
+		}
+	}
+	baseURL := func(name string, value string) {
+		parsed, err := url.Parse(value)
+		if err != nil {
+			problems = append(problems, "invalid "+name+": "+err.Error())
+			return
+		}
+		if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, "invalid "+name+": "+value+" is not an http or https URL")
+		}
+	}
+	oneOf := func(name string, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		problems = append(problems, "invalid "+name+": "+value+" is not one of "+strings.Join(allowed[1:], ", "))
+	}
+	notNegative := func(name string, value int) {
+		if value < 0 {
+			problems = append(problems, "invalid "+name+": it cannot be negative")
+		}
+	}
+
+	if required("APIGATEWAY_ADDR", configuration.ApiGatewayAddress) {
+		listeningAddress("APIGATEWAY_ADDR", configuration.ApiGatewayAddress)
+	}
+	if configuration.AdminAddress != "" {
+		listeningAddress("ADMIN_ADDR", configuration.AdminAddress)
+	}
+	for name, address := range map[string]string{
+		"USER_ADDR":         configuration.UserManagementAddress,
+		"COURSE_ADDR":       configuration.CourseManagementAddress,
+		"TEACHING_ADDR":     configuration.TeachingMaterialManagementAddress,
+		"NOTIFICATION_ADDR": configuration.NotificationManagementAddress,
+	} {
+		if required(name, address) {
+			baseURL(name, address)
+		}
+	}
+	required("TOKEN_PRIVATE_KEY", configuration.TokenPrivateKey)
+	oneOf("TOKEN_SIGNING_ALGORITHM", configuration.TokenSigningAlgorithm, "", "HS256", "RS256", "ES256")
+	oneOf("TOKEN_SOURCE_PRECEDENCE", configuration.TokenSourcePrecedence, "", "cookie", "header")
+	oneOf("CREDENTIAL_VERIFICATION_MODE", configuration.CredentialVerificationMode, "", "path", "body", "basic")
+	oneOf("DISCOVERY", configuration.Discovery, "", "static", "file", "dns")
+	if configuration.Discovery == "file" {
+		required("DISCOVERY_FILE", configuration.DiscoveryFile)
+	}
+	required("POLICY_FILE", configuration.PolicyFile)
+	for name, value := range map[string]int{
+		"REFRESH_TOKEN_LIFETIME_HOURS":    configuration.RefreshTokenLifetimeHours,
+		"TOKEN_KEY_ROTATION_HOURS":        configuration.TokenKeyRotationHours,
+		"LOGIN_MAX_FAILURES_PER_USER":     configuration.LoginThrottle.MaxFailuresPerUser,
+		"LOGIN_MAX_FAILURES_PER_IP":       configuration.LoginThrottle.MaxFailuresPerIP,
+		"LOGIN_FAILURE_WINDOW_MINUTES":    configuration.LoginThrottle.FailureWindowMinutes,
+		"LOGIN_LOCKOUT_SECONDS":           configuration.LoginThrottle.LockoutSeconds,
+		"LOGIN_MAX_LOCKOUT_MINUTES":       configuration.LoginThrottle.MaxLockoutMinutes,
+		"COURSE_OWNERSHIP_CACHE_SECONDS":  configuration.CourseOwnershipCacheSeconds,
+		"DISCOVERY_REFRESH_SECONDS":       configuration.DiscoveryRefreshSeconds,
+		"COMPENSATION_MAX_ATTEMPTS":       configuration.CompensationRetry.MaxAttempts,
+		"COMPENSATION_INITIAL_BACKOFF_MS": configuration.CompensationRetry.InitialBackoffMs,
+		"COMPENSATION_MAX_BACKOFF_MS":     configuration.CompensationRetry.MaxBackoffMs,
+		"OPERATION_RETENTION_SECONDS":     configuration.OperationRetentionSeconds,
+		"IDEMPOTENCY_KEY_TTL_SECONDS":     configuration.IdempotencyKeyTTLSeconds,
+	} {
+		notNegative(name, value)
+	}
+	for upstream, settings := range configuration.Upstreams {
+		prefix := "UPSTREAMS." + upstream + "."
+		for _, instance := range settings.Instances {
+			baseURL(prefix+"Instances", instance)
+		}
+		oneOf(prefix+"Balancer", settings.Balancer, "", "round-robin", "least-outstanding", "consistent-hash")
+		if settings.BreakerFailureRatio < 0 || settings.BreakerFailureRatio > 1 {
+			problems = append(problems, "invalid "+prefix+"BreakerFailureRatio: it must be between 0 and 1")
+		}
+	}
+	for route, policy := range configuration.RetryPolicies {
+		for _, class := range policy.RetryableErrors {
+			oneOf("RETRY_POLICIES."+route+".RetryableErrors", class, "", "connection", "timeout")
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
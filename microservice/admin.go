@@ -0,0 +1,271 @@
+package microservice
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Timeout of the requests sent to the micro-services to check their health
+const upstreamProbeTimeout = 2 * time.Second
+
+// RouteInfo encapsulates a route registered in the router of the api gateway, together with the roles allowed to
+// invoke it, as returned to the administrators
+type RouteInfo struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+	Public  bool     `json:"public"`
+	Roles   []string `json:"roles"`
+}
+
+// UpstreamHealth encapsulates the result of the health check of an instance of a micro-service, its state in the load
+// balancer and the state of the circuit breaker of the micro-service, as returned to the administrators
+type UpstreamHealth struct {
+	Name           string               `json:"name"`
+	Address        string               `json:"address"`
+	Healthy        bool                 `json:"healthy"`
+	StatusCode     int                  `json:"statusCode,omitempty"`
+	LatencyMs      int64                `json:"latencyMs"`
+	Error          string               `json:"error,omitempty"`
+	Ejected        bool                 `json:"ejected"`
+	Outstanding    int                  `json:"outstanding"`
+	CircuitBreaker CircuitBreakerStatus `json:"circuitBreaker"`
+}
+
+// ReconciliationJob is a maintenance task that the administrators can trigger on demand, such as the removal of the
+// expired revocations. The result of the last run is kept to be shown to the administrators.
+type ReconciliationJob struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	LastRun     time.Time `json:"lastRun,omitempty"`
+	LastResult  string    `json:"lastResult,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+	run         func() (string, error)
+}
+
+// reconciliationJobRegistry contains the jobs that can be triggered, indexed by name
+type reconciliationJobRegistry struct {
+	sync.Mutex
+	jobs map[string]*ReconciliationJob
+}
+
+var reconciliationJobs = reconciliationJobRegistry{jobs: make(map[string]*ReconciliationJob)}
+
+// RegisterReconciliationJob makes the given function available to the administrators as a job with the given name.
+// The function returns a short description of what has been done.
+func RegisterReconciliationJob(name string, description string, run func() (string, error)) {
+	reconciliationJobs.Lock()
+	defer reconciliationJobs.Unlock()
+	reconciliationJobs.jobs[name] = &ReconciliationJob{Name: name, Description: description, run: run}
+}
+
+// writeJSONResponse sends to the client the given value encoded in JSON with the given status code
+func writeJSONResponse(w http.ResponseWriter, statusCode int, value interface{}) {
+	responseBody, err := json.Marshal(value)
+	if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+		log.Println("Api Gateway - Internal Server Error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(responseBody)
+}
+
+// ListRoutes returns the handler that lists to an administrator the routes registered in the given router, with the
+// roles allowed to invoke them according to the access policy
+func ListRoutes(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		routes := []RouteInfo{}
+		err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			path, err := route.GetPathTemplate()
+			if err != nil {
+				return nil
+			}
+			methods, _ := route.GetMethods()
+			info := RouteInfo{Path: path, Methods: methods, Roles: []string{}}
+			for _, method := range methods {
+				routePolicy := lookupRoutePolicy(method, path)
+				if routePolicy == nil {
+					continue
+				}
+				info.Public = routePolicy.Public
+				for _, grant := range routePolicy.Grants {
+					for _, role := range grant.Roles {
+						if !containsString(info.Roles, role) {
+							info.Roles = append(info.Roles, role)
+						}
+					}
+				}
+			}
+			routes = append(routes, info)
+			return nil
+		})
+		if err != nil {
+			MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+			log.Println("Api Gateway - Internal Server Error")
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, routes)
+	}
+}
+
+// containsString returns true if the given value is in the given list
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// probeUpstream checks the health of the instance with the given address of the micro-service with the given name. The
+// instance is considered healthy if it answers to the health check path of the micro-service without a server error.
+// The probe bypasses the circuit breaker and the load balancer, so that the instance is checked even when the breaker
+// is open or the instance is ejected.
+func probeUpstream(name string, address string) UpstreamHealth {
+	health := UpstreamHealth{Name: name, Address: address, CircuitBreaker: circuitBreakerOf(name).status()}
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamProbeTimeout)
+	defer cancel()
+	request, err := newInstanceRequest(ctx, address, http.MethodGet, config.Get().Upstreams[name].HealthCheckPath, nil)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	start := time.Now()
+	resp, err := upstreamClient(name).Do(request)
+	health.LatencyMs = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	resp.Body.Close()
+	health.StatusCode = resp.StatusCode
+	health.Healthy = resp.StatusCode < http.StatusInternalServerError
+	return health
+}
+
+// GetUpstreamHealth checks in parallel the health of the instances of the micro-services and returns the results to an
+// administrator
+func GetUpstreamHealth(w http.ResponseWriter, _ *http.Request) {
+	results := make(chan UpstreamHealth)
+	probes := 0
+	for name := range upstreamAddresses() {
+		instances := loadBalancerOf(name).instanceStatuses()
+		for address, instance := range instances {
+			probes++
+			go func(name string, address string, instance upstreamInstance) {
+				health := probeUpstream(name, address)
+				health.Ejected = instance.ejected
+				health.Outstanding = instance.outstanding
+				results <- health
+			}(name, address, instance)
+		}
+	}
+	upstreams := make([]UpstreamHealth, 0, probes)
+	for i := 0; i < probes; i++ {
+		upstreams = append(upstreams, <-results)
+	}
+	sort.Slice(upstreams, func(i, j int) bool {
+		if upstreams[i].Name != upstreams[j].Name {
+			return upstreams[i].Name < upstreams[j].Name
+		}
+		return upstreams[i].Address < upstreams[j].Address
+	})
+	writeJSONResponse(w, http.StatusOK, upstreams)
+}
+
+// ListReconciliationJobs returns to an administrator the jobs that can be triggered, with the result of their last run
+func ListReconciliationJobs(w http.ResponseWriter, _ *http.Request) {
+	reconciliationJobs.Lock()
+	jobs := make([]ReconciliationJob, 0, len(reconciliationJobs.jobs))
+	for _, job := range reconciliationJobs.jobs {
+		jobs = append(jobs, *job)
+	}
+	reconciliationJobs.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	writeJSONResponse(w, http.StatusOK, jobs)
+}
+
+// RunReconciliationJob runs on behalf of an administrator the job specified in the URL and returns its result
+func RunReconciliationJob(w http.ResponseWriter, r *http.Request) {
+
+	/* For authentication purpose the access token is read from the request and validated */
+	decodedToken, err := AuthenticateRequest(w, r)
+	if err != nil {
+		return
+	}
+
+	name := mux.Vars(r)["job"]
+	reconciliationJobs.Lock()
+	job, present := reconciliationJobs.jobs[name]
+	reconciliationJobs.Unlock()
+	if !present {
+		MakeErrorResponse(w, http.StatusNotFound, "Job not found")
+		log.Println("Job not found")
+		return
+	}
+
+	result, err := job.run()
+	reconciliationJobs.Lock()
+	job.LastRun = time.Now()
+	job.LastResult = result
+	job.LastError = ""
+	if err != nil {
+		job.LastError = err.Error()
+	}
+	ranJob := *job
+	reconciliationJobs.Unlock()
+	auditLog("reconciliation_job", map[string]string{"job": name, "admin": decodedToken.Subject, "result": result,
+		"error": ranJob.LastError})
+	if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "Job failed - "+err.Error())
+		log.Println("Job " + name + " failed - " + err.Error())
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, ranJob)
+}
+
+// The jobs reconciling the state kept by the api gateway
+func init() {
+	RegisterReconciliationJob("purge-expired-tokens",
+		"Removes the expired refresh tokens and the revocations of access tokens that have expired anyway",
+		func() (string, error) {
+			refreshTokens.Lock()
+			refreshTokens.removeExpired()
+			refreshTokens.Unlock()
+			removed, err := revocations.removeExpired()
+			return "revocations removed: " + strconv.Itoa(removed), err
+		})
+	RegisterReconciliationJob("purge-expired-lockouts",
+		"Forgets the failed login attempts that are out of the window and not locked out",
+		func() (string, error) {
+			return "counters removed: " + strconv.Itoa(loginAttempts.removeExpired()), nil
+		})
+	RegisterReconciliationJob("flush-course-ownership-cache",
+		"Forgets the cached courses held by the teachers, so that they are asked again to course management",
+		func() (string, error) {
+			return "teachers removed: " + strconv.Itoa(courseOwnership.flush()), nil
+		})
+	RegisterReconciliationJob("reset-circuit-breakers",
+		"Closes the circuit breakers of the micro-services, so that the requests are sent to them again",
+		func() (string, error) {
+			return "breakers closed: " + strconv.Itoa(ResetCircuitBreakers()), nil
+		})
+	RegisterReconciliationJob("rotate-signing-keys",
+		"Reloads or generates the keys used to sign the access tokens",
+		func() (string, error) {
+			if config.Get().TokenSigningAlgorithm == "" || config.Get().TokenSigningAlgorithm == "HS256" {
+				return "the tokens are signed with the shared private key", nil
+			}
+			return "signing keys rotated", RotateSigningKeys()
+		})
+}
@@ -0,0 +1,43 @@
+package microservice
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// auditLog logs a security relevant event, such as a lockout or a revocation, as a single JSON line prefixed by
+// "AUDIT", so that the audit events can be easily extracted from the log of the api gateway.
+func auditLog(event string, attributes map[string]string) {
+	record := map[string]string{"event": event, "time": time.Now().UTC().Format(time.RFC3339)}
+	for key, value := range attributes {
+		record[key] = value
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Println("AUDIT " + event)
+		return
+	}
+	log.Println("AUDIT " + string(line))
+}
+
+// clientAddress returns the IP address of the client that sent the request. If the api gateway runs behind a trusted
+// proxy, the address is the last one appended by the proxy to the X-Forwarded-For header, because the previous ones
+// may have been forged by the client.
+func clientAddress(r *http.Request) string {
+	if configurationOf(r.Context()).TrustForwardedFor {
+		forwardedFor := r.Header.Get("X-Forwarded-For")
+		if forwardedFor != "" {
+			addresses := strings.Split(forwardedFor, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
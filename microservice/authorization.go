@@ -0,0 +1,324 @@
+package microservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var PermissionDenied = errors.New("permission denied")
+var MalformedRequestBody = errors.New("malformed request body")
+
+// Role granting the access to any authenticated user
+const anyRole = "*"
+
+// Policy maps every route of the api gateway to the roles allowed to invoke it and to the conditions they have to
+// satisfy. The users having an elevated role satisfy every condition, so they can act on behalf of any user.
+type Policy struct {
+	ElevatedRoles []string      `json:"elevatedRoles"`
+	Routes        []RoutePolicy `json:"routes"`
+}
+
+// RoutePolicy specifies who can invoke the given methods of the route registered with the given path template. A
+// public route can be invoked without an access token.
+type RoutePolicy struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+	Public  bool     `json:"public"`
+	Grants  []Grant  `json:"grants"`
+}
+
+// Grant allows the access to the users having one of the given roles, provided that all the conditions are satisfied
+type Grant struct {
+	Roles      []string    `json:"roles"`
+	Conditions []Condition `json:"conditions"`
+}
+
+// Condition is a check on the request that depends on the caller. The checked value is read from the given path
+// parameter or from the given field of the JSON body. The supported types are:
+// - owner: the value must be the username of the caller
+// - holdsCourse: the value must be the id of a course held by the caller
+// - attendsCourse: the value must be the id of a course attended by the caller
+type Condition struct {
+	Type      string `json:"type"`
+	Parameter string `json:"parameter"`
+	BodyField string `json:"bodyField"`
+}
+
+// accessPolicy contains the policy in use, indexed by "<method> <path template>"
+type accessPolicy struct {
+	sync.RWMutex
+	elevatedRoles map[string]bool
+	routes        map[string]*RoutePolicy
+}
+
+var policy = accessPolicy{elevatedRoles: make(map[string]bool), routes: make(map[string]*RoutePolicy)}
+
+// Key of the request context where the claims of the authenticated caller are stored
+type claimsContextKey struct{}
+
+// LoadPolicy reads the access policy from the configured file, together with the one declared by the routes of the
+// route table, validates it and puts it in use
+func LoadPolicy() error {
+	configuration := config.Get()
+	routes, err := readRouteTable(configuration)
+	if err != nil {
+		return err
+	}
+	newPolicy, err := readPolicy(configuration.PolicyFile, routes)
+	if err != nil {
+		return err
+	}
+	usePolicy(newPolicy)
+	return nil
+}
+
+// readPolicy reads the access policy from the given file, adds the one declared by the given routes of the route
+// table and validates it, without putting it in use
+func readPolicy(policyFile string, routes []RouteDefinition) (*accessPolicy, error) {
+	file, err := os.Open(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var newPolicy Policy
+	err = json.NewDecoder(file).Decode(&newPolicy)
+	if err != nil {
+		return nil, err
+	}
+	// The routes of the route table may declare their own policy
+	newPolicy.Routes = append(newPolicy.Routes, routeTablePolicies(routes)...)
+	elevatedRoles := make(map[string]bool)
+	for _, role := range newPolicy.ElevatedRoles {
+		elevatedRoles[role] = true
+	}
+	policies := make(map[string]*RoutePolicy)
+	for i := range newPolicy.Routes {
+		route := &newPolicy.Routes[i]
+		err = validateRoutePolicy(route)
+		if err != nil {
+			return nil, err
+		}
+		for _, method := range route.Methods {
+			key := method + " " + route.Path
+			if _, present := policies[key]; present {
+				return nil, fmt.Errorf("duplicate policy for %s", key)
+			}
+			policies[key] = route
+		}
+	}
+	return &accessPolicy{elevatedRoles: elevatedRoles, routes: policies}, nil
+}
+
+// usePolicy puts in use the given access policy
+func usePolicy(newPolicy *accessPolicy) {
+	policy.Lock()
+	defer policy.Unlock()
+	policy.elevatedRoles = newPolicy.elevatedRoles
+	policy.routes = newPolicy.routes
+}
+
+// validateRoutePolicy checks that the given route policy can be evaluated
+func validateRoutePolicy(route *RoutePolicy) error {
+	if route.Path == "" || len(route.Methods) == 0 {
+		return errors.New("policy without path or methods")
+	}
+	for _, grant := range route.Grants {
+		if len(grant.Roles) == 0 {
+			return fmt.Errorf("grant without roles in the policy of %s", route.Path)
+		}
+		for _, condition := range grant.Conditions {
+			switch condition.Type {
+			case "owner", "holdsCourse", "attendsCourse":
+			default:
+				return fmt.Errorf("unknown condition %q in the policy of %s", condition.Type, route.Path)
+			}
+			if (condition.Parameter == "") == (condition.BodyField == "") {
+				return fmt.Errorf("condition %q in the policy of %s needs either a parameter or a body field",
+					condition.Type, route.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupRoutePolicy returns the policy in use of the given method of the route with the given path template, or nil if
+// the route is not covered by the policy
+func lookupRoutePolicy(method string, path string) *RoutePolicy {
+	return policy.lookup(method, path)
+}
+
+// lookup returns the policy of the given method of the route with the given path template, or nil if the route is not
+// covered by the access policy
+func (accessPolicy *accessPolicy) lookup(method string, path string) *RoutePolicy {
+	accessPolicy.RLock()
+	defer accessPolicy.RUnlock()
+	return accessPolicy.routes[method+" "+path]
+}
+
+// CallerUsername returns the username of the user the token was issued to. The tokens issued before the introduction
+// of the Username claim carry the username in the subject only.
+func (claims Claims) CallerUsername() string {
+	if claims.Username != "" {
+		return claims.Username
+	}
+	return claims.Subject
+}
+
+// HasElevatedRole returns true if the user the token was issued to can act on behalf of any user
+func (claims Claims) HasElevatedRole() bool {
+	return isElevatedRole(claims.Type)
+}
+
+// isElevatedRole returns true if the users having the given role can act on behalf of any user, according to the
+// policy in use
+func isElevatedRole(role string) bool {
+	return policy.isElevated(role)
+}
+
+// isElevated returns true if the users having the given role can act on behalf of any user according to the access
+// policy
+func (accessPolicy *accessPolicy) isElevated(role string) bool {
+	accessPolicy.RLock()
+	defer accessPolicy.RUnlock()
+	return accessPolicy.elevatedRoles[role]
+}
+
+// AuthorizationMiddleware authorizes every request according to the access policy before it reaches the handler of
+// the route. Except for the public routes, the access token is validated and the claims are stored in the request
+// context, where the handler can find them through AuthenticateRequest. The routes not covered by the policy are denied.
+func AuthorizationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var path string
+		route := mux.CurrentRoute(r)
+		if route != nil {
+			path, _ = route.GetPathTemplate()
+		}
+		// The path template of the route is kept in the request context, so that the requests sent to the micro-services
+		// on behalf of the route can be configured per route
+		r = r.WithContext(context.WithValue(r.Context(), routeContextKey{}, path))
+		routePolicy := policyOf(r.Context()).lookup(r.Method, path)
+		if routePolicy == nil {
+			MakeErrorResponse(w, http.StatusUnauthorized, "Permission denied")
+			log.Println("Permission denied - no policy for " + r.Method + " " + path)
+			return
+		}
+		if routePolicy.Public {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, err := AuthenticateRequest(w, r)
+		if err != nil {
+			return
+		}
+		err = authorize(r, routePolicy, claims)
+		if err == PermissionDenied {
+			MakeErrorResponse(w, http.StatusUnauthorized, "Permission denied")
+			log.Println("Permission denied - " + claims.CallerUsername() + " cannot " + r.Method + " " + r.URL.Path)
+			return
+		}
+		if err == CircuitOpen || err == NoHealthyInstance {
+			makeUpstreamErrorResponse(w, err)
+			return
+		}
+		if err == MalformedRequestBody {
+			MakeErrorResponse(w, http.StatusBadRequest, "Bad Request")
+			log.Println("Bad Request")
+			return
+		}
+		if err != nil {
+			MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+			log.Println("Api Gateway - Internal Server Error")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims)))
+	})
+}
+
+// authorize checks if at least one grant of the given route policy allows the caller to perform the request. It
+// returns PermissionDenied if no grant allows it, or the error occurred evaluating a condition.
+func authorize(r *http.Request, routePolicy *RoutePolicy, claims Claims) error {
+	for _, grant := range routePolicy.Grants {
+		if !grantsRole(grant, claims.Type) {
+			continue
+		}
+		if policyOf(r.Context()).isElevated(claims.Type) {
+			return nil
+		}
+		allowed := true
+		for _, condition := range grant.Conditions {
+			satisfied, err := evaluateCondition(r, condition, claims)
+			if err != nil {
+				return err
+			}
+			if !satisfied {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			return nil
+		}
+	}
+	return PermissionDenied
+}
+
+// grantsRole returns true if the given grant applies to the given role
+func grantsRole(grant Grant, role string) bool {
+	for _, grantedRole := range grant.Roles {
+		if grantedRole == anyRole || grantedRole == role {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateCondition checks if the given condition is satisfied by the request of the caller identified by the claims
+func evaluateCondition(r *http.Request, condition Condition, claims Claims) (bool, error) {
+	value, err := conditionValue(r, condition)
+	if err != nil {
+		return false, err
+	}
+	switch condition.Type {
+	case "owner":
+		return value != "" && value == claims.CallerUsername(), nil
+	case "holdsCourse":
+		return teacherHoldsCourse(r.Context(), claims, value)
+	case "attendsCourse":
+		courses, err := findCourses(r.Context(), "courses/students/"+claims.CallerUsername())
+		if err != nil {
+			return false, err
+		}
+		return containsCourse(courses, value), nil
+	}
+	return false, PermissionDenied
+}
+
+// conditionValue returns the value checked by the given condition. When it is read from the body, the body is
+// restored so that it can be forwarded to the micro-service.
+func conditionValue(r *http.Request, condition Condition) (string, error) {
+	if condition.Parameter != "" {
+		return mux.Vars(r)[condition.Parameter], nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var fields map[string]interface{}
+	err = json.Unmarshal(body, &fields)
+	if err != nil {
+		return "", MalformedRequestBody
+	}
+	value, _ := fields[condition.BodyField].(string)
+	return value, nil
+}
@@ -24,6 +24,21 @@ type LoginResponseBody struct {
 	User User `json:"user"`
 }
 
+// Encapsulates the field of the JSON body of the http POST request sent by the client in order to obtain a new access
+// token when the refresh token is not provided through cookie
+type RefreshRequestBody struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Encapsulates the fields of the JSON body of the http response containing the tokens issued to the client. The same
+// tokens are set in the cookies of the response too.
+type TokenResponseBody struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int    `json:"expiresIn"`
+}
+
 // Encapsulates the field of the JSON error response from a microservice
 type ErrorResponse struct {
 	Error string `json:"error"`
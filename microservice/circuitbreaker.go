@@ -0,0 +1,229 @@
+package microservice
+
+import (
+	"errors"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"sync"
+	"time"
+)
+
+// States of a circuit breaker
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// Default settings of the circuit breakers
+const (
+	defaultBreakerFailureRatio     = 0.5
+	defaultBreakerMinRequests      = 5
+	defaultBreakerWindow           = 60 * time.Second
+	defaultBreakerCoolDown         = 30 * time.Second
+	defaultBreakerHalfOpenRequests = 1
+)
+
+var CircuitOpen = errors.New("circuit open")
+
+// CircuitBreakerStatus encapsulates the state of the circuit breaker of a micro-service, as returned to the
+// administrators
+type CircuitBreakerStatus struct {
+	State    string    `json:"state"`
+	Requests int       `json:"requests"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"openedAt,omitempty"`
+}
+
+// circuitBreaker protects the api gateway from a micro-service that is failing. While the breaker is closed the
+// requests are sent and their outcome is counted in a window: when the failures reach the configured ratio of the
+// requests, the breaker opens and the requests are rejected without contacting the micro-service. After the cool-down
+// the breaker becomes half-open and lets a few trial requests through: if they succeed the breaker closes again,
+// otherwise it opens for another cool-down.
+type circuitBreaker struct {
+	sync.Mutex
+	failureRatio     float64
+	minRequests      int
+	window           time.Duration
+	coolDown         time.Duration
+	halfOpenRequests int
+	state            string
+	windowStart      time.Time
+	requests         int
+	failures         int
+	openedAt         time.Time
+	trials           int
+}
+
+// circuitBreakerRegistry contains the circuit breaker of each micro-service, indexed by name
+type circuitBreakerRegistry struct {
+	sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+var circuitBreakers = circuitBreakerRegistry{breakers: make(map[string]*circuitBreaker)}
+
+// newCircuitBreaker creates a closed circuit breaker configured according to the given settings
+func newCircuitBreaker(settings config.UpstreamConfig) *circuitBreaker {
+	breaker := &circuitBreaker{
+		failureRatio:     settings.BreakerFailureRatio,
+		minRequests:      settings.BreakerMinRequests,
+		window:           durationSetting(settings.BreakerWindowMs, defaultBreakerWindow),
+		coolDown:         durationSetting(settings.BreakerCoolDownMs, defaultBreakerCoolDown),
+		halfOpenRequests: settings.BreakerHalfOpenRequests,
+		state:            circuitClosed,
+		windowStart:      time.Now(),
+	}
+	if breaker.failureRatio <= 0 || breaker.failureRatio > 1 {
+		breaker.failureRatio = defaultBreakerFailureRatio
+	}
+	if breaker.minRequests <= 0 {
+		breaker.minRequests = defaultBreakerMinRequests
+	}
+	if breaker.halfOpenRequests <= 0 {
+		breaker.halfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+	return breaker
+}
+
+// circuitBreakerOf returns the circuit breaker of the given micro-service
+func circuitBreakerOf(name string) *circuitBreaker {
+	circuitBreakers.Lock()
+	defer circuitBreakers.Unlock()
+	breaker, present := circuitBreakers.breakers[name]
+	if !present {
+		breaker = newCircuitBreaker(config.Get().Upstreams[name])
+		circuitBreakers.breakers[name] = breaker
+	}
+	return breaker
+}
+
+// ResetCircuitBreakers closes the circuit breakers of all the micro-services, forgetting the counted requests, and
+// configures them again according to the current configuration. It returns the number of breakers that were not closed.
+func ResetCircuitBreakers() int {
+	circuitBreakers.Lock()
+	defer circuitBreakers.Unlock()
+	reset := 0
+	for name, breaker := range circuitBreakers.breakers {
+		if breaker.status().State != circuitClosed {
+			reset++
+		}
+		delete(circuitBreakers.breakers, name)
+	}
+	return reset
+}
+
+// allow checks if a request can be sent to the micro-service. It returns CircuitOpen if the request has to be rejected.
+func (breaker *circuitBreaker) allow() error {
+	breaker.Lock()
+	defer breaker.Unlock()
+	breaker.update(time.Now())
+	switch breaker.state {
+	case circuitOpen:
+		return CircuitOpen
+	case circuitHalfOpen:
+		if breaker.trials >= breaker.halfOpenRequests {
+			return CircuitOpen
+		}
+		breaker.trials++
+	}
+	return nil
+}
+
+// isOpen returns true if the requests to the micro-service are currently rejected. Unlike allow, it does not take up
+// any trial request of an half-open breaker.
+func (breaker *circuitBreaker) isOpen() bool {
+	breaker.Lock()
+	defer breaker.Unlock()
+	breaker.update(time.Now())
+	return breaker.state == circuitOpen ||
+		(breaker.state == circuitHalfOpen && breaker.trials >= breaker.halfOpenRequests)
+}
+
+// record counts the outcome of a request allowed by the breaker, opening or closing the breaker if needed
+func (breaker *circuitBreaker) record(success bool) {
+	breaker.Lock()
+	defer breaker.Unlock()
+	now := time.Now()
+	breaker.update(now)
+	switch breaker.state {
+	case circuitHalfOpen:
+		if success {
+			breaker.close(now)
+		} else {
+			breaker.open(now)
+		}
+	case circuitClosed:
+		breaker.requests++
+		if !success {
+			breaker.failures++
+		}
+		if breaker.requests >= breaker.minRequests &&
+			float64(breaker.failures) >= breaker.failureRatio*float64(breaker.requests) {
+			breaker.open(now)
+		}
+	}
+}
+
+// release gives back the trial taken up by a request whose outcome says nothing about the health of the
+// micro-service, e.g. because the client disconnected
+func (breaker *circuitBreaker) release() {
+	breaker.Lock()
+	defer breaker.Unlock()
+	if breaker.state == circuitHalfOpen && breaker.trials > 0 {
+		breaker.trials--
+	}
+}
+
+// status returns the current state of the breaker
+func (breaker *circuitBreaker) status() CircuitBreakerStatus {
+	breaker.Lock()
+	defer breaker.Unlock()
+	breaker.update(time.Now())
+	status := CircuitBreakerStatus{State: breaker.state, Requests: breaker.requests, Failures: breaker.failures}
+	if breaker.state != circuitClosed {
+		status.OpenedAt = breaker.openedAt
+	}
+	return status
+}
+
+// update moves an open breaker to half-open when the cool-down is over, and starts a new window of a closed breaker
+// when the current one is over. The caller must hold the lock.
+func (breaker *circuitBreaker) update(now time.Time) {
+	if breaker.state == circuitOpen && now.Sub(breaker.openedAt) >= breaker.coolDown {
+		breaker.state = circuitHalfOpen
+		breaker.trials = 0
+	}
+	if breaker.state == circuitClosed && now.Sub(breaker.windowStart) >= breaker.window {
+		breaker.windowStart = now
+		breaker.requests = 0
+		breaker.failures = 0
+	}
+}
+
+// open makes the breaker reject the requests for a cool-down. The caller must hold the lock.
+func (breaker *circuitBreaker) open(now time.Time) {
+	breaker.state = circuitOpen
+	breaker.openedAt = now
+	breaker.trials = 0
+}
+
+// close makes the breaker allow the requests again, starting a new window. The caller must hold the lock.
+func (breaker *circuitBreaker) close(now time.Time) {
+	breaker.state = circuitClosed
+	breaker.windowStart = now
+	breaker.requests = 0
+	breaker.failures = 0
+	breaker.trials = 0
+}
+
+// unavailableUpstream returns the first of the given micro-services whose circuit breaker is open, or an empty string
+// if all of them can be contacted. It is used before starting an operation that involves several micro-services, so
+// that no one is contacted when one of them is known to be failing.
+func unavailableUpstream(names ...string) string {
+	for _, name := range names {
+		if circuitBreakerOf(name).isOpen() {
+			return name
+		}
+	}
+	return ""
+}
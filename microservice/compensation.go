@@ -0,0 +1,382 @@
+package microservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default settings of the retries of the failed compensations
+const (
+	defaultCompensationMaxAttempts    = 8
+	defaultCompensationInitialBackoff = 1 * time.Second
+	defaultCompensationMaxBackoff     = 5 * time.Minute
+)
+
+// Interval between two checks of the compensations due to be retried
+const compensationRetryInterval = time.Second
+
+var CompensationNotFound = errors.New("compensation not found")
+var CompensationInProgress = errors.New("compensation in progress")
+
+// CompensationEntry is a compensation of a step of a saga that failed and is retried in background, as returned to
+// the administrators. When the maximum number of attempts is reached the compensation is moved to the dead letters,
+// where it stays until an administrator retries or discards it.
+type CompensationEntry struct {
+	Id          string         `json:"id"`
+	Saga        string         `json:"saga"`
+	Execution   string         `json:"execution"`
+	Step        string         `json:"step"`
+	Parameters  SagaParameters `json:"parameters"`
+	Result      []byte         `json:"result,omitempty"`
+	Attempts    int            `json:"attempts"`
+	Created     time.Time      `json:"created"`
+	NextAttempt time.Time      `json:"nextAttempt"`
+	LastError   string         `json:"lastError"`
+	running     bool
+}
+
+// CompensationQueueStatus lists the compensations waiting to be retried and the dead letters, as returned to the
+// administrators
+type CompensationQueueStatus struct {
+	Pending     []CompensationEntry `json:"pending"`
+	DeadLetters []CompensationEntry `json:"deadLetters"`
+}
+
+// compensationQueue keeps the failed compensations, indexed by id. The queue is persisted in the file specified in
+// the configuration, if any, so that the compensations survive a restart of the api gateway.
+type compensationQueue struct {
+	sync.Mutex
+	Pending     map[string]*CompensationEntry `json:"pending"`
+	DeadLetters map[string]*CompensationEntry `json:"deadLetters"`
+}
+
+var compensations = compensationQueue{Pending: make(map[string]*CompensationEntry),
+	DeadLetters: make(map[string]*CompensationEntry)}
+
+// compensationRetryPolicy returns the policy of the retries of the failed compensations
+func compensationRetryPolicy() retryPolicy {
+	settings := config.Get().CompensationRetry
+	policy := retryPolicy{
+		maxAttempts:    settings.MaxAttempts,
+		initialBackoff: durationSetting(settings.InitialBackoffMs, defaultCompensationInitialBackoff),
+		maxBackoff:     durationSetting(settings.MaxBackoffMs, defaultCompensationMaxBackoff),
+	}
+	if policy.maxAttempts <= 0 {
+		policy.maxAttempts = defaultCompensationMaxAttempts
+	}
+	return policy
+}
+
+// LoadCompensationQueue reads the failed compensations from the file specified in the configuration, if any. It is
+// meant to be called at startup, so that the compensations are retried after a restart of the api gateway.
+func LoadCompensationQueue() error {
+	if config.Get().CompensationQueueFile == "" {
+		return nil
+	}
+	bytes, err := ioutil.ReadFile(config.Get().CompensationQueueFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	compensations.Lock()
+	defer compensations.Unlock()
+	err = json.Unmarshal(bytes, &compensations)
+	if err != nil {
+		return err
+	}
+	if compensations.Pending == nil {
+		compensations.Pending = make(map[string]*CompensationEntry)
+	}
+	if compensations.DeadLetters == nil {
+		compensations.DeadLetters = make(map[string]*CompensationEntry)
+	}
+	return nil
+}
+
+// persist writes the failed compensations in the file specified in the configuration, if any. The caller must hold
+// the lock.
+func (queue *compensationQueue) persist() error {
+	if config.Get().CompensationQueueFile == "" {
+		return nil
+	}
+	bytes, err := json.Marshal(queue)
+	if err != nil {
+		return err
+	}
+	// The file is replaced atomically, so that a crash during the write does not corrupt it
+	tmpFile := config.Get().CompensationQueueFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, bytes, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, config.Get().CompensationQueueFile)
+}
+
+// enqueue puts in the queue the compensation of the given step of the execution of a saga with the given id, that
+// failed with the given error at its first attempt
+func (queue *compensationQueue) enqueue(saga *Saga, execution string, step string, parameters SagaParameters,
+	result []byte, compensationErr error) error {
+	id, err := randomToken(16)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	entry := &CompensationEntry{Id: id, Saga: saga.Name, Execution: execution, Step: step, Parameters: parameters,
+		Result: result, Created: now}
+	queue.Lock()
+	defer queue.Unlock()
+	queue.Pending[id] = entry
+	queue.failed(entry, compensationErr, now)
+	return queue.persist()
+}
+
+// queued tells if the compensation of the given step of the given execution of a saga is in the queue, either
+// pending or dead
+func (queue *compensationQueue) queued(execution string, step string) bool {
+	queue.Lock()
+	defer queue.Unlock()
+	for _, entries := range []map[string]*CompensationEntry{queue.Pending, queue.DeadLetters} {
+		for _, entry := range entries {
+			if entry.Execution == execution && entry.Step == step {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// failed records a failed attempt of the given pending compensation and schedules the next one, or moves the
+// compensation to the dead letters if the attempts are exhausted. The caller must hold the lock.
+func (queue *compensationQueue) failed(entry *CompensationEntry, err error, now time.Time) {
+	policy := compensationRetryPolicy()
+	entry.Attempts++
+	entry.LastError = err.Error()
+	if entry.Attempts >= policy.maxAttempts {
+		delete(queue.Pending, entry.Id)
+		queue.DeadLetters[entry.Id] = entry
+		entry.NextAttempt = time.Time{}
+		log.Println("Compensation " + entry.Id + " of " + entry.Step + " (saga " + entry.Saga + " " + entry.Execution +
+			") moved to the dead letters after " + strconv.Itoa(entry.Attempts) + " attempts")
+		return
+	}
+	entry.NextAttempt = now.Add(policy.backoff(entry.Attempts + 1))
+}
+
+// retry attempts again the compensation with the given id, either pending or dead, and returns its state after the
+// attempt. A dead letter gets a new set of attempts.
+func (queue *compensationQueue) retry(id string) (CompensationEntry, error) {
+	queue.Lock()
+	entry, present := queue.Pending[id]
+	if dead, isDead := queue.DeadLetters[id]; isDead {
+		entry, present = dead, true
+		delete(queue.DeadLetters, id)
+		entry.Attempts = 0
+		queue.Pending[id] = entry
+	}
+	if !present {
+		queue.Unlock()
+		return CompensationEntry{}, CompensationNotFound
+	}
+	if entry.running {
+		queue.Unlock()
+		return *entry, CompensationInProgress
+	}
+	entry.running = true
+	queue.Unlock()
+
+	compensationErr := errors.New("unknown saga step " + entry.Saga + "/" + entry.Step)
+	if saga, present := sagaDefinitions[entry.Saga]; present {
+		for _, step := range saga.Steps {
+			if step.Name == entry.Step && step.Compensation != nil {
+				compensationErr = safeCompensation(step, entry.Parameters, entry.Result)
+			}
+		}
+	}
+
+	queue.Lock()
+	defer queue.Unlock()
+	entry.running = false
+	if compensationErr != nil {
+		queue.failed(entry, compensationErr, time.Now())
+	} else {
+		entry.Attempts++
+		entry.LastError = ""
+		delete(queue.Pending, id)
+		operations.apply(sagaLogRecord{Id: entry.Execution, Event: stepCompensated, Step: entry.Step})
+		log.Println("Compensation " + entry.Id + " of " + entry.Step + " (saga " + entry.Saga + " " +
+			entry.Execution + ") completed")
+	}
+	err := queue.persist()
+	if err != nil {
+		log.Println("Compensation queue not persisted: " + err.Error())
+	}
+	return *entry, compensationErr
+}
+
+// discard removes the compensation with the given id from the queue, either pending or dead. A compensation being
+// attempted cannot be discarded.
+func (queue *compensationQueue) discard(id string) error {
+	queue.Lock()
+	defer queue.Unlock()
+	if entry, present := queue.Pending[id]; present {
+		if entry.running {
+			return CompensationInProgress
+		}
+		delete(queue.Pending, id)
+	} else if _, present := queue.DeadLetters[id]; present {
+		delete(queue.DeadLetters, id)
+	} else {
+		return CompensationNotFound
+	}
+	return queue.persist()
+}
+
+// due returns the ids of the pending compensations whose next attempt is due
+func (queue *compensationQueue) due(now time.Time) []string {
+	queue.Lock()
+	defer queue.Unlock()
+	var ids []string
+	for id, entry := range queue.Pending {
+		if !entry.running && !entry.NextAttempt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// status returns the pending compensations and the dead letters, ordered by creation time
+func (queue *compensationQueue) status() CompensationQueueStatus {
+	queue.Lock()
+	defer queue.Unlock()
+	status := CompensationQueueStatus{Pending: []CompensationEntry{}, DeadLetters: []CompensationEntry{}}
+	for _, entry := range queue.Pending {
+		status.Pending = append(status.Pending, *entry)
+	}
+	for _, entry := range queue.DeadLetters {
+		status.DeadLetters = append(status.DeadLetters, *entry)
+	}
+	sort.Slice(status.Pending, func(i, j int) bool { return status.Pending[i].Created.Before(status.Pending[j].Created) })
+	sort.Slice(status.DeadLetters, func(i, j int) bool {
+		return status.DeadLetters[i].Created.Before(status.DeadLetters[j].Created)
+	})
+	return status
+}
+
+// safeCompensation executes the compensation of the given step, turning a panic into an error so that a faulty
+// compensation cannot crash the api gateway
+func safeCompensation(step SagaStep, parameters SagaParameters, result []byte) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = errors.New("compensation panicked: " + panicDescription(recovered))
+		}
+	}()
+	return step.Compensation(context.Background(), parameters, result)
+}
+
+// panicDescription returns a description of the value of a recovered panic
+func panicDescription(value interface{}) string {
+	if err, ok := value.(error); ok {
+		return err.Error()
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return "unexpected value"
+}
+
+// StartCompensationRetries starts a goroutine that periodically retries the failed compensations that are due
+func StartCompensationRetries() {
+	go func() {
+		ticker := time.NewTicker(compensationRetryInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			for _, id := range compensations.due(now) {
+				_, _ = compensations.retry(id)
+			}
+		}
+	}()
+}
+
+// ListCompensations returns to an administrator the failed compensations waiting to be retried and the dead letters
+func ListCompensations(w http.ResponseWriter, _ *http.Request) {
+	writeJSONResponse(w, http.StatusOK, compensations.status())
+}
+
+// RetryCompensation attempts again on behalf of an administrator the failed compensation specified in the URL, either
+// pending or dead, and returns its state after the attempt
+func RetryCompensation(w http.ResponseWriter, r *http.Request) {
+
+	/* For authentication purpose the access token is read from the request and validated */
+	decodedToken, err := AuthenticateRequest(w, r)
+	if err != nil {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	entry, err := compensations.retry(id)
+	if err == CompensationNotFound {
+		MakeErrorResponse(w, http.StatusNotFound, "Compensation not found")
+		log.Println("Compensation not found")
+		return
+	}
+	if err == CompensationInProgress {
+		MakeErrorResponse(w, http.StatusConflict, "Compensation in progress")
+		log.Println("Compensation in progress")
+		return
+	}
+	errorMessage := ""
+	if err != nil {
+		errorMessage = err.Error()
+	}
+	auditLog("compensation_retried", map[string]string{"compensation": id, "admin": decodedToken.Subject,
+		"error": errorMessage})
+	if err != nil {
+		MakeErrorResponse(w, http.StatusBadGateway, "Compensation failed - "+err.Error())
+		log.Println("Compensation " + id + " failed - " + err.Error())
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, entry)
+}
+
+// DiscardCompensation removes on behalf of an administrator the failed compensation specified in the URL, either
+// pending or dead, for instance because the inconsistency has been fixed by hand
+func DiscardCompensation(w http.ResponseWriter, r *http.Request) {
+
+	/* For authentication purpose the access token is read from the request and validated */
+	decodedToken, err := AuthenticateRequest(w, r)
+	if err != nil {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	err = compensations.discard(id)
+	if err == CompensationNotFound {
+		MakeErrorResponse(w, http.StatusNotFound, "Compensation not found")
+		log.Println("Compensation not found")
+		return
+	}
+	if err == CompensationInProgress {
+		MakeErrorResponse(w, http.StatusConflict, "Compensation in progress")
+		log.Println("Compensation in progress")
+		return
+	}
+	if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+		log.Println("Compensation queue not persisted: " + err.Error())
+		return
+	}
+	auditLog("compensation_discarded", map[string]string{"compensation": id, "admin": decodedToken.Subject})
+	w.WriteHeader(http.StatusNoContent)
+}
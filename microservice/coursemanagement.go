@@ -2,13 +2,16 @@ package microservice
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/bitly/go-simplejson"
 	"github.com/gorilla/mux"
-	"github.com/redefik/sdccproject/apigateway/config"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 )
 
 // FindCourse process the course searching request coming from the client and validate the embedded access token. It verify
@@ -16,13 +19,8 @@ import (
 // and the response is forwarded to the client.
 func FindCourse(w http.ResponseWriter, r *http.Request) {
 
-	/* For authentication purpose the access token is read from the Cookie header */
-	tokenString, err := GetToken(w, r)
-	if err != nil {
-		return
-	}
-	/* The token is decoded and the claims are obtained for further checks */
-	_, err = ValidateToken(tokenString, w)
+	/* For authentication purpose the access token is read from the request and validated */
+	_, err := AuthenticateRequest(w, r)
 	if err != nil {
 		return
 	}
@@ -31,314 +29,289 @@ func FindCourse(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r) // url-encoded parameters
 	by := vars["by"]
 	searchString := vars["string"]
-	err = ForwardAndReturnGet(config.Configuration.CourseManagementAddress+"courses"+"/"+by+"/"+searchString, w)
+	err = ProxyToUpstream(CourseManagement, "courses"+"/"+by+"/"+searchString, w, r)
 	if err != nil {
-		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
-		log.Println("Api Gateway - Internal Server Error")
+		makeUpstreamErrorResponse(w, err)
 		return
 	}
 
 }
 
-// AddCourseToStudent process the course creation request coming from the client validating the embedded access token. If the token
-// is properly signed, it checks if the request comes from a student, because course creation is allowed for teachers
-// only. Upon successful validation, the request is forwarded to the micro-service. The first time a course is added the student
+// AddCourseToStudent process the request of subscribing a student to a course. The AuthorizationMiddleware has already
+// checked that the request comes from the student himself, according to the access policy. The request is forwarded to
+// the micro-service. The first time a course is added the student
 // does not exist. In this case, the function provides its creation.
 func AddCourseToStudent(w http.ResponseWriter, r *http.Request) {
 
-	// For authentication purpose the access token is read from the Cookie header and validated, it's also verified if
-	// requester is a student
-	tokenString, err := GetToken(w, r)
-	if err != nil {
-		MakeErrorResponse(w, http.StatusUnauthorized, "Permission denied")
-		log.Println("Permission denied")
-		return
-	}
-	decodedToken, err := ValidateToken(tokenString, w)
+	// The claims of the access token are read from the request, where they have been stored after the authorization
+	decodedToken, err := AuthenticateRequest(w, r)
 	if err != nil {
-		MakeErrorResponse(w, http.StatusUnauthorized, "Permission denied")
-		log.Println("Permission denied")
-		return
-	}
-	if decodedToken.Type != "student" {
-		MakeErrorResponse(w, http.StatusUnauthorized, "Permission denied")
-		log.Println("Permission denied")
 		return
 	}
 
 	/* Upon successful validation a distributed transaction starts: api gateway send to course management and notification
 	management micro-services a request to register the user to course in their own data-store. The request succeeds only
-	if the operation is completed by both micro-services. The requests are send in parallel using goroutines. */
+	if the operation is completed by both micro-services. */
+	parameters, err := subscriptionParameters(r, decodedToken)
+	if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "API Gateway - Internal Server Error")
+		log.Println("API Gateway - Internal Server Error")
+		return
+	}
+	ExecuteSaga(w, r, subscribeStudentSaga, parameters)
+}
 
-	// Collecting parameters for requests to course management and notification management micro-services
-	studentUsername := mux.Vars(r)["username"]
-	studentMail := decodedToken.Mail
-	studentName := decodedToken.Name
-	studentSurname := decodedToken.Surname
+// subscriptionParameters collects from the given request, whose access token has the given claims, the parameters of
+// the requests to course management and notification management micro-services that subscribe or unsubscribe a student
+func subscriptionParameters(r *http.Request, decodedToken Claims) (SagaParameters, error) {
 	var courseMinimized CourseMinimized
 	var course Course
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		MakeErrorResponse(w, http.StatusInternalServerError, "API Gateway - Internal Server Error")
-		log.Println("API Gateway - Internal Server Error")
-		return
+		return nil, err
 	}
 	err = json.Unmarshal(body, &courseMinimized)
 	if err != nil {
-		MakeErrorResponse(w, http.StatusInternalServerError, "API Gateway - Internal Server Error")
-		log.Println("API Gateway - Internal Server Error")
-		return
+		return nil, err
 	}
 	err = json.Unmarshal(body, &course)
 	if err != nil {
-		MakeErrorResponse(w, http.StatusInternalServerError, "API Gateway - Internal Server Error")
-		log.Println("API Gateway - Internal Server Error")
-		return
+		return nil, err
 	}
+	return SagaParameters{
+		"username": mux.Vars(r)["username"],
+		"name":     decodedToken.Name,
+		"surname":  decodedToken.Surname,
+		"mail":     decodedToken.Mail,
+		"courseId": courseMinimized.Id,
+		"course":   string(body),
+	}, nil
+}
 
-	//Initialize the channel to receive the exit of local transactions
-	c := make(chan localTransaction, 2)
-
-	//Launching goRoutines responsible to actuate local transaction
-	go addSubscriptionInCourseManagement(studentUsername, studentName, studentSurname, courseMinimized.Id, c)
-	go addSubscriptionInNotificationManagement(studentMail, course, c)
-
-	isSentResponse := false     // Indicate if an internal error occurred and client already received a response
-	var response *http.Response // The response for the client
-	var localTransaction localTransaction
-	var failingMicroservice []string // Contains the name of micro-service(s) that failed the execution of the request
-	var i int
-
-	for i = 0; i <= 1; i++ {
-		// Waiting for the exit of local transactions
-		localTransaction = <-c
-		if localTransaction.Response == nil {
-			// Any error occurred during forwarding of request: the client receive immediately an Internal Server Error
-			failingMicroservice = append(failingMicroservice, localTransaction.Microservice)
-			if isSentResponse == false {
-				isSentResponse = true
-				MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
-				log.Println("Api Gateway - Internal Server Error")
-			}
-		} else if localTransaction.Response.StatusCode != http.StatusOK {
-			// Failure: the client receive the last error response that the api-gateway obtained from micro-services
-			failingMicroservice = append(failingMicroservice, localTransaction.Microservice)
-			response = localTransaction.Response
-		} else {
-			// Success: the client receive the success response from course management micro-service.
-			if localTransaction.Microservice == "courseManagement" {
-				if response == nil {
-					response = localTransaction.Response
-				}
-			}
-		}
-	}
+// The subscription of a student to a course is registered in parallel by course management and notification management
+var subscribeStudentSaga = &Saga{
+	Name:     "subscribeStudent",
+	Parallel: true,
+	Response: CourseManagement,
+	Steps: []SagaStep{
+		{
+			Name:          CourseManagement,
+			Upstream:      CourseManagement,
+			SuccessStatus: http.StatusOK,
+			Action:        addSubscriptionInCourseManagement,
+			Compensation:  undoWith(removeSubscriptionInCourseManagement, http.StatusOK, http.StatusNotFound),
+		},
+		{
+			Name:          NotificationManagement,
+			Upstream:      NotificationManagement,
+			SuccessStatus: http.StatusOK,
+			Action:        addSubscriptionInNotificationManagement,
+			Compensation:  undoWith(removeSubscriptionInNotificationManagement, http.StatusOK, http.StatusNotFound),
+		},
+	},
+}
 
-	// If only a micro-service fail the other have to undo the action just completed
-	if len(failingMicroservice) == 1 {
-		if failingMicroservice[0] == "courseManagement" {
-			removeSubscriptionInNotificationManagement(studentMail, course, nil)
-		} else {
-			removeSubscriptionInCourseManagement(studentUsername, courseMinimized.Id, nil)
-		}
-	}
+// The cancellation of a subscription is registered in parallel by course management and notification management
+var unsubscribeStudentSaga = &Saga{
+	Name:     "unsubscribeStudent",
+	Parallel: true,
+	Response: CourseManagement,
+	Steps: []SagaStep{
+		{
+			Name:          CourseManagement,
+			Upstream:      CourseManagement,
+			SuccessStatus: http.StatusOK,
+			Action:        removeSubscriptionInCourseManagement,
+			Compensation:  undoWith(addSubscriptionInCourseManagement, http.StatusOK),
+		},
+		{
+			Name:          NotificationManagement,
+			Upstream:      NotificationManagement,
+			SuccessStatus: http.StatusOK,
+			Action:        removeSubscriptionInNotificationManagement,
+			Compensation:  undoWith(addSubscriptionInNotificationManagement, http.StatusOK),
+		},
+	},
+}
+
+// The course is created in parallel by course management and notification management
+var createCourseSaga = &Saga{
+	Name:     "createCourse",
+	Parallel: true,
+	Response: CourseManagement,
+	Steps: []SagaStep{
+		{
+			Name:          CourseManagement,
+			Upstream:      CourseManagement,
+			SuccessStatus: http.StatusCreated,
+			Action:        createCourseInCourseManagement,
+			Compensation:  deleteCourseInCourseManagement,
+		},
+		{
+			Name:          NotificationManagement,
+			Upstream:      NotificationManagement,
+			SuccessStatus: http.StatusCreated,
+			Action:        createCourseInNotificationManagement,
+			Compensation:  deleteCourseInNotificationManagement,
+		},
+	},
+}
 
-	// If no Internal Server Error occurred the response from micro-services is forwarded to client
-	if !isSentResponse {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(response.StatusCode)
-		responseBody, err := ioutil.ReadAll(response.Body)
+// The course is deleted from notification management first, where it can be created again if the deletion fails in
+// course management, whose identifiers cannot be restored
+var deleteCourseSaga = &Saga{
+	Name:      "deleteCourse",
+	Parallel:  false,
+	Response:  CourseManagement,
+	Committed: forgetDeletedCourse,
+	Steps: []SagaStep{
+		{
+			Name:          NotificationManagement,
+			Upstream:      NotificationManagement,
+			SuccessStatus: http.StatusOK,
+			Action:        removeCourseInNotificationManagement,
+			Compensation:  undoWith(createCourseInNotificationManagement, http.StatusCreated),
+		},
+		{
+			Name:          CourseManagement,
+			Upstream:      CourseManagement,
+			SuccessStatus: http.StatusOK,
+			// The course has already been deleted by the execution interrupted by the restart
+			ResumedStatuses: []int{http.StatusNotFound},
+			Action:          removeCourseInCourseManagement,
+		},
+	},
+}
+
+// forgetDeletedCourse forgets the cached courses of the teacher holding the course deleted with the given parameters,
+// so that the course is no longer considered held by the teacher
+func forgetDeletedCourse(parameters SagaParameters) {
+	courseOwnership.forgetCourse(parameters["courseId"])
+}
+
+// undoWith returns a compensation that undoes a step through the given action, that succeeds with the given status.
+// The action succeeds also with the given undone statuses, meaning that there is nothing to undo, e.g. because the step
+// was interrupted by a restart before reaching the micro-service.
+func undoWith(action func(context.Context, SagaParameters) (*http.Response, error), successStatus int,
+	undoneStatuses ...int) func(context.Context, SagaParameters, []byte) error {
+	return func(ctx context.Context, parameters SagaParameters, _ []byte) error {
+		response, err := action(ctx, parameters)
 		if err != nil {
-			MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
-			log.Println("Api Gateway - Internal Server Error")
-			return
+			return err
 		}
-		_, err = w.Write(responseBody)
-		if err != nil {
-			MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
-			log.Println("Api Gateway - Internal Server Error")
-			return
+		response.Body.Close()
+		if response.StatusCode == successStatus {
+			return nil
 		}
+		for _, status := range undoneStatuses {
+			if response.StatusCode == status {
+				return nil
+			}
+		}
+		return errors.New("unexpected status " + strconv.Itoa(response.StatusCode))
 	}
+}
 
+// courseOf returns the course of the given parameters, as sent to notification management micro-service
+func courseOf(parameters SagaParameters) ([]byte, error) {
+	var course Course
+	err := json.Unmarshal([]byte(parameters["course"]), &course)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(course)
 }
 
 // addSubscriptionInCourseManagement send a request of course subscription to course management micro-service.
 // If the student to subscribe to the course is not present in data-store, he is created.
-func addSubscriptionInCourseManagement(studentUsername string, studentName string, studentSurname, courseId string, channel chan localTransaction) {
+func addSubscriptionInCourseManagement(ctx context.Context, parameters SagaParameters) (*http.Response, error) {
 
-	httpClient := &http.Client{}
-	putRequest, err := http.NewRequest(http.MethodPut, config.Configuration.CourseManagementAddress+"students/"+
-		studentUsername+"/courses/"+courseId, nil)
+	studentUsername := parameters["username"]
+	courseId := parameters["courseId"]
+	putResponse, err := doUpstream(ctx, CourseManagement, http.MethodPut, "students/"+studentUsername+"/courses/"+courseId,
+		"", nil)
 	if err != nil {
-		if channel == nil {
-			log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
-		} else {
-			channel <- localTransaction{"courseManagement", nil}
-			return
-		}
-	}
-	putResponse, err := httpClient.Do(putRequest)
-	if err != nil {
-		if channel == nil {
-			log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
-		} else {
-			channel <- localTransaction{"courseManagement", nil}
-			return
-		}
+		return nil, err
 	}
 
 	// It the student does not exist, it is created by the api-gateway.
-	// This case can not verify when the method is used to undo a previous operation
 	if putResponse.StatusCode == http.StatusNotFound {
 		var errorResponse ErrorResponse
 		// Decode the microservice error putResponse
-		jsonDecoder := json.NewDecoder(putResponse.Body)
-		err = jsonDecoder.Decode(&errorResponse)
+		body, err := ioutil.ReadAll(putResponse.Body)
+		putResponse.Body.Close()
 		if err != nil {
-			channel <- localTransaction{"courseManagement", nil}
-			return
+			return nil, err
 		}
-		if errorResponse.Error == "Student Not Found" {
-
-			studentCreationRequest := simplejson.New()
-			studentCreationRequest.Set("name", studentName+" "+studentSurname)
-			studentCreationRequest.Set("username", studentUsername)
-			studentCreationRequestPayload, err := studentCreationRequest.MarshalJSON()
-			postResponse, err := http.Post(config.Configuration.CourseManagementAddress+"students",
-				"application/json", bytes.NewBuffer(studentCreationRequestPayload))
-			if err != nil {
-				channel <- localTransaction{"courseManagement", nil}
-				return
-			}
-			if postResponse.StatusCode == http.StatusCreated {
-				// Upon successful student creation proceed with course appending
-				req, err := http.NewRequest(http.MethodPut, config.Configuration.CourseManagementAddress+"students/"+
-					studentUsername+"/courses/"+courseId, nil)
-				resp, err := httpClient.Do(req)
-				if err != nil {
-					channel <- localTransaction{"courseManagement", nil}
-					return
-				}
-				channel <- localTransaction{"courseManagement", resp}
-				return
-			}
-			// If for some unexpected reason the student has not been created, an error is communicated to main thread
-			channel <- localTransaction{"courseManagement", nil}
-			return
+		err = json.Unmarshal(body, &errorResponse)
+		if err != nil {
+			return nil, err
+		}
+		if errorResponse.Error != "Student Not Found" {
+			// Any other response from the micro-service is simply forwarded to the client
+			putResponse.Body = ioutil.NopCloser(bytes.NewReader(body))
+			return putResponse, nil
 		}
-	}
 
-	if putResponse.StatusCode != http.StatusOK && channel == nil {
-		log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
+		studentCreationRequest := simplejson.New()
+		studentCreationRequest.Set("name", parameters["name"]+" "+parameters["surname"])
+		studentCreationRequest.Set("username", studentUsername)
+		studentCreationRequestPayload, err := studentCreationRequest.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		postResponse, err := doUpstream(ctx, CourseManagement, http.MethodPost, "students",
+			"application/json", bytes.NewBuffer(studentCreationRequestPayload))
+		if err != nil {
+			return nil, err
+		}
+		postResponse.Body.Close()
+		if postResponse.StatusCode != http.StatusCreated {
+			// If for some unexpected reason the student has not been created, an error is communicated to the saga
+			return nil, errors.New("student " + studentUsername + " not created")
+		}
+		// Upon successful student creation proceed with course appending
+		return doUpstream(ctx, CourseManagement, http.MethodPut, "students/"+studentUsername+"/courses/"+courseId, "", nil)
 	}
 
-	if channel != nil {
-		// Any other putResponse from the micro-service is simply forwarded to the client
-		channel <- localTransaction{"courseManagement", putResponse}
-	}
+	// Any other putResponse from the micro-service is simply forwarded to the client
+	return putResponse, nil
 }
 
 // removeSubscriptionInCourseManagement send a request to remove a course subscription to course management
 // micro-service for the specified user.
-func removeSubscriptionInCourseManagement(studentUsername string, courseId string, channel chan localTransaction) {
-
-	httpClient := &http.Client{}
-	req, err := http.NewRequest(http.MethodDelete, config.Configuration.CourseManagementAddress+"students/"+
-		studentUsername+"/courses/"+courseId, nil)
-	if err != nil {
-		if channel == nil {
-			log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
-		} else {
-			channel <- localTransaction{"courseManagement", nil}
-			return
-		}
-	}
-	resp, err := httpClient.Do(req)
-
-	if (err != nil || resp.StatusCode != http.StatusOK) && channel == nil {
-		log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
-	} else if err != nil && channel != nil {
-		channel <- localTransaction{"courseManagement", nil}
-		return
-	}
-	if channel != nil {
-		channel <- localTransaction{"courseManagement", resp}
-	}
-
+func removeSubscriptionInCourseManagement(ctx context.Context, parameters SagaParameters) (*http.Response, error) {
+	return doUpstream(ctx, CourseManagement, http.MethodDelete, "students/"+parameters["username"]+"/courses/"+
+		parameters["courseId"], "", nil)
 }
 
 // removeSubscriptionInNotificationManagement send a request to remove a course subscription to notification management
-// micro-service for the specified user. Channel is the chan through communicate with main thread. If channel is null
-// it means the function is used as undo method because transaction fail. If an error occurred during undoing operation
-// a message is show to allow system administrator to recover the system
-func removeSubscriptionInNotificationManagement(studentMail string, course Course, channel chan localTransaction) {
-
-	body, err := json.Marshal(course)
+// micro-service for the specified user.
+func removeSubscriptionInNotificationManagement(ctx context.Context, parameters SagaParameters) (*http.Response, error) {
+	body, err := courseOf(parameters)
 	if err != nil {
-		if channel == nil {
-			log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
-		} else {
-			channel <- localTransaction{"notificationManagement", nil}
-			return
-		}
-	}
-	httpClient := &http.Client{}
-	req, err := http.NewRequest(http.MethodDelete, config.Configuration.NotificationManagementAddress+
-		"course/student/"+studentMail, bytes.NewBuffer(body))
-	resp, err := httpClient.Do(req)
-	if (err != nil || resp.StatusCode != http.StatusOK) && channel == nil {
-		log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
-	} else if err != nil && channel != nil {
-		channel <- localTransaction{"notificationManagement", nil}
-		return
-	}
-	if channel != nil {
-		channel <- localTransaction{"notificationManagement", resp}
+		return nil, err
 	}
+	return doUpstream(ctx, NotificationManagement, http.MethodDelete, "course/student/"+parameters["mail"], "",
+		bytes.NewBuffer(body))
 }
 
 // addSubscriptionInNotificationManagement send a request of course subscription to notification management micro-service.
-//Channel is the chan through communicate with main thread. If channel is null it means the function is used as undo
-// method because transaction fail. If an error occurred during undoing operation a message is show to allow system
-// administrator to recover the system
-func addSubscriptionInNotificationManagement(studentMail string, course Course, channel chan localTransaction) {
-
-	body, err := json.Marshal(course)
+func addSubscriptionInNotificationManagement(ctx context.Context, parameters SagaParameters) (*http.Response, error) {
+	body, err := courseOf(parameters)
 	if err != nil {
-		if channel == nil {
-			log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
-		} else {
-			channel <- localTransaction{"notificationManagement", nil}
-			return
-		}
-	}
-	httpClient := &http.Client{}
-	req, err := http.NewRequest(http.MethodPut, config.Configuration.NotificationManagementAddress+
-		"course/student/"+studentMail, bytes.NewBuffer(body))
-	resp, err := httpClient.Do(req)
-	if (err != nil || resp.StatusCode != http.StatusOK) && channel == nil {
-		log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
-	} else if err != nil && channel != nil {
-		channel <- localTransaction{"notificationManagement", nil}
-		return
-	}
-	if channel != nil {
-		channel <- localTransaction{"notificationManagement", resp}
+		return nil, err
 	}
+	return doUpstream(ctx, NotificationManagement, http.MethodPut, "course/student/"+parameters["mail"], "",
+		bytes.NewBuffer(body))
 }
 
 // FindStudentCourses process the request coming from the client and validate the embedded access token. It verify
 // if the token is properly signed and not expired. Upon successful validation, the request is forwarded to the microservice
 // and the response is returned, as-is, to the client.
 func FindStudentCourses(w http.ResponseWriter, r *http.Request) {
-	/* For authentication purpose the access token is read from the Cookie header */
-	tokenString, err := GetToken(w, r)
-	if err != nil {
-		return
-	}
-	/* The token is decoded and the claims are obtained for further checks */
-	_, err = ValidateToken(tokenString, w)
+	/* For authentication purpose the access token is read from the request and validated */
+	_, err := AuthenticateRequest(w, r)
 	if err != nil {
 		return
 	}
@@ -346,10 +319,9 @@ func FindStudentCourses(w http.ResponseWriter, r *http.Request) {
 	returned to the client*/
 	vars := mux.Vars(r) // url-encoded parameters
 	studentUsername := vars["username"]
-	err = ForwardAndReturnGet(config.Configuration.CourseManagementAddress+"courses/students/"+studentUsername, w)
+	err = ProxyToUpstream(CourseManagement, "courses/students/"+studentUsername, w, r)
 	if err != nil {
-		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
-		log.Println("Api Gateway - Internal Server Error")
+		makeUpstreamErrorResponse(w, err)
 		return
 	}
 }
@@ -358,327 +330,211 @@ func FindStudentCourses(w http.ResponseWriter, r *http.Request) {
 // Upon successful validation, the request is forwarded to the micro-services of course management and notification management.
 func UnsubscribeStudentFromCourse(w http.ResponseWriter, r *http.Request) {
 
-	// For authentication purpose the access token is read from the Cookie header and validated, it's also verified if
-	// requester is a student
-	tokenString, err := GetToken(w, r)
+	// The claims of the access token are read from the request, where they have been stored after the authorization
+	decodedToken, err := AuthenticateRequest(w, r)
 	if err != nil {
-		MakeErrorResponse(w, http.StatusUnauthorized, "Permission denied")
-		log.Println("Permission denied")
-		return
-	}
-	decodedToken, err := ValidateToken(tokenString, w)
-	if err != nil {
-		MakeErrorResponse(w, http.StatusUnauthorized, "Permission denied")
-		log.Println("Permission denied")
-		return
-	}
-	if decodedToken.Type != "student" {
-		MakeErrorResponse(w, http.StatusUnauthorized, "Permission denied")
-		log.Println("Permission denied")
 		return
 	}
 
 	/* Upon successful validation a distributed transaction starts: api gateway send to course management and notification
 	management micro-services a request to deregister the user to course in their own data-store. The request succeeds only
-	if the operation is completed by both micro-services. The requests are send in parallel using goroutines. */
-
-	// Collecting parameters for requests to course management and notification management micro-services
-	studentUsername := mux.Vars(r)["username"]
-	studentMail := decodedToken.Mail
-	var courseMinimized CourseMinimized
-	var course Course
-	body, err := ioutil.ReadAll(r.Body)
+	if the operation is completed by both micro-services. */
+	parameters, err := subscriptionParameters(r, decodedToken)
 	if err != nil {
 		MakeErrorResponse(w, http.StatusInternalServerError, "API Gateway - Internal Server Error")
 		log.Println("API Gateway - Internal Server Error")
 		return
 	}
-	err = json.Unmarshal(body, &courseMinimized)
+	ExecuteSaga(w, r, unsubscribeStudentSaga, parameters)
+}
+
+// CreateCourse process the course creation request coming from the client. The AuthorizationMiddleware has already
+// checked that the request comes from a teacher, according to the access policy. The request is forwarded to the
+// micro-service and the response is forwarded to the client.
+func CreateCourse(w http.ResponseWriter, r *http.Request) {
+
+	// For authentication purpose the access token is read from the request and validated
+	_, err := AuthenticateRequest(w, r)
 	if err != nil {
-		MakeErrorResponse(w, http.StatusInternalServerError, "API Gateway - Internal Server Error")
-		log.Println("API Gateway - Internal Server Error")
 		return
 	}
-	err = json.Unmarshal(body, &course)
+
+	/* Upon successful validation a distributed transaction starts: api gateway send to course management and notification
+	management micro-services a request to create course in their own data-store. The creation of course succeed only if the
+	operation is completed by both micro-services. */
+	requestBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		MakeErrorResponse(w, http.StatusInternalServerError, "API Gateway - Internal Server Error")
 		log.Println("API Gateway - Internal Server Error")
 		return
 	}
-
-	//Initialize the channel to receive the exit of local transactions
-	c := make(chan localTransaction, 2)
-
-	//Launching goRoutines responsible to actuate local transaction
-	go removeSubscriptionInCourseManagement(studentUsername, courseMinimized.Id, c)
-	go removeSubscriptionInNotificationManagement(studentMail, course, c)
-
-	isSentResponse := false     // Indicate if an internal error occurred and client already received a response
-	var response *http.Response // The response for the client
-	var localTransaction localTransaction
-	var failingMicroservice []string // Contains the name of micro-service(s) that failed the execution of the request
-	var i int
-
-	for i = 0; i <= 1; i++ {
-		// Waiting for the exit of local transactions
-		localTransaction = <-c
-		if localTransaction.Response == nil {
-			// Any error occurred during forwarding of request: the client receive immediately an Internal Server Error
-			failingMicroservice = append(failingMicroservice, localTransaction.Microservice)
-			if isSentResponse == false {
-				isSentResponse = true
-				MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
-				log.Println("Api Gateway - Internal Server Error")
-			}
-		} else if localTransaction.Response.StatusCode != http.StatusOK {
-			// Failure: the client receive the last error response that the api-gateway obtained from micro-services
-			failingMicroservice = append(failingMicroservice, localTransaction.Microservice)
-			response = localTransaction.Response
-		} else {
-			// Success: the client receive the success response from course management micro-service.
-			if localTransaction.Microservice == "courseManagement" {
-				if response == nil {
-					response = localTransaction.Response
-				}
-			}
-		}
-	}
-
-	// If only a micro-service fail the other have to undo the action just completed
-	if len(failingMicroservice) == 1 {
-		if failingMicroservice[0] == "courseManagement" {
-			addSubscriptionInNotificationManagement(studentMail, course, nil)
-		} else {
-			addSubscriptionInCourseManagement(studentUsername, "", "", courseMinimized.Id, nil)
-		}
-	}
-
-	// If no Internal Server Error occurred the response from micro-services is forwarded to client
-	if !isSentResponse {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(response.StatusCode)
-		responseBody, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
-			log.Println("Api Gateway - Internal Server Error")
-			return
-		}
-		_, err = w.Write(responseBody)
-		if err != nil {
-			MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
-			log.Println("Api Gateway - Internal Server Error")
-			return
-		}
-	}
+	ExecuteSaga(w, r, createCourseSaga, SagaParameters{"course": string(requestBody)})
 }
 
-// CreateCourse process the course creation request coming from the client validating the embedded access token. If the token
-// is properly signed, it checks if the request comes from a student, because course creation is allowed for teachers
-// only. Upon successful validation, the request is forwarded to the micro-service and the response is forwarded to the
-// client.
-func CreateCourse(w http.ResponseWriter, r *http.Request) {
+// DeleteCourse process the course deletion request coming from the client. The AuthorizationMiddleware has already
+// checked that the request comes from the teacher holding the course, according to the access policy. The course is
+// deleted from both course management and notification management micro-services.
+func DeleteCourse(w http.ResponseWriter, r *http.Request) {
 
-	// For authentication purpose the access token is read from the Cookie header
-	tokenString, err := GetToken(w, r)
+	// For authentication purpose the access token is read from the request and validated
+	_, err := AuthenticateRequest(w, r)
 	if err != nil {
 		return
 	}
-	// The token is decoded and the claims are obtained for further checks
-	decodedToken, err := ValidateToken(tokenString, w)
+
+	// The course management micro-service identifies the course by id, the notification management one by the
+	// information in the body of the request
+	var course Course
+	err = json.NewDecoder(r.Body).Decode(&course)
 	if err != nil {
+		MakeErrorResponse(w, http.StatusBadRequest, "Bad Request")
+		log.Println("Bad Request")
 		return
 	}
-	// Upon successful authentication check if the request comes from a teacher.
-	// In case of student request an Unauthorized code is returned
-	if decodedToken.Type != "teacher" {
-		MakeErrorResponse(w, http.StatusUnauthorized, "Permission denied")
-		log.Println("Permission denied")
+	// The ownership has been checked for the course in the URL, so the body has to describe the same course, otherwise
+	// the micro-services would delete different courses
+	courseId := mux.Vars(r)["courseId"]
+	found, present, err := findCourse(r.Context(), course)
+	if err != nil {
+		makeUpstreamErrorResponse(w, err)
 		return
 	}
-
-	/* Upon successful validation a distributed transaction starts: api gateway send to course management and notification
-	management micro-services a request to create course in their own data-store. The creation of course succeed only if the
-	operation is completed by both micro-services. The requests are send in parallel using goroutines.  */
-
-	//Initialize the channel to receive the exit of local transactions
-	c := make(chan localTransaction, 2)
-	//Launching goRoutines responsible to actuate local transactions
-	requestBody, _ := ioutil.ReadAll(r.Body)
-	go createCourseInCourseManagement(requestBody, c)
-	go createCourseInNotificationManagement(requestBody, c)
-
-	isSentResponse := false     // Indicate if an internal error occurred and client already received a response
-	var response *http.Response // The response for the client
-	var localTransaction localTransaction
-	var failingMicroservice []string             // Contains the name of micro-service(s) that failed the execution of the request
-	var courseInCourseManagement CourseMinimized // Contains the id of course inserted in course management micro-service
-	var courseInNotificationManagement Course    // Contains the name of course inserted in notification micro-service
-	var i int
-
-	for i = 0; i <= 1; i++ {
-		// Waiting for the exit of local transactions
-		localTransaction = <-c
-		if localTransaction.Response == nil {
-			// Any error occurred during forwarding of request: the client receive immediately an Internal Server Error
-			failingMicroservice = append(failingMicroservice, localTransaction.Microservice)
-			if isSentResponse == false {
-				isSentResponse = true
-				MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
-				log.Println("Api Gateway - Internal Server Error")
-			}
-		} else if localTransaction.Response.StatusCode != http.StatusCreated {
-			// Failure: the client receive the last error response that the api-gateway obtained from micro-services
-			failingMicroservice = append(failingMicroservice, localTransaction.Microservice)
-			response = localTransaction.Response
-		} else {
-			// Success: the client receive the success response from course management micro-service.
-			// The id of inserted course in micro-services are stored for eventually future deletion
-			if localTransaction.Microservice == "courseManagement" {
-				if response == nil {
-					response = localTransaction.Response
-				}
-				body, _ := ioutil.ReadAll(localTransaction.Response.Body)
-				_ = json.Unmarshal(body, &courseInCourseManagement)
-			} else if localTransaction.Microservice == "notificationManagement" {
-				body, _ := ioutil.ReadAll(localTransaction.Response.Body)
-				_ = json.Unmarshal(body, &courseInNotificationManagement)
-			}
-		}
-	}
-
-	// If only a micro-service fail the other have to undo the action just completed
-	if len(failingMicroservice) == 1 {
-		if failingMicroservice[0] == "courseManagement" {
-			deleteCourseInNotificationManagement(courseInNotificationManagement)
-		} else {
-			deleteCourseInCourseManagement(courseInCourseManagement.Id)
-		}
+	if !present || found.Id != courseId {
+		MakeErrorResponse(w, http.StatusBadRequest, "Bad Request - The course does not match the course id")
+		log.Println("Bad Request - The course does not match the course id " + courseId)
+		return
 	}
-
-	// If no Internal Server Error occurred the response from micro-services is forwarded to client
-	if !isSentResponse {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(response.StatusCode)
-		responseBody, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
-			log.Println("Api Gateway - Internal Server Error")
-			return
-		}
-		_, err = w.Write(responseBody)
-		if err != nil {
-			MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
-			log.Println("Api Gateway - Internal Server Error")
-			return
-		}
+	requestBody, err := json.Marshal(course)
+	if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "API Gateway - Internal Server Error")
+		log.Println("API Gateway - Internal Server Error")
+		return
 	}
+	ExecuteSaga(w, r, deleteCourseSaga, SagaParameters{"courseId": courseId, "course": string(requestBody)})
 }
 
 // createCourseInNotificationManagement send a request of course creation to notification management micro-service.
-func createCourseInNotificationManagement(body []byte, channel chan localTransaction) {
+func createCourseInNotificationManagement(ctx context.Context, parameters SagaParameters) (*http.Response, error) {
 	// Retrieving the name of course from the body of request
-	var course Course
-	err := json.Unmarshal(body, &course)
-	if err != nil {
-		// Communicating to main thread the failure of local transaction
-		channel <- localTransaction{"notificationManagement", nil}
-		return
-	}
-	requestBody, err := json.Marshal(course)
+	requestBody, err := courseOf(parameters)
 	if err != nil {
-		// Communicating to main thread the failure of local transaction
-		channel <- localTransaction{"notificationManagement", nil}
-		return
+		return nil, err
 	}
 	// Send the post request to notification management micro-service
-	resp, err := http.Post(config.Configuration.NotificationManagementAddress+"course",
+	return doUpstream(ctx, NotificationManagement, http.MethodPost, "course",
 		"application/json", bytes.NewBuffer(requestBody))
-	if err != nil {
-		// Communicating to main thread the failure of local transaction
-		channel <- localTransaction{"notificationManagement", nil}
-		return
-	}
-	// Communicating to main thread the exit of local transaction
-	channel <- localTransaction{"notificationManagement", resp}
 }
 
 // createCourseInCourseManagement send a request of course creation to course management micro-service.
-func createCourseInCourseManagement(requestBody []byte, channel chan localTransaction) {
+func createCourseInCourseManagement(ctx context.Context, parameters SagaParameters) (*http.Response, error) {
 	// Send the post request to course management micro-service
-	resp, err := http.Post(config.Configuration.CourseManagementAddress+"courses",
-		"application/json", bytes.NewBuffer(requestBody))
-	if err != nil {
-		// Communicating to main thread the failure of local transaction
-		channel <- localTransaction{"courseManagement", nil}
-		return
-	}
-	// Communicating to main thread the exit of local transaction
-	channel <- localTransaction{"courseManagement", resp}
+	return doUpstream(ctx, CourseManagement, http.MethodPost, "courses",
+		"application/json", bytes.NewBufferString(parameters["course"]))
+}
+
+// removeCourseInCourseManagement send a request of course deletion to course management micro-service.
+func removeCourseInCourseManagement(ctx context.Context, parameters SagaParameters) (*http.Response, error) {
+	return doUpstream(ctx, CourseManagement, http.MethodDelete, "courses/"+parameters["courseId"], "", nil)
 }
 
-// deleteCourseInCourseManagement send a request of course deletion to course management micro-service.
-func deleteCourseInCourseManagement(courseId string) {
-	client := &http.Client{}
-	request, err := http.NewRequest(http.MethodDelete, config.Configuration.CourseManagementAddress+"courses/"+courseId, nil)
+// removeCourseInNotificationManagement send a request of course deletion to notification management micro-service.
+func removeCourseInNotificationManagement(ctx context.Context, parameters SagaParameters) (*http.Response, error) {
+	body, err := courseOf(parameters)
 	if err != nil {
-		log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
-	}
-	response, err := client.Do(request)
-	if err != nil || response.StatusCode != 200 {
-		log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
+		return nil, err
 	}
+	return doUpstream(ctx, NotificationManagement, http.MethodDelete, "course", "", bytes.NewBuffer(body))
+}
 
+// deleteCourseInCourseManagement undoes the creation of a course in course management micro-service, given the
+// created course. If the created course is unknown, because the api gateway stopped while creating it, the course is
+// looked up by the information in the parameters.
+func deleteCourseInCourseManagement(ctx context.Context, parameters SagaParameters, result []byte) error {
+	var course CourseMinimized
+	if result != nil {
+		err := json.Unmarshal(result, &course)
+		if err != nil {
+			return err
+		}
+	} else {
+		var created Course
+		err := json.Unmarshal([]byte(parameters["course"]), &created)
+		if err != nil {
+			return err
+		}
+		var present bool
+		course, present, err = findCourse(ctx, created)
+		if err != nil {
+			return err
+		}
+		if !present {
+			// There is nothing to undo
+			return nil
+		}
+	}
+	return undoWith(removeCourseInCourseManagement, http.StatusOK)(ctx, SagaParameters{"courseId": course.Id}, nil)
 }
 
-// deleteCourseInNotificationManagement send a request of course deletion to notification management micro-service.
-func deleteCourseInNotificationManagement(course Course) {
-	client := &http.Client{}
-	body, err := json.Marshal(course)
+// findCourse searches in course management micro-service the given course, and returns false if it does not exist
+func findCourse(ctx context.Context, course Course) (CourseMinimized, bool, error) {
+	resp, err := doUpstream(ctx, CourseManagement, http.MethodGet, "courses/name/"+url.PathEscape(course.Name), "", nil)
+	if err != nil {
+		return CourseMinimized{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return CourseMinimized{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return CourseMinimized{}, false, CourseListUnavailable
+	}
+	// The search returns the courses whose name contains the given one
+	var courses []struct {
+		CourseMinimized
+		Course
+	}
+	err = json.NewDecoder(resp.Body).Decode(&courses)
 	if err != nil {
-		log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
+		return CourseMinimized{}, false, err
 	}
-	request, _ := http.NewRequest(http.MethodDelete, config.Configuration.NotificationManagementAddress+"course", bytes.NewBuffer(body))
-	response, err := client.Do(request)
-	if err != nil || response.StatusCode != 200 {
-		log.Println(err)
-		log.Panicln("Api Gateway - Consistency problem. Please, recover the system.")
+	for _, found := range courses {
+		if found.Course == course {
+			return found.CourseMinimized, true, nil
+		}
 	}
+	return CourseMinimized{}, false, nil
 }
 
-// This struct encapsulates the exit of single local transaction. Its fields are used by main thread to orchestrate
-// the other micro-service involved in distributed transaction. It is assumed an internal error if response is nil
-type localTransaction struct {
-	Microservice string
-	Response     *http.Response
+// deleteCourseInNotificationManagement undoes the creation of a course in notification management micro-service. The
+// course is identified by the information in the parameters, so the created course is not needed. A course not found
+// has not been created, or has already been deleted.
+func deleteCourseInNotificationManagement(ctx context.Context, parameters SagaParameters, _ []byte) error {
+	response, err := removeCourseInNotificationManagement(ctx, parameters)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNotFound {
+		return errors.New("unexpected status " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
 }
 
-// PushCourseNotification process the request of notification push sent by the client checking that the provider is
-// a teacher. Upon successful validation, the request is forwarded to the course management microservice and the response
-// is returned to the client
+// PushCourseNotification process the request of notification push sent by the client. The AuthorizationMiddleware has
+// already checked that the provider is the teacher holding the course. The request is forwarded to the course management
+// microservice and the response is returned to the client
 func PushCourseNotification(w http.ResponseWriter, r *http.Request) {
-	/*For authentication purpose, the access token is read from the Cookie header*/
-	tokenString, err := GetToken(w, r)
+	/* For authentication purpose the access token is read from the request and validated */
+	_, err := AuthenticateRequest(w, r)
 	if err != nil {
 		return
 	}
-	/*The token is decoded and the claims are obtained for further checks*/
-	decodedToken, err := ValidateToken(tokenString, w)
-	if err != nil {
-		return
-	}
-	// only a teacher can push a notification
-	if decodedToken.Type != "teacher" {
-		MakeErrorResponse(w, http.StatusUnauthorized, "Permission denied")
-		log.Println("Permission denied")
-		return
-	}
 	vars := mux.Vars(r)
 	courseId := vars["courseId"]
 	// on success validation, the request is forwarded to the microservice
-	err = ForwardAndReturnPost(config.Configuration.CourseManagementAddress+"courses/"+courseId+"/notification", "application/json", w, r)
+	err = ProxyToUpstream(CourseManagement, "courses/"+courseId+"/notification", w, r)
 	if err != nil {
-		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
-		log.Println("Api Gateway - Internal Server Error")
+		makeUpstreamErrorResponse(w, err)
 		return
 	}
 }
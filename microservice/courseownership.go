@@ -0,0 +1,123 @@
+package microservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Default time for which the courses held by a teacher are cached
+const defaultCourseOwnershipCacheSeconds = 30
+
+var CourseListUnavailable = errors.New("course list unavailable")
+
+// teacherCourses contains the courses held by a teacher, as returned by course management, and the time after which
+// they have to be asked again. Refetched tells if they have already been asked again before that time, because a course
+// was not among them.
+type teacherCourses struct {
+	Courses   []CourseMinimized
+	ExpiresAt time.Time
+	Refetched bool
+}
+
+// courseOwnershipCache caches the courses held by the teachers, indexed by "<Name>-<Surname>", so that the ownership
+// of a course can be checked without asking course management at every request
+type courseOwnershipCache struct {
+	sync.Mutex
+	teachers map[string]teacherCourses
+}
+
+var courseOwnership = courseOwnershipCache{teachers: make(map[string]teacherCourses)}
+
+// courseOwnershipCacheLifetime returns the time for which the courses held by a teacher, found for the request with
+// the given context, are cached
+func courseOwnershipCacheLifetime(ctx context.Context) time.Duration {
+	seconds := configurationOf(ctx).CourseOwnershipCacheSeconds
+	if seconds <= 0 {
+		seconds = defaultCourseOwnershipCacheSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// findCourses asks course management for the list of courses returned by the given query
+func findCourses(ctx context.Context, query string) ([]CourseMinimized, error) {
+	resp, err := doUpstream(ctx, CourseManagement, http.MethodGet, query, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, CourseListUnavailable
+	}
+	var courses []CourseMinimized
+	err = json.NewDecoder(resp.Body).Decode(&courses)
+	if err != nil {
+		return nil, err
+	}
+	return courses, nil
+}
+
+// containsCourse returns true if the course with the given id is in the given list
+func containsCourse(courses []CourseMinimized, courseId string) bool {
+	for _, course := range courses {
+		if course.Id == courseId {
+			return true
+		}
+	}
+	return false
+}
+
+// teacherHoldsCourse checks if the teacher the given token was issued to holds the course with the given id. The
+// courses held by the teacher are cached, but when the course is not among the cached ones they are asked again to
+// course management, so that a course just created can be used immediately. They are asked again at most once in the
+// lifetime of the cached ones, so that the requests for courses not held do not reach course management every time.
+func teacherHoldsCourse(ctx context.Context, claims Claims, courseId string) (bool, error) {
+	teacherName := claims.Name + "-" + claims.Surname
+	courseOwnership.Lock()
+	cached, present := courseOwnership.teachers[teacherName]
+	courseOwnership.Unlock()
+	fresh := present && time.Now().Before(cached.ExpiresAt)
+	if fresh && containsCourse(cached.Courses, courseId) {
+		return true, nil
+	}
+	if fresh && cached.Refetched {
+		return false, nil
+	}
+	courses, err := findCourses(ctx, "courses/teacher/"+teacherName)
+	if err != nil {
+		return false, err
+	}
+	entry := teacherCourses{courses, time.Now().Add(courseOwnershipCacheLifetime(ctx)), false}
+	if fresh {
+		// The courses asked again keep the lifetime of the cached ones
+		entry = teacherCourses{courses, cached.ExpiresAt, true}
+	}
+	courseOwnership.Lock()
+	courseOwnership.teachers[teacherName] = entry
+	courseOwnership.Unlock()
+	return containsCourse(courses, courseId), nil
+}
+
+// forgetCourse forgets the cached courses of the teachers holding the course with the given id, e.g. because it has
+// been deleted
+func (cache *courseOwnershipCache) forgetCourse(courseId string) {
+	cache.Lock()
+	defer cache.Unlock()
+	for teacherName, cached := range cache.teachers {
+		if containsCourse(cached.Courses, courseId) {
+			delete(cache.teachers, teacherName)
+		}
+	}
+}
+
+// flush forgets the cached courses of all the teachers. It returns the number of teachers removed.
+func (cache *courseOwnershipCache) flush() int {
+	cache.Lock()
+	defer cache.Unlock()
+	removed := len(cache.teachers)
+	cache.teachers = make(map[string]teacherCourses)
+	return removed
+}
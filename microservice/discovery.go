@@ -0,0 +1,308 @@
+package microservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of service discovery
+const (
+	staticDiscoveryKind = "static"
+	fileDiscoveryKind   = "file"
+	dnsDiscoveryKind    = "dns"
+)
+
+// Default interval between two refreshes of the instances found by the service discovery
+const defaultDiscoveryRefreshInterval = 10 * time.Second
+
+// Timeout of the DNS queries of the service discovery
+const dnsLookupTimeout = 5 * time.Second
+
+var UnknownDiscovery = errors.New("unknown service discovery")
+
+// Discovery finds the base addresses of the instances of the micro-services. The implementations that look the
+// instances up somewhere keep them up to date through Refresh, that is called periodically.
+type Discovery interface {
+	// Instances returns the base addresses of the instances of the given micro-service, or nil if they are not known
+	Instances(name string) []string
+	// Refresh looks the instances of the micro-services up again
+	Refresh() error
+}
+
+// staticDiscovery finds the instances in the configuration: the ones listed for the micro-service or, if none is
+// listed, the single instance at the address of the micro-service
+type staticDiscovery struct{}
+
+// discoveredInstances contains the instances found by a discovery that looks them up, indexed by micro-service
+type discoveredInstances struct {
+	sync.RWMutex
+	instances map[string][]string
+}
+
+// fileDiscovery finds the instances in a JSON file that maps the name of every micro-service to the list of the base
+// addresses of its instances, e.g. {"courseManagement": ["http://10.0.0.1:8080/course_management/api/v1.0/"]}. The
+// file is read again whenever it is modified. The micro-services missing in the file are found in the configuration.
+type fileDiscovery struct {
+	discoveredInstances
+	file     string
+	modified time.Time
+}
+
+// dnsDiscovery finds the instances through the DNS. If a SRV record is configured for a micro-service, an instance is
+// found for every target of the record; otherwise an instance is found for every address of the A and AAAA records of
+// the host of the micro-service. The scheme and the path of the instances are the ones of the address of the
+// micro-service, and so is the port when no SRV record is used. The last instances found are kept when a query fails.
+type dnsDiscovery struct {
+	discoveredInstances
+	resolver *net.Resolver
+}
+
+// serviceDiscovery contains the discovery in use, with the channel that stops its periodic refresh
+type serviceDiscovery struct {
+	sync.RWMutex
+	discovery Discovery
+	stop      chan struct{}
+}
+
+var discovery = serviceDiscovery{discovery: staticDiscovery{}}
+
+// Instances returns the instances of the given micro-service found in the configuration
+func (staticDiscovery) Instances(name string) []string {
+	instances := config.Get().Upstreams[name].Instances
+	if len(instances) > 0 {
+		return instances
+	}
+	address, present := upstreamAddresses()[name]
+	if !present {
+		return nil
+	}
+	return []string{address}
+}
+
+// Refresh does nothing, because the instances are read from the configuration every time
+func (staticDiscovery) Refresh() error {
+	return nil
+}
+
+// Instances returns the instances of the given micro-service found the last time they were looked up
+func (found *discoveredInstances) Instances(name string) []string {
+	found.RLock()
+	defer found.RUnlock()
+	return found.instances[name]
+}
+
+// set replaces the instances of the given micro-service
+func (found *discoveredInstances) set(name string, instances []string) {
+	found.Lock()
+	defer found.Unlock()
+	found.instances[name] = instances
+}
+
+// Instances returns the instances of the given micro-service listed in the file, or the ones in the configuration if
+// the micro-service is not listed
+func (discovery *fileDiscovery) Instances(name string) []string {
+	instances := discovery.discoveredInstances.Instances(name)
+	if len(instances) == 0 {
+		return staticDiscovery{}.Instances(name)
+	}
+	return instances
+}
+
+// Refresh reads the file again if it has been modified since the last time
+func (discovery *fileDiscovery) Refresh() error {
+	info, err := os.Stat(discovery.file)
+	if err != nil {
+		return err
+	}
+	discovery.RLock()
+	modified := discovery.modified
+	discovery.RUnlock()
+	if info.ModTime().Equal(modified) {
+		return nil
+	}
+	content, err := ioutil.ReadFile(discovery.file)
+	if err != nil {
+		return err
+	}
+	var instances map[string][]string
+	err = json.Unmarshal(content, &instances)
+	if err != nil {
+		return err
+	}
+	discovery.Lock()
+	discovery.instances = instances
+	discovery.modified = info.ModTime()
+	discovery.Unlock()
+	log.Println("Instances of the micro-services read from " + discovery.file)
+	return nil
+}
+
+// Instances returns the instances of the given micro-service found through the DNS, or the one at the address of the
+// micro-service if no instance has been found yet
+func (discovery *dnsDiscovery) Instances(name string) []string {
+	instances := discovery.discoveredInstances.Instances(name)
+	if len(instances) == 0 {
+		return staticDiscovery{}.Instances(name)
+	}
+	return instances
+}
+
+// Refresh looks up again the instances of every micro-service. The micro-services whose query fails keep their
+// instances, and the error is returned after the others have been looked up.
+func (discovery *dnsDiscovery) Refresh() error {
+	var lastErr error
+	for name, address := range upstreamAddresses() {
+		instances, err := discovery.lookup(address, config.Get().Upstreams[name].SRVName)
+		if err != nil {
+			log.Println("DNS lookup of the instances of " + name + " failed: " + err.Error())
+			lastErr = err
+			continue
+		}
+		discovery.set(name, instances)
+	}
+	return lastErr
+}
+
+// lookup returns the instances of the micro-service at the given address, found through the given SRV record or, if
+// it is empty, through the address records of the host
+func (discovery *dnsDiscovery) lookup(address string, srvName string) ([]string, error) {
+	template, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	var hosts []string
+	if srvName != "" {
+		_, records, err := discovery.resolver.LookupSRV(ctx, "", "", srvName)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+		}
+	} else {
+		addresses, err := discovery.resolver.LookupIPAddr(ctx, template.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addresses {
+			host := ip.IP.String()
+			if template.Port() != "" {
+				host = net.JoinHostPort(host, template.Port())
+			} else if ip.IP.To4() == nil {
+				host = "[" + host + "]"
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	instances := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		instance := *template
+		instance.Host = host
+		instances = append(instances, instance.String())
+	}
+	return instances, nil
+}
+
+// upstreamInstances returns the base addresses of the instances of the given micro-service, found by the discovery in
+// use
+func upstreamInstances(name string) []string {
+	discovery.RLock()
+	defer discovery.RUnlock()
+	return discovery.discovery.Instances(name)
+}
+
+// StartDiscovery puts in use the service discovery of the configured kind, refreshing it at the configured interval
+func StartDiscovery() error {
+	newDiscovery, interval, err := discoveryOf(config.Get())
+	if err != nil {
+		return err
+	}
+	return UseDiscovery(newDiscovery, interval)
+}
+
+// discoveryOf creates the service discovery of the kind set in the given configuration, and returns it with the
+// interval at which it has to be refreshed
+func discoveryOf(configuration config.Config) (Discovery, time.Duration, error) {
+	var newDiscovery Discovery
+	switch configuration.Discovery {
+	case "", staticDiscoveryKind:
+		newDiscovery = staticDiscovery{}
+	case fileDiscoveryKind:
+		newDiscovery = &fileDiscovery{
+			discoveredInstances: discoveredInstances{instances: make(map[string][]string)},
+			file:                configuration.DiscoveryFile,
+		}
+	case dnsDiscoveryKind:
+		newDiscovery = &dnsDiscovery{
+			discoveredInstances: discoveredInstances{instances: make(map[string][]string)},
+			resolver:            net.DefaultResolver,
+		}
+	default:
+		return nil, 0, UnknownDiscovery
+	}
+	interval := defaultDiscoveryRefreshInterval
+	if configuration.DiscoveryRefreshSeconds > 0 {
+		interval = time.Duration(configuration.DiscoveryRefreshSeconds) * time.Second
+	}
+	return newDiscovery, interval, nil
+}
+
+// UseDiscovery puts in use the given service discovery and, unless it is the static one, refreshes it at the given
+// interval, so that the instances of the micro-services are updated while the api gateway is running. The instances
+// are looked up once before returning. The discovery previously in use is stopped.
+func UseDiscovery(newDiscovery Discovery, interval time.Duration) error {
+	err := newDiscovery.Refresh()
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	discovery.Lock()
+	if discovery.stop != nil {
+		close(discovery.stop)
+	}
+	discovery.discovery = newDiscovery
+	discovery.stop = stop
+	discovery.Unlock()
+	if _, static := newDiscovery.(staticDiscovery); !static {
+		go refreshDiscovery(newDiscovery, interval, stop)
+	}
+	return nil
+}
+
+// refreshDiscovery refreshes the given discovery at the given interval, until the given channel is closed
+func refreshDiscovery(discovery Discovery, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := discovery.Refresh()
+			if err != nil {
+				log.Println("Service discovery refresh failed: " + err.Error())
+			}
+		}
+	}
+}
+
+// RefreshDiscovery looks the instances of the micro-services up immediately, without waiting for the periodic refresh
+func RefreshDiscovery() error {
+	discovery.RLock()
+	current := discovery.discovery
+	discovery.RUnlock()
+	return current.Refresh()
+}
@@ -10,11 +10,29 @@ import (
 func MakeErrorResponse(w http.ResponseWriter, code int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
+	w.Write(errorPayload(message))
+}
+
+// errorPayload returns the body of an error response with the message specified
+func errorPayload(message string) []byte {
 	response := simplejson.New()
 	response.Set("error", message)
 	responsePayload, err := response.MarshalJSON()
 	if err != nil {
 		log.Panicln(err)
 	}
-	w.Write(responsePayload)
+	return responsePayload
+}
+
+// makeUpstreamErrorResponse generates an http response for a request that could not be completed because of the given
+// error in the interaction with a micro-service. When the circuit breaker of the micro-service is open, or all its
+// instances are ejected, the client is told that the service is unavailable, otherwise the error is an internal one.
+func makeUpstreamErrorResponse(w http.ResponseWriter, err error) {
+	if err == CircuitOpen || err == NoHealthyInstance {
+		MakeErrorResponse(w, http.StatusServiceUnavailable, "Api Gateway - Service Unavailable")
+		log.Println("Api Gateway - Service Unavailable")
+		return
+	}
+	MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+	log.Println("Api Gateway - Internal Server Error")
 }
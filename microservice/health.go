@@ -0,0 +1,151 @@
+package microservice
+
+import (
+	"github.com/redefik/sdccproject/apigateway/config"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Default settings of the health checks of the micro-services
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+)
+
+// InstanceStatus encapsulates the state of an instance of a micro-service, as reported by the readiness endpoint
+type InstanceStatus struct {
+	Address   string    `json:"address"`
+	Healthy   bool      `json:"healthy"`
+	Ejected   bool      `json:"ejected"`
+	LastCheck time.Time `json:"lastCheck,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// DependencyStatus encapsulates the state of a micro-service the api gateway depends on. The micro-service is healthy
+// if at least one of its instances can receive requests.
+type DependencyStatus struct {
+	Name      string           `json:"name"`
+	Healthy   bool             `json:"healthy"`
+	Instances []InstanceStatus `json:"instances"`
+}
+
+// ReadinessStatus encapsulates the answer of the readiness endpoint
+type ReadinessStatus struct {
+	Status       string             `json:"status"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// recordProbe counts the outcome of a health check of the instance. The instance becomes unhealthy after the configured
+// number of failed checks in a row, and healthy again after the configured number of successful checks in a row. A
+// successful check admits again an ejected instance too.
+func (instance *upstreamInstance) recordProbe(health UpstreamHealth) {
+	balancer := instance.balancer
+	balancer.Lock()
+	defer balancer.Unlock()
+	instance.lastCheck = time.Now()
+	instance.lastCheckError = health.Error
+	if health.Healthy {
+		instance.probeSuccesses++
+		instance.probeFailures = 0
+		if instance.unhealthy && instance.probeSuccesses >= balancer.healthyThreshold {
+			instance.unhealthy = false
+			log.Println("Instance " + instance.address + " of " + balancer.name + " healthy")
+		}
+		if instance.ejected {
+			instance.ejected = false
+			instance.consecutiveFailures = 0
+			log.Println("Instance " + instance.address + " of " + balancer.name + " admitted again")
+		}
+		return
+	}
+	instance.probeFailures++
+	instance.probeSuccesses = 0
+	if !instance.unhealthy && instance.probeFailures >= balancer.unhealthyThreshold {
+		instance.unhealthy = true
+		log.Println("Instance " + instance.address + " of " + balancer.name + " unhealthy: " + health.Error)
+	}
+}
+
+// CheckUpstreamHealth checks in parallel the health of all the instances of the given micro-service, and waits for the
+// end of the checks
+func CheckUpstreamHealth(name string) {
+	balancer := loadBalancerOf(name)
+	balancer.Lock()
+	instances := append([]*upstreamInstance(nil), balancer.instances...)
+	balancer.Unlock()
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(instance *upstreamInstance) {
+			defer wg.Done()
+			instance.recordProbe(probeUpstream(name, instance.address))
+		}(instance)
+	}
+	wg.Wait()
+}
+
+// StartHealthChecks starts checking periodically the health of the instances of every micro-service, each one with
+// its configured interval. The first check is made immediately.
+func StartHealthChecks() {
+	for name := range upstreamAddresses() {
+		interval := durationSetting(config.Get().Upstreams[name].HealthCheckIntervalMs, defaultHealthCheckInterval)
+		go func(name string, interval time.Duration) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				CheckUpstreamHealth(name)
+				<-ticker.C
+			}
+		}(name, interval)
+	}
+}
+
+// dependencyStatus returns the state of the given micro-service and of its instances
+func dependencyStatus(name string) DependencyStatus {
+	balancer := loadBalancerOf(name)
+	balancer.Lock()
+	defer balancer.Unlock()
+	dependency := DependencyStatus{Name: name, Instances: []InstanceStatus{}}
+	for _, instance := range balancer.instances {
+		dependency.Healthy = dependency.Healthy || instance.available()
+		dependency.Instances = append(dependency.Instances, InstanceStatus{
+			Address:   instance.address,
+			Healthy:   !instance.unhealthy,
+			Ejected:   instance.ejected,
+			LastCheck: instance.lastCheck,
+			Error:     instance.lastCheckError,
+		})
+	}
+	return dependency
+}
+
+// Liveness tells an external component that the api gateway is running
+func Liveness(w http.ResponseWriter, _ *http.Request) {
+	writeJSONResponse(w, http.StatusOK, map[string]string{"status": "alive"})
+}
+
+// Readiness tells an external component if the api gateway can serve the requests, that is if every micro-service has
+// at least one instance that can receive requests. The state of every micro-service is returned; when some
+// micro-service has no available instance the response is 503 Service Unavailable.
+func Readiness(w http.ResponseWriter, _ *http.Request) {
+	readiness := ReadinessStatus{Status: "ready", Dependencies: []DependencyStatus{}}
+	for name := range upstreamAddresses() {
+		dependency := dependencyStatus(name)
+		if !dependency.Healthy {
+			readiness.Status = "not ready"
+		}
+		readiness.Dependencies = append(readiness.Dependencies, dependency)
+	}
+	sort.Slice(readiness.Dependencies, func(i, j int) bool {
+		return readiness.Dependencies[i].Name < readiness.Dependencies[j].Name
+	})
+	statusCode := http.StatusOK
+	if readiness.Status != "ready" {
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeJSONResponse(w, statusCode, readiness)
+}
@@ -0,0 +1,286 @@
+package microservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default time for which the outcome of a request with an idempotency key is stored
+const defaultIdempotencyKeyTTLSeconds = 24 * 60 * 60
+
+// Maximum length of an idempotency key
+const maxIdempotencyKeyLength = 255
+
+// Maximum size of a response stored for an idempotency key. The outcome of a request with a larger response is not
+// stored, so the request is executed again if repeated.
+const maxIdempotentResponseSize = 1 << 20
+
+// Maximum size of the body of a request with an idempotency key. The body is kept in memory to be compared with the
+// body of the repetitions.
+const maxIdempotentRequestSize = 1 << 20
+
+// Maximum number of idempotency keys stored. When it is reached the requests with a new key are executed without
+// storing their outcome, so that clients sending many keys cannot exhaust the memory.
+const maxIdempotencyKeys = 10000
+
+// Maximum total size of the responses stored for the idempotency keys. When it is reached the outcomes of the new
+// requests are not stored.
+const maxIdempotentResponsesSize = 64 << 20
+
+// Interval between two removals of the expired outcomes, made while reserving the keys
+const idempotencyKeyPurgeInterval = time.Minute
+
+// Header that marks a response as the stored outcome of a previous request with the same idempotency key
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// Headers of a response that are stored together with its status and body
+var idempotentResponseHeaders = []string{"Content-Type", "Location", "Preference-Applied"}
+
+// idempotentOutcome is the outcome of a request with an idempotency key, together with the digest of the body of the
+// request. The response is unknown while the request is in progress.
+type idempotentOutcome struct {
+	bodyHash  string
+	done      bool
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+// idempotencyStore contains the outcomes of the requests with an idempotency key, indexed by user, method, path and
+// key, and the total size of their responses
+type idempotencyStore struct {
+	sync.Mutex
+	outcomes  map[string]*idempotentOutcome
+	size      int
+	lastPurge time.Time
+}
+
+var TooManyIdempotencyKeys = errors.New("too many idempotency keys")
+
+var idempotencyKeys = idempotencyStore{outcomes: make(map[string]*idempotentOutcome)}
+
+// idempotencyKeyTTL returns the time for which the outcome of the request with the given context is stored, if it
+// carries an idempotency key
+func idempotencyKeyTTL(ctx context.Context) time.Duration {
+	seconds := configurationOf(ctx).IdempotencyKeyTTLSeconds
+	if seconds <= 0 {
+		seconds = defaultIdempotencyKeyTTLSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// begin reserves the given key for a request in progress, whose body has the given digest. If the key is already
+// reserved, its outcome is returned instead, with done false if the request is still in progress. The expired outcomes
+// are removed once per purge interval. TooManyIdempotencyKeys is returned if the key cannot be reserved because the
+// store is full.
+func (store *idempotencyStore) begin(key string, bodyHash string) (idempotentOutcome, bool, error) {
+	store.Lock()
+	defer store.Unlock()
+	now := time.Now()
+	if now.Sub(store.lastPurge) > idempotencyKeyPurgeInterval {
+		store.removeExpired(now)
+		store.lastPurge = now
+	}
+	outcome, present := store.outcomes[key]
+	if present && !(outcome.done && now.After(outcome.expiresAt)) {
+		return *outcome, false, nil
+	}
+	if present {
+		store.remove(key)
+	}
+	if len(store.outcomes) >= maxIdempotencyKeys {
+		return idempotentOutcome{}, false, TooManyIdempotencyKeys
+	}
+	store.outcomes[key] = &idempotentOutcome{bodyHash: bodyHash}
+	return idempotentOutcome{}, true, nil
+}
+
+// removeExpired removes the outcomes expired at the given time. It must be called holding the lock of the store.
+func (store *idempotencyStore) removeExpired(now time.Time) {
+	for key, outcome := range store.outcomes {
+		if outcome.done && now.After(outcome.expiresAt) {
+			store.remove(key)
+		}
+	}
+}
+
+// remove removes the outcome of the given key. It must be called holding the lock of the store.
+func (store *idempotencyStore) remove(key string) {
+	if outcome, present := store.outcomes[key]; present {
+		store.size -= len(outcome.body)
+		delete(store.outcomes, key)
+	}
+}
+
+// complete stores the outcome of the request with the given key for the given time. The key is released instead if
+// the total size of the responses stored would exceed the maximum.
+func (store *idempotencyStore) complete(key string, status int, header http.Header, body []byte, ttl time.Duration) {
+	store.Lock()
+	defer store.Unlock()
+	outcome, present := store.outcomes[key]
+	if !present {
+		return
+	}
+	if store.size+len(body) > maxIdempotentResponsesSize {
+		log.Println("Too many responses stored for the idempotency keys - outcome not stored")
+		store.remove(key)
+		return
+	}
+	store.size += len(body)
+	outcome.done = true
+	outcome.status = status
+	outcome.header = header
+	outcome.body = body
+	outcome.expiresAt = time.Now().Add(ttl)
+}
+
+// release frees the given key without storing an outcome, so that the request can be executed again
+func (store *idempotencyStore) release(key string) {
+	store.Lock()
+	defer store.Unlock()
+	store.remove(key)
+}
+
+// recordingResponseWriter forwards a response to the client and keeps a copy of it, unless its body is larger than
+// maxIdempotentResponseSize
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.truncated && w.body.Len()+len(data) > maxIdempotentResponseSize {
+		w.truncated = true
+		w.body.Reset()
+	}
+	if !w.truncated {
+		w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush sends the buffered data to the client, so that the streamed responses are not held back
+func (w *recordingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// IdempotencyMiddleware makes the POST and PUT requests carrying an Idempotency-Key header safe to be repeated, e.g.
+// after a timeout. The outcome of the first request is stored and returned to the repetitions with the same key, method
+// and path by the same user, without executing them. A repetition received while the first request is in progress is
+// rejected with 409 Conflict, and one with a different body with 422 Unprocessable Entity. The outcomes with a server
+// error are not stored, so that the request can be attempted again, and neither are the ones exceeding the limits of
+// the store. Only the authenticated requests are considered, so the middleware follows AuthorizationMiddleware.
+func IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+		claims, authenticated := r.Context().Value(claimsContextKey{}).(Claims)
+		if idempotencyKey == "" || !authenticated || (r.Method != http.MethodPost && r.Method != http.MethodPut) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(idempotencyKey) > maxIdempotencyKeyLength {
+			MakeErrorResponse(w, http.StatusBadRequest, "Invalid idempotency key")
+			log.Println("Invalid idempotency key")
+			return
+		}
+
+		// The body is read to be compared with the body of the repetitions, then given back to the handler
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxIdempotentRequestSize+1))
+			if err != nil {
+				MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+				log.Println("Api Gateway - Internal Server Error")
+				return
+			}
+			if len(body) > maxIdempotentRequestSize {
+				MakeErrorResponse(w, http.StatusRequestEntityTooLarge, "Request too large for an idempotency key")
+				log.Println("Request too large for an idempotency key")
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		bodyHash := digest(string(body))
+
+		key := claims.CallerUsername() + " " + r.Method + " " + r.URL.Path + " " + idempotencyKey
+		outcome, reserved, err := idempotencyKeys.begin(key, bodyHash)
+		if err == TooManyIdempotencyKeys {
+			log.Println("Too many idempotency keys - outcome of " + r.Method + " " + r.URL.Path + " not stored")
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !reserved && outcome.bodyHash != bodyHash {
+			MakeErrorResponse(w, http.StatusUnprocessableEntity, "Idempotency key reused with a different request body")
+			log.Println("Idempotency key reused with a different request body")
+			return
+		}
+		if !reserved && !outcome.done {
+			MakeErrorResponse(w, http.StatusConflict, "Request with the same idempotency key in progress")
+			log.Println("Request with the same idempotency key in progress")
+			return
+		}
+		if !reserved {
+			// The stored outcome is returned to the client, as if the request were executed again
+			for name, values := range outcome.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(outcome.status)
+			_, _ = w.Write(outcome.body)
+			log.Println("Outcome of " + r.Method + " " + r.URL.Path + " replayed to " + claims.CallerUsername())
+			return
+		}
+
+		recorder := &recordingResponseWriter{ResponseWriter: w}
+		completed := false
+		// The key is released even if the handler panics, otherwise the repetitions would be rejected until the restart
+		defer func() {
+			if !completed {
+				idempotencyKeys.release(key)
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		if recorder.status >= http.StatusInternalServerError || recorder.truncated {
+			if recorder.truncated {
+				log.Println("Outcome of " + r.Method + " " + r.URL.Path + " not stored: response larger than " +
+					strconv.Itoa(maxIdempotentResponseSize) + " bytes")
+			}
+			return
+		}
+		header := make(http.Header)
+		for _, name := range idempotentResponseHeaders {
+			if values, present := recorder.Header()[name]; present {
+				header[name] = values
+			}
+		}
+		idempotencyKeys.complete(key, recorder.status, header, recorder.body.Bytes(), idempotencyKeyTTL(r.Context()))
+		completed = true
+	})
+}
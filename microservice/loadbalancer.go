@@ -0,0 +1,309 @@
+package microservice
+
+import (
+	"context"
+	"errors"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Strategies used to choose the instance of a micro-service a request is sent to
+const (
+	roundRobinBalancing       = "round-robin"
+	leastOutstandingBalancing = "least-outstanding"
+	consistentHashBalancing   = "consistent-hash"
+)
+
+// Default settings of the load balancers
+const (
+	defaultEjectionFailures      = 3
+	defaultEjectionProbeInterval = 5 * time.Second
+)
+
+// Number of points of each instance on the ring of the consistent hash
+const consistentHashReplicas = 100
+
+var NoHealthyInstance = errors.New("no healthy instance")
+
+// upstreamInstance is an instance of a micro-service, with the requests it is serving, its recent failures and the
+// outcome of the recent health checks. An instance that fails too many requests in a row is ejected, and an instance
+// that fails too many health checks in a row is unhealthy: in both cases no request is sent to it until a probe succeeds.
+type upstreamInstance struct {
+	address             string
+	balancer            *loadBalancer
+	outstanding         int
+	consecutiveFailures int
+	ejected             bool
+	ejectedAt           time.Time
+	removed             bool
+	unhealthy           bool
+	probeSuccesses      int
+	probeFailures       int
+	lastCheck           time.Time
+	lastCheckError      string
+}
+
+// hashPoint is a point of the ring of the consistent hash, owned by an instance
+type hashPoint struct {
+	hash     uint32
+	instance *upstreamInstance
+}
+
+// loadBalancer spreads the requests to a micro-service across its instances according to the configured strategy
+type loadBalancer struct {
+	sync.Mutex
+	name               string
+	strategy           string
+	instances          []*upstreamInstance
+	ring               []hashPoint
+	next               int
+	ejectionFailures   int
+	probeInterval      time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+	stop               chan struct{}
+}
+
+// loadBalancerRegistry contains the load balancer of each micro-service, indexed by name
+type loadBalancerRegistry struct {
+	sync.Mutex
+	balancers map[string]*loadBalancer
+}
+
+var loadBalancers = loadBalancerRegistry{balancers: make(map[string]*loadBalancer)}
+
+// hashString returns the hash of the given string, used to place the instances and the keys on the ring
+func hashString(value string) uint32 {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(value))
+	return hash.Sum32()
+}
+
+// newLoadBalancer creates the load balancer of the given micro-service, configured according to the given settings
+func newLoadBalancer(name string, settings config.UpstreamConfig) *loadBalancer {
+	balancer := &loadBalancer{
+		name:               name,
+		strategy:           settings.Balancer,
+		ejectionFailures:   settings.EjectionFailures,
+		probeInterval:      durationSetting(settings.EjectionProbeIntervalMs, defaultEjectionProbeInterval),
+		healthyThreshold:   settings.HealthyThreshold,
+		unhealthyThreshold: settings.UnhealthyThreshold,
+		stop:               make(chan struct{}),
+	}
+	switch balancer.strategy {
+	case roundRobinBalancing, leastOutstandingBalancing, consistentHashBalancing:
+	default:
+		if balancer.strategy != "" {
+			log.Println("Unknown balancing strategy " + balancer.strategy + " for " + name + ", using " + roundRobinBalancing)
+		}
+		balancer.strategy = roundRobinBalancing
+	}
+	if balancer.ejectionFailures <= 0 {
+		balancer.ejectionFailures = defaultEjectionFailures
+	}
+	if balancer.healthyThreshold <= 0 {
+		balancer.healthyThreshold = defaultHealthyThreshold
+	}
+	if balancer.unhealthyThreshold <= 0 {
+		balancer.unhealthyThreshold = defaultUnhealthyThreshold
+	}
+	return balancer
+}
+
+// loadBalancerOf returns the load balancer of the given micro-service, balancing across its current instances
+func loadBalancerOf(name string) *loadBalancer {
+	loadBalancers.Lock()
+	defer loadBalancers.Unlock()
+	balancer, present := loadBalancers.balancers[name]
+	if !present {
+		balancer = newLoadBalancer(name, config.Get().Upstreams[name])
+		loadBalancers.balancers[name] = balancer
+	}
+	balancer.setInstances(upstreamInstances(name))
+	return balancer
+}
+
+// setInstances makes the balancer spread the requests across the instances with the given addresses. The instances
+// already known keep their state, so that an ejected instance stays ejected.
+func (balancer *loadBalancer) setInstances(addresses []string) {
+	balancer.Lock()
+	defer balancer.Unlock()
+	if len(addresses) == len(balancer.instances) {
+		changed := false
+		for i, address := range addresses {
+			changed = changed || balancer.instances[i].address != address
+		}
+		if !changed {
+			return
+		}
+	}
+	known := make(map[string]*upstreamInstance)
+	for _, instance := range balancer.instances {
+		known[instance.address] = instance
+		instance.removed = true
+	}
+	balancer.instances = nil
+	balancer.ring = nil
+	for _, address := range addresses {
+		instance, present := known[address]
+		if !present {
+			instance = &upstreamInstance{address: address, balancer: balancer}
+		}
+		instance.removed = false
+		balancer.instances = append(balancer.instances, instance)
+		for i := 0; i < consistentHashReplicas; i++ {
+			balancer.ring = append(balancer.ring, hashPoint{hashString(address + "#" + strconv.Itoa(i)), instance})
+		}
+	}
+	sort.Slice(balancer.ring, func(i, j int) bool { return balancer.ring[i].hash < balancer.ring[j].hash })
+	balancer.next = 0
+}
+
+// ResetLoadBalancers discards the load balancers of the micro-services, stopping the probes of the ejected instances,
+// so that the next requests are balanced across the instances of the current configuration
+func ResetLoadBalancers() {
+	loadBalancers.Lock()
+	defer loadBalancers.Unlock()
+	for name, balancer := range loadBalancers.balancers {
+		close(balancer.stop)
+		delete(loadBalancers.balancers, name)
+	}
+}
+
+// balancingKey returns the key used by the consistent hash for the request the given context belongs to, that is the
+// username of the caller. The requests of the same user are sent to the same instance as long as it is not ejected.
+func balancingKey(ctx context.Context) string {
+	claims, ok := ctx.Value(claimsContextKey{}).(Claims)
+	if !ok {
+		return ""
+	}
+	return claims.CallerUsername()
+}
+
+// pick chooses the instance the request with the given context is sent to, among the ones not ejected. The requests
+// without a key are balanced in round-robin even when the consistent hash is configured.
+func (balancer *loadBalancer) pick(ctx context.Context) (*upstreamInstance, error) {
+	balancer.Lock()
+	defer balancer.Unlock()
+	if len(balancer.instances) == 0 {
+		return nil, UnknownUpstream
+	}
+	switch balancer.strategy {
+	case leastOutstandingBalancing:
+		var chosen *upstreamInstance
+		for i := range balancer.instances {
+			// the search starts from a different instance every time, so that the ties are broken in round-robin
+			instance := balancer.instances[(balancer.next+i)%len(balancer.instances)]
+			if instance.available() && (chosen == nil || instance.outstanding < chosen.outstanding) {
+				chosen = instance
+			}
+		}
+		balancer.next = (balancer.next + 1) % len(balancer.instances)
+		if chosen != nil {
+			return chosen, nil
+		}
+		return nil, NoHealthyInstance
+	case consistentHashBalancing:
+		key := balancingKey(ctx)
+		if key != "" {
+			hash := hashString(key)
+			start := sort.Search(len(balancer.ring), func(i int) bool { return balancer.ring[i].hash >= hash })
+			for i := range balancer.ring {
+				point := balancer.ring[(start+i)%len(balancer.ring)]
+				if point.instance.available() {
+					return point.instance, nil
+				}
+			}
+			return nil, NoHealthyInstance
+		}
+	}
+	for range balancer.instances {
+		instance := balancer.instances[balancer.next]
+		balancer.next = (balancer.next + 1) % len(balancer.instances)
+		if instance.available() {
+			return instance, nil
+		}
+	}
+	return nil, NoHealthyInstance
+}
+
+// available returns true if requests can be sent to the instance. The caller must hold the lock of the balancer.
+func (instance *upstreamInstance) available() bool {
+	return !instance.ejected && !instance.unhealthy
+}
+
+// acquire counts a request sent to the instance
+func (instance *upstreamInstance) acquire() {
+	instance.balancer.Lock()
+	defer instance.balancer.Unlock()
+	instance.outstanding++
+}
+
+// release counts the end of a request sent to the instance. The failed requests are counted too, and the instance is
+// ejected when they are too many in a row; counted is false when the outcome says nothing about the health of the
+// instance, e.g. because the client disconnected.
+func (instance *upstreamInstance) release(counted bool, success bool) {
+	balancer := instance.balancer
+	balancer.Lock()
+	defer balancer.Unlock()
+	instance.outstanding--
+	if !counted || instance.ejected {
+		return
+	}
+	if success {
+		instance.consecutiveFailures = 0
+		return
+	}
+	instance.consecutiveFailures++
+	if instance.consecutiveFailures >= balancer.ejectionFailures {
+		instance.ejected = true
+		instance.ejectedAt = time.Now()
+		log.Println("Instance " + instance.address + " of " + balancer.name + " ejected after " +
+			strconv.Itoa(instance.consecutiveFailures) + " failures")
+		go balancer.probe(instance)
+	}
+}
+
+// probe checks periodically the health of the given ejected instance, until a probe succeeds and the instance is
+// admitted again, or the instance is removed or the load balancer is discarded
+func (balancer *loadBalancer) probe(instance *upstreamInstance) {
+	ticker := time.NewTicker(balancer.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-balancer.stop:
+			return
+		case <-ticker.C:
+			balancer.Lock()
+			removed := instance.removed
+			balancer.Unlock()
+			if removed {
+				return
+			}
+			if probeUpstream(balancer.name, instance.address).Healthy {
+				balancer.Lock()
+				instance.ejected = false
+				instance.consecutiveFailures = 0
+				balancer.Unlock()
+				log.Println("Instance " + instance.address + " of " + balancer.name + " admitted again")
+				return
+			}
+		}
+	}
+}
+
+// instanceStatuses returns the state of the instances, indexed by address
+func (balancer *loadBalancer) instanceStatuses() map[string]upstreamInstance {
+	balancer.Lock()
+	defer balancer.Unlock()
+	statuses := make(map[string]upstreamInstance)
+	for _, instance := range balancer.instances {
+		statuses[instance.address] = *instance
+	}
+	return statuses
+}
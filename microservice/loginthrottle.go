@@ -0,0 +1,352 @@
+package microservice
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default thresholds of the login brute-force protection
+const (
+	defaultMaxFailuresPerUser   = 5
+	defaultMaxFailuresPerIP     = 20
+	defaultFailureWindowMinutes = 15
+	defaultLockoutSeconds       = 30
+	defaultMaxLockoutMinutes    = 60
+)
+
+// Interval between two removals of the expired failure counters, made while recording the login attempts
+const failureCounterPurgeInterval = time.Minute
+
+// Time a client has to wait before trying again when the attempts being verified would lock out the username or the
+// address if they failed
+const pendingAttemptsRetryAfter = time.Second
+
+// Maximum number of failure counters. When it is reached the usernames without a counter are no longer tracked, so that
+// a client trying many usernames cannot exhaust the memory; their attempts still count for the client address.
+const maxFailureCounters = 100000
+
+// failureCounter keeps track of the failed login attempts of an username or of a client address. When the failures in
+// the window reach the threshold, the username or the address is locked out. The duration of each lockout doubles the
+// duration of the previous one, up to the maximum configured. The attempts whose credentials are being verified are
+// counted apart, and become failures only if the credentials turn out to be wrong.
+type failureCounter struct {
+	Failures     int       `json:"failures"`
+	FirstFailure time.Time `json:"firstFailure"`
+	LastFailure  time.Time `json:"lastFailure"`
+	Lockouts     int       `json:"lockouts"`
+	LockedUntil  time.Time `json:"lockedUntil"`
+	pending      int
+}
+
+// loginThrottle contains the failure counters indexed by "user:<username>" and "ip:<address>"
+type loginThrottle struct {
+	sync.Mutex
+	counters  map[string]*failureCounter
+	lastPurge time.Time
+}
+
+var loginAttempts = loginThrottle{counters: make(map[string]*failureCounter)}
+
+// Lockout encapsulates an username or a client address currently locked out, as returned to the administrators
+type Lockout struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	Lockouts    int       `json:"lockouts"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// throttleSetting returns the given configured value, or the default one if the value is not configured
+func throttleSetting(value int, defaultValue int) int {
+	if value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+// failureWindow returns the time after which the failures of an username or of an address are forgotten
+func failureWindow() time.Duration {
+	minutes := throttleSetting(config.Get().LoginThrottle.FailureWindowMinutes, defaultFailureWindowMinutes)
+	return time.Duration(minutes) * time.Minute
+}
+
+// lockoutDuration returns the duration of the n-th lockout (starting from 0) of an username or of an address
+func lockoutDuration(n int) time.Duration {
+	base := time.Duration(throttleSetting(config.Get().LoginThrottle.LockoutSeconds, defaultLockoutSeconds)) *
+		time.Second
+	maximum := time.Duration(throttleSetting(config.Get().LoginThrottle.MaxLockoutMinutes,
+		defaultMaxLockoutMinutes)) * time.Minute
+	duration := time.Duration(float64(base) * math.Pow(2, float64(n)))
+	if duration > maximum || duration <= 0 {
+		return maximum
+	}
+	return duration
+}
+
+// thresholds returns the failures after which the given username and the given address are locked out, indexed by
+// the key of their failure counters
+func thresholds(username string, address string) map[string]int {
+	return map[string]int{
+		"user:" + username: throttleSetting(config.Get().LoginThrottle.MaxFailuresPerUser, defaultMaxFailuresPerUser),
+		"ip:" + address:    throttleSetting(config.Get().LoginThrottle.MaxFailuresPerIP, defaultMaxFailuresPerIP),
+	}
+}
+
+// counter returns the failure counter of the given key, discarding it if its failures are older than the window, it
+// is not locked out and no attempt is being verified. The caller must hold the lock.
+func (throttle *loginThrottle) counter(key string, now time.Time) *failureCounter {
+	counter, present := throttle.counters[key]
+	if present && now.After(counter.LockedUntil) && now.Sub(counter.LastFailure) > failureWindow() &&
+		counter.pending == 0 {
+		delete(throttle.counters, key)
+		present = false
+	}
+	if !present {
+		return nil
+	}
+	return counter
+}
+
+// retryAfter returns the time the client has to wait before trying again if the given username or the given address
+// is locked out, otherwise it returns zero. The caller must hold the lock.
+func (throttle *loginThrottle) retryAfter(username string, address string, now time.Time) time.Duration {
+	var wait time.Duration
+	for _, key := range []string{"user:" + username, "ip:" + address} {
+		counter := throttle.counter(key, now)
+		if counter != nil && counter.LockedUntil.After(now) && counter.LockedUntil.Sub(now) > wait {
+			wait = counter.LockedUntil.Sub(now)
+		}
+	}
+	return wait
+}
+
+// attempt checks if the given username or the given address is locked out, or would be locked out if the attempts
+// being verified failed. In this case it returns the time the client has to wait before trying again. Otherwise the
+// attempt is counted as being verified, so that concurrent attempts cannot pass the check before the outcome of the
+// previous ones is known, and it returns zero. The outcome of the attempt is then reported through recordFailure,
+// recordSuccess or cancel.
+func (throttle *loginThrottle) attempt(username string, address string) time.Duration {
+	throttle.Lock()
+	defer throttle.Unlock()
+	now := time.Now()
+	if now.Sub(throttle.lastPurge) > failureCounterPurgeInterval {
+		throttle.removeExpiredCounters(now)
+		throttle.lastPurge = now
+	}
+	wait := throttle.retryAfter(username, address, now)
+	if wait > 0 {
+		return wait
+	}
+	limits := thresholds(username, address)
+	for key, threshold := range limits {
+		counter := throttle.counter(key, now)
+		if counter != nil && counter.recentFailures(now)+counter.pending >= threshold {
+			return pendingAttemptsRetryAfter
+		}
+	}
+	for key := range limits {
+		counter := throttle.trackedCounter(key, now)
+		if counter != nil {
+			counter.pending++
+		}
+	}
+	return 0
+}
+
+// recentFailures returns the failures of the counter in the window
+func (counter *failureCounter) recentFailures(now time.Time) int {
+	if now.Sub(counter.LastFailure) > failureWindow() {
+		return 0
+	}
+	return counter.Failures
+}
+
+// trackedCounter returns the failure counter of the given key, creating it if needed. It returns nil if the key is
+// not tracked because there are too many counters. The caller must hold the lock.
+func (throttle *loginThrottle) trackedCounter(key string, now time.Time) *failureCounter {
+	counter := throttle.counter(key, now)
+	if counter == nil {
+		if len(throttle.counters) >= maxFailureCounters {
+			log.Println("Too many failure counters - login attempt of " + key + " not tracked")
+			return nil
+		}
+		counter = &failureCounter{FirstFailure: now}
+		throttle.counters[key] = counter
+	}
+	return counter
+}
+
+// recordFailure registers a failed login attempt for the given username from the given address, whose wrong
+// credentials have been verified, locking them out if the threshold has been reached
+func (throttle *loginThrottle) recordFailure(username string, address string) {
+	throttle.Lock()
+	defer throttle.Unlock()
+	now := time.Now()
+	for key, threshold := range thresholds(username, address) {
+		throttle.release(key)
+		counter := throttle.trackedCounter(key, now)
+		if counter == nil {
+			continue
+		}
+		if now.Sub(counter.LastFailure) > failureWindow() {
+			// The failures preceding the last lockout are out of the window
+			counter.Failures = 0
+			counter.FirstFailure = now
+		}
+		counter.Failures++
+		counter.LastFailure = now
+		if counter.Failures >= threshold {
+			counter.LockedUntil = now.Add(lockoutDuration(counter.Lockouts))
+			counter.Lockouts++
+			counter.Failures = 0
+			auditLog("login_lockout", map[string]string{
+				"key":         key,
+				"username":    username,
+				"ip":          address,
+				"lockouts":    strconv.Itoa(counter.Lockouts),
+				"lockedUntil": counter.LockedUntil.UTC().Format(time.RFC3339),
+			})
+		}
+	}
+}
+
+// release stops counting an attempt of the given key as being verified, if it is still counted. The caller must hold
+// the lock.
+func (throttle *loginThrottle) release(key string) {
+	counter, present := throttle.counters[key]
+	if present && counter.pending > 0 {
+		counter.pending--
+	}
+}
+
+// cancel stops counting as being verified an attempt of the given username from the given address whose credentials
+// could not be verified, e.g. because user management is unavailable
+func (throttle *loginThrottle) cancel(username string, address string) {
+	throttle.Lock()
+	defer throttle.Unlock()
+	throttle.release("user:" + username)
+	throttle.release("ip:" + address)
+}
+
+// recordSuccess forgets the failed login attempts of the given username after a successful login. The previous failures
+// of the address are kept, because many usernames may be tried from the same address; only the attempt is no longer
+// counted as being verified.
+func (throttle *loginThrottle) recordSuccess(username string, address string) {
+	throttle.Lock()
+	defer throttle.Unlock()
+	delete(throttle.counters, "user:"+username)
+	throttle.release("ip:" + address)
+}
+
+// lockouts returns the usernames and the addresses currently locked out, sorted by key
+func (throttle *loginThrottle) lockouts() []Lockout {
+	throttle.Lock()
+	defer throttle.Unlock()
+	now := time.Now()
+	lockouts := []Lockout{}
+	for key := range throttle.counters {
+		counter := throttle.counter(key, now)
+		if counter != nil && counter.LockedUntil.After(now) {
+			lockouts = append(lockouts, Lockout{key, counter.Failures, counter.Lockouts, counter.LockedUntil})
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].Key < lockouts[j].Key })
+	return lockouts
+}
+
+// clear removes the failure counter of the given key. If key is empty all the counters are removed. It returns false
+// if there was no counter to remove.
+func (throttle *loginThrottle) clear(key string) bool {
+	throttle.Lock()
+	defer throttle.Unlock()
+	if key == "" {
+		throttle.counters = make(map[string]*failureCounter)
+		return true
+	}
+	_, present := throttle.counters[key]
+	delete(throttle.counters, key)
+	return present
+}
+
+// removeExpired removes the failure counters that are out of the window and not locked out. It returns the number of
+// counters removed.
+func (throttle *loginThrottle) removeExpired() int {
+	throttle.Lock()
+	defer throttle.Unlock()
+	return throttle.removeExpiredCounters(time.Now())
+}
+
+// removeExpiredCounters removes the failure counters that are out of the window and not locked out. It returns the
+// number of counters removed. The caller must hold the lock.
+func (throttle *loginThrottle) removeExpiredCounters(now time.Time) int {
+	removed := 0
+	for key := range throttle.counters {
+		if throttle.counter(key, now) == nil {
+			removed++
+		}
+	}
+	return removed
+}
+
+// makeTooManyRequestsResponse generates the response for a client that is locked out, specifying after how many
+// seconds it can try again
+func makeTooManyRequestsResponse(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	MakeErrorResponse(w, http.StatusTooManyRequests, "Too many failed login attempts - Retry after "+
+		strconv.Itoa(seconds)+" seconds")
+}
+
+// ListLockouts returns to an administrator the usernames and the client addresses currently locked out because of too
+// many failed login attempts
+func ListLockouts(w http.ResponseWriter, r *http.Request) {
+
+	/* For authentication purpose the access token is read from the request and validated */
+	_, err := AuthenticateRequest(w, r)
+	if err != nil {
+		return
+	}
+
+	responseBody, err := json.Marshal(loginAttempts.lockouts())
+	if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+		log.Println("Api Gateway - Internal Server Error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(responseBody)
+}
+
+// ClearLockouts allows an administrator to unlock an username (URL /lockouts/users/{username}), a client address (URL
+// /lockouts/ips/{ip}) or everyone (URL /lockouts), forgetting their failed login attempts
+func ClearLockouts(w http.ResponseWriter, r *http.Request) {
+
+	/* For authentication purpose the access token is read from the request and validated */
+	decodedToken, err := AuthenticateRequest(w, r)
+	if err != nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+	key := ""
+	if username, present := vars["username"]; present {
+		key = "user:" + username
+	} else if address, present := vars["ip"]; present {
+		key = "ip:" + address
+	}
+	if !loginAttempts.clear(key) {
+		MakeErrorResponse(w, http.StatusNotFound, "Lockout not found")
+		log.Println("Lockout not found")
+		return
+	}
+	auditLog("lockout_cleared", map[string]string{"key": key, "admin": decodedToken.Subject})
+	w.WriteHeader(http.StatusNoContent)
+}
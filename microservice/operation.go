@@ -0,0 +1,233 @@
+package microservice
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default time for which a finished operation can be queried
+const defaultOperationRetentionSeconds = 3600
+
+// Path under which the state of an asynchronous operation is published
+const operationsPath = "/didattica-mobile/api/v1.0/operations/"
+
+// States of an asynchronous operation and of its steps. A pending step is waiting for the micro-service; a step is
+// compensating from the failure of the operation until its compensation succeeds, possibly from the compensation
+// queue. The steps following a failed one in a sequential saga are skipped.
+const (
+	operationPending      = "pending"
+	operationCommitted    = "committed"
+	operationCompensating = "compensating"
+	operationCompensated  = "compensated"
+	operationFailed       = "failed"
+	operationSkipped      = "skipped"
+)
+
+// OperationStep is the state of a step of an asynchronous operation
+type OperationStep struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// OperationResponse is the response that the client would have received from a synchronous execution of the operation
+type OperationResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// Operation is an execution of a saga requested in asynchronous mode, as returned to the client that requested it.
+// The response is set when the operation is committed or failed.
+type Operation struct {
+	Id       string             `json:"id"`
+	Saga     string             `json:"saga"`
+	Status   string             `json:"status"`
+	Steps    []OperationStep    `json:"steps"`
+	Response *OperationResponse `json:"response,omitempty"`
+	owner    string
+	finished time.Time
+}
+
+// operationRegistry contains the asynchronous operations, indexed by id. They are kept in memory only: after a restart
+// the interrupted executions are recovered from the saga log, but they cannot be queried any more.
+type operationRegistry struct {
+	sync.Mutex
+	operations map[string]*Operation
+}
+
+var operations = operationRegistry{operations: make(map[string]*Operation)}
+
+// operationRetention returns the time for which a finished operation can be queried
+func operationRetention() time.Duration {
+	seconds := config.Get().OperationRetentionSeconds
+	if seconds <= 0 {
+		seconds = defaultOperationRetentionSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// detachedContext carries the values of a request without being cancelled with it, so that a saga goes on after the
+// client disconnects or, in asynchronous mode, after the response is sent to the client
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// respondAsync returns true if the client asked for the asynchronous execution of the request, through the
+// Prefer: respond-async header
+func respondAsync(r *http.Request) bool {
+	for _, header := range r.Header["Prefer"] {
+		for _, preference := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// register adds a pending operation for the execution with the given id of the saga, on behalf of the given user, and
+// returns a copy of it. The finished operations whose retention has expired are removed.
+func (registry *operationRegistry) register(id string, saga *Saga, owner string) Operation {
+	operation := &Operation{Id: id, Saga: saga.Name, Status: operationPending, owner: owner}
+	for _, step := range saga.Steps {
+		operation.Steps = append(operation.Steps, OperationStep{Name: step.Name, Status: operationPending})
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	now := time.Now()
+	for id, operation := range registry.operations {
+		if !operation.finished.IsZero() && now.Sub(operation.finished) > operationRetention() {
+			delete(registry.operations, id)
+		}
+	}
+	registry.operations[id] = operation
+	return operation.copy()
+}
+
+// apply updates the state of the steps of the operation with the given id, if any, with the given event of the saga
+// log. As soon as a step fails the operation is compensating, and so are its completed steps.
+func (registry *operationRegistry) apply(record sagaLogRecord) {
+	registry.Lock()
+	defer registry.Unlock()
+	operation, present := registry.operations[record.Id]
+	if !present {
+		return
+	}
+	if record.Event == stepFailed {
+		operation.Status = operationCompensating
+		for i := range operation.Steps {
+			if operation.Steps[i].Status == operationCommitted {
+				operation.Steps[i].Status = operationCompensating
+			}
+		}
+	}
+	for i := range operation.Steps {
+		if operation.Steps[i].Name != record.Step {
+			continue
+		}
+		switch record.Event {
+		case stepCompleted:
+			operation.Steps[i].Status = operationCommitted
+			if operation.Status == operationCompensating {
+				operation.Steps[i].Status = operationCompensating
+			}
+		case stepFailed:
+			operation.Steps[i].Status = operationFailed
+		case stepCompensated:
+			operation.Steps[i].Status = operationCompensated
+		}
+	}
+}
+
+// finish records the response of the operation with the given id, that is committed if the response is successful
+// and failed otherwise
+func (registry *operationRegistry) finish(id string, status int, body []byte) {
+	registry.Lock()
+	defer registry.Unlock()
+	operation, present := registry.operations[id]
+	if !present {
+		return
+	}
+	operation.Status = operationCommitted
+	if status >= http.StatusBadRequest {
+		operation.Status = operationFailed
+		for i := range operation.Steps {
+			if operation.Steps[i].Status == operationPending {
+				operation.Steps[i].Status = operationSkipped
+			}
+		}
+	}
+	operation.Response = &OperationResponse{Status: status}
+	if json.Valid(body) {
+		operation.Response.Body = body
+	} else if len(body) > 0 {
+		operation.Response.Body, _ = json.Marshal(string(body))
+	}
+	operation.finished = time.Now()
+}
+
+// get returns a copy of the operation with the given id, if it has been requested by the given user and its retention
+// has not expired
+func (registry *operationRegistry) get(id string, owner string) (Operation, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	operation, present := registry.operations[id]
+	if !present || operation.owner != owner {
+		return Operation{}, false
+	}
+	if !operation.finished.IsZero() && time.Since(operation.finished) > operationRetention() {
+		delete(registry.operations, id)
+		return Operation{}, false
+	}
+	return operation.copy(), true
+}
+
+// copy returns a copy of the operation that does not share its steps
+func (operation *Operation) copy() Operation {
+	copied := *operation
+	copied.Steps = append([]OperationStep(nil), operation.Steps...)
+	return copied
+}
+
+// executeSagaAsync starts the execution with the given id of the saga in background and responds to the client with
+// 202 Accepted and the pending operation, whose state can be queried at the URL given in the Location header
+func executeSagaAsync(w http.ResponseWriter, r *http.Request, saga *Saga, id string, parameters SagaParameters, owner string) {
+	operation := operations.register(id, saga, owner)
+	ctx := detachedContext{r.Context()}
+	go func() {
+		outcomes := saga.run(ctx, id, parameters)
+		status, body := saga.response(id, outcomes)
+		operations.finish(id, status, body)
+	}()
+	w.Header().Set("Location", operationsPath+id)
+	w.Header().Set("Preference-Applied", "respond-async")
+	writeJSONResponse(w, http.StatusAccepted, operation)
+}
+
+// GetOperation returns to the client the state of the asynchronous operation specified in the URL, that it requested
+func GetOperation(w http.ResponseWriter, r *http.Request) {
+
+	/* For authentication purpose the access token is read from the request and validated */
+	decodedToken, err := AuthenticateRequest(w, r)
+	if err != nil {
+		return
+	}
+
+	operation, present := operations.get(mux.Vars(r)["id"], decodedToken.CallerUsername())
+	if !present {
+		MakeErrorResponse(w, http.StatusNotFound, "Operation not found")
+		log.Println("Operation not found")
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, operation)
+}
@@ -0,0 +1,140 @@
+package microservice
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest body of an idempotent request that is kept in memory to be sent again if the request is repeated. The
+// larger bodies are streamed to the micro-service, and the request is sent once.
+const maxReplayableBodySize = 1 << 20
+
+// Interval at which the response of a micro-service is flushed to the client while it is streamed
+const proxyFlushInterval = 100 * time.Millisecond
+
+// Headers of the client forwarded to the micro-services. The others, e.g. the access token, are not forwarded.
+var forwardedRequestHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Content-Encoding",
+	"Content-Type",
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Range",
+	"If-Unmodified-Since",
+	"Range",
+	"User-Agent",
+	idempotencyKeyHeader,
+}
+
+// upstreamTransport sends the requests proxied to a micro-service to one of its instances, chosen by the load
+// balancer, through the circuit breaker and according to the retry policy of the route
+type upstreamTransport struct {
+	name string
+}
+
+// forwardedHeader returns the headers of the client that are forwarded to the micro-services, except for the ones the
+// client declared as hop-by-hop in the Connection header
+func forwardedHeader(header http.Header) http.Header {
+	hopByHop := make(map[string]bool)
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			hopByHop[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	forwarded := make(http.Header)
+	for _, name := range forwardedRequestHeaders {
+		values, present := header[name]
+		if present && !hopByHop[name] {
+			forwarded[name] = values
+		}
+	}
+	return forwarded
+}
+
+// RoundTrip sends the given request, whose URL path is the one of the micro-service, to an instance of the
+// micro-service. The body of an idempotent request is read in advance if it is small enough, so that the request can
+// be repeated; otherwise the body is streamed and the request is not repeated. The response is streamed, so its
+// transfer is not bounded by the overall timeout of the client.
+func (transport upstreamTransport) RoundTrip(outgoing *http.Request) (*http.Response, error) {
+	ctx := outgoing.Context()
+	body := outgoing.Body
+	var payload []byte
+	replayable := body == nil
+	if body != nil && isRetryableRequest(outgoing.Method, outgoing.Header) &&
+		outgoing.ContentLength >= 0 && outgoing.ContentLength <= maxReplayableBodySize {
+		var err error
+		payload, err = ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		replayable = true
+	}
+	newRequest := func() (*http.Request, *upstreamInstance, error) {
+		instance, err := loadBalancerOf(transport.name).pick(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		var requestBody io.Reader
+		if payload != nil {
+			requestBody = bytes.NewReader(payload)
+		} else if body != nil {
+			requestBody = body
+		}
+		request, err := newInstanceRequest(ctx, instance.address, outgoing.Method, outgoing.URL.Path, requestBody)
+		if err != nil {
+			return nil, nil, err
+		}
+		request.URL.RawQuery = outgoing.URL.RawQuery
+		request.Header = outgoing.Header
+		request.Trailer = outgoing.Trailer
+		if payload == nil && body != nil {
+			request.ContentLength = outgoing.ContentLength
+		}
+		return request, instance, nil
+	}
+	if !replayable {
+		request, instance, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		return sendUpstream(transport.name, instance, request, true)
+	}
+	return sendUpstreamWithRetries(ctx, transport.name, outgoing.Method, outgoing.Header, true, newRequest)
+}
+
+// ProxyToUpstream proxies the request of the client to the given path of the given micro-service, keeping its method,
+// its query string and the forwarded headers, and streams the response of the micro-service back to the client with
+// its headers and trailers. The hop-by-hop headers are stripped in both directions. If the request could not be sent
+// or no response was received, nothing is written to the client and the error is returned.
+func ProxyToUpstream(upstream string, path string, w http.ResponseWriter, r *http.Request) error {
+	var proxyErr error
+	proxy := &httputil.ReverseProxy{
+		Director: func(outgoing *http.Request) {
+			outgoing.URL.Path = path
+			outgoing.URL.RawPath = ""
+			outgoing.Header = forwardedHeader(outgoing.Header)
+		},
+		Transport:     upstreamTransport{name: upstream},
+		FlushInterval: proxyFlushInterval,
+		ModifyResponse: func(resp *http.Response) error {
+			log.Println("Response status Code from Microservice: " + strconv.Itoa(resp.StatusCode))
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			proxyErr = err
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	return proxyErr
+}
@@ -0,0 +1,226 @@
+package microservice
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Name of the cookie carrying the refresh token. The cookie is restricted to the token endpoints so that the refresh
+// token is not sent along with the other requests of the client.
+const refreshTokenCookie = "refreshToken"
+const refreshTokenCookiePath = "/didattica-mobile/api/v1.0/token"
+
+// Lifetime of a refresh token when it is not specified in the configuration
+const defaultRefreshTokenLifetime = 7 * 24 * time.Hour
+
+var InvalidRefreshToken = errors.New("invalid refresh token")
+var ReusedRefreshToken = errors.New("refresh token reuse detected")
+
+// refreshSession encapsulates the information bound to an issued refresh token. All the refresh tokens obtained by
+// rotation from the same login belong to the same family, so that the whole chain can be invalidated when the reuse of
+// a consumed token is detected.
+type refreshSession struct {
+	User      User
+	Family    string
+	ExpiresAt time.Time
+	Used      bool
+}
+
+// refreshTokenStore keeps the issued refresh tokens indexed by their SHA-256 digest, so that the plain tokens are never
+// kept in memory by the api gateway.
+type refreshTokenStore struct {
+	sync.Mutex
+	sessions map[string]*refreshSession
+}
+
+var refreshTokens = refreshTokenStore{sessions: make(map[string]*refreshSession)}
+
+// refreshTokenLifetime returns the configured lifetime of the refresh tokens
+func refreshTokenLifetime() time.Duration {
+	if config.Get().RefreshTokenLifetimeHours > 0 {
+		return time.Duration(config.Get().RefreshTokenLifetimeHours) * time.Hour
+	}
+	return defaultRefreshTokenLifetime
+}
+
+// randomToken returns a random url-safe string built from n random bytes
+func randomToken(n int) (string, error) {
+	buffer := make([]byte, n)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+// digest returns the hex-encoded SHA-256 digest of the given token
+func digest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issue generates a new refresh token for the given user. If family is empty a new family is started.
+func (store *refreshTokenStore) issue(user User, family string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	if family == "" {
+		family, err = randomToken(16)
+		if err != nil {
+			return "", err
+		}
+	}
+	// The password is never kept together with the refresh token
+	user.Password = ""
+	store.Lock()
+	defer store.Unlock()
+	store.removeExpired()
+	store.sessions[digest(token)] = &refreshSession{
+		User:      user,
+		Family:    family,
+		ExpiresAt: time.Now().Add(refreshTokenLifetime()),
+	}
+	return token, nil
+}
+
+// rotate consumes the given refresh token and returns a new one belonging to the same family, together with the user
+// the token was issued to. A token can be consumed only once: if an already consumed token is presented again, the
+// whole family is revoked, because either the legitimate client or an attacker holds a stolen token.
+func (store *refreshTokenStore) rotate(token string) (User, string, error) {
+	store.Lock()
+	session, present := store.sessions[digest(token)]
+	if !present || time.Now().After(session.ExpiresAt) {
+		store.Unlock()
+		return User{}, "", InvalidRefreshToken
+	}
+	if session.Used {
+		store.revokeFamily(session.Family)
+		store.Unlock()
+		return session.User, "", ReusedRefreshToken
+	}
+	session.Used = true
+	store.Unlock()
+
+	newToken, err := store.issue(session.User, session.Family)
+	if err != nil {
+		return User{}, "", err
+	}
+	return session.User, newToken, nil
+}
+
+// revokeFamily removes all the refresh tokens of the given family. The caller must hold the lock.
+func (store *refreshTokenStore) revokeFamily(family string) {
+	for key, session := range store.sessions {
+		if session.Family == family {
+			delete(store.sessions, key)
+		}
+	}
+}
+
+// removeExpired removes the expired refresh tokens. The caller must hold the lock.
+func (store *refreshTokenStore) removeExpired() {
+	now := time.Now()
+	for key, session := range store.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(store.sessions, key)
+		}
+	}
+}
+
+// writeTokenResponse sends to the client the access token and the refresh token. The tokens are written both in the
+// 'Set-Cookie' fields of the HTTP answer and in its JSON body, so that the clients which do not handle cookies can send
+// the access token through the Authorization header.
+func writeTokenResponse(w http.ResponseWriter, accessToken string, refreshToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:  "token",
+		Value: accessToken,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    refreshToken,
+		Path:     refreshTokenCookiePath,
+		MaxAge:   int(refreshTokenLifetime().Seconds()),
+		HttpOnly: true,
+	})
+	responseBody, err := json.Marshal(TokenResponseBody{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenLifetime.Seconds()),
+	})
+	if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+		log.Println("Internal Server Error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// The tokens must not be stored by intermediate caches
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(responseBody)
+}
+
+// getRefreshToken reads the refresh token from the dedicated cookie or, if the cookie is missing, from the JSON body
+// of the request
+func getRefreshToken(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(refreshTokenCookie)
+	if err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	if r.Body == nil {
+		return "", InvalidRefreshToken
+	}
+	var requestBody RefreshRequestBody
+	err = json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil || requestBody.RefreshToken == "" {
+		return "", InvalidRefreshToken
+	}
+	return requestBody.RefreshToken, nil
+}
+
+// RefreshAccessToken exchanges the refresh token provided by the client for a new access token, so that the client
+// does not need to send again its credentials when the access token expires. The presented refresh token is consumed
+// and a new one is returned together with the access token.
+func RefreshAccessToken(w http.ResponseWriter, r *http.Request) {
+
+	refreshToken, err := getRefreshToken(r)
+	if err != nil {
+		MakeErrorResponse(w, http.StatusUnauthorized, "No refresh token provided")
+		log.Println("No refresh token provided")
+		return
+	}
+
+	user, newRefreshToken, err := refreshTokens.rotate(refreshToken)
+	if err == ReusedRefreshToken {
+		// All the tokens of the session have been revoked, so the client has to login again
+		MakeErrorResponse(w, http.StatusUnauthorized, "Refresh token reuse detected - Please, login again")
+		log.Println("Refresh token reuse detected for user " + user.Username)
+		return
+	} else if err == InvalidRefreshToken {
+		MakeErrorResponse(w, http.StatusUnauthorized, "Invalid or expired refresh token")
+		log.Println("Invalid or expired refresh token")
+		return
+	} else if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+		log.Println("Internal Server Error")
+		return
+	}
+
+	accessToken, err := SignAccessToken(user)
+	if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+		log.Println("Internal Server Error")
+		return
+	}
+	writeTokenResponse(w, accessToken, newRefreshToken)
+}
@@ -0,0 +1,249 @@
+package microservice
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Interval between two checks of the modification time of the files the configuration is read from
+const configurationWatchInterval = 5 * time.Second
+
+// Causes of a reload
+const (
+	startupReload    = "startup"
+	signalReload     = "signal"
+	fileChangeReload = "file change"
+)
+
+// ReloadStatus encapsulates the outcome of the reloads of the configuration, as returned to the administrators. The
+// generation counts the configurations put in use since the api gateway started.
+type ReloadStatus struct {
+	Generation  int       `json:"generation"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastCause   string    `json:"lastCause"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	LastFailure time.Time `json:"lastFailure,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// gatewaySnapshot is a configuration put in use by a reload, together with the router and the access policy built
+// from it
+type gatewaySnapshot struct {
+	configuration config.Config
+	policy        *accessPolicy
+	router        *mux.Router
+}
+
+// Key of the request context where the snapshot in use when the request was received is stored
+type snapshotContextKey struct{}
+
+// Gateway serves the requests of the clients through the router built from the configuration in use. When the
+// configuration is reloaded a new snapshot of the configuration, the router and the access policy is swapped atomically
+// with the old one. Every request is served with the snapshot in use when it was received, stored in its context, so
+// that the requests in flight finish with the configuration, the routes, the handlers and the access policy they
+// started with.
+type Gateway struct {
+	sync.Mutex
+	snapshot          atomic.Value
+	readConfiguration func() (config.Config, error)
+	watchedFiles      map[string]time.Time
+	status            ReloadStatus
+}
+
+// NewGateway reads the configuration through the given function and builds the router of the api gateway. The same
+// function is used to read the configuration again at every reload.
+func NewGateway(readConfiguration func() (config.Config, error)) (*Gateway, error) {
+	gateway := &Gateway{readConfiguration: readConfiguration}
+	err := gateway.Reload(startupReload)
+	if err != nil {
+		return nil, err
+	}
+	return gateway, nil
+}
+
+// ServeHTTP serves the given request through the router in use, with the configuration and the access policy in use
+func (gateway *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	snapshot := gateway.snapshot.Load().(*gatewaySnapshot)
+	snapshot.router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), snapshotContextKey{}, snapshot)))
+}
+
+// Router returns the router in use
+func (gateway *Gateway) Router() *mux.Router {
+	return gateway.snapshot.Load().(*gatewaySnapshot).router
+}
+
+// configurationOf returns the configuration in use when the request with the given context was received. The requests
+// not received through a Gateway, e.g. the ones of the tests, use the current configuration.
+func configurationOf(ctx context.Context) config.Config {
+	if snapshot, ok := ctx.Value(snapshotContextKey{}).(*gatewaySnapshot); ok {
+		return snapshot.configuration
+	}
+	return config.Get()
+}
+
+// policyOf returns the access policy in use when the request with the given context was received. The requests not
+// received through a Gateway use the current access policy.
+func policyOf(ctx context.Context) *accessPolicy {
+	if snapshot, ok := ctx.Value(snapshotContextKey{}).(*gatewaySnapshot); ok {
+		return snapshot.policy
+	}
+	return &policy
+}
+
+// newGatewayRouter builds a router that authorizes every request according to the access policy, replays the outcome
+// of the repeated requests with an idempotency key and serves the given routes of the route table
+func newGatewayRouter(routes []RouteDefinition) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(AuthorizationMiddleware)
+	router.Use(IdempotencyMiddleware)
+	registerRouteTable(router, routes)
+	return router
+}
+
+// Reload reads the configuration, the route table and the access policy again and, if they are all valid, puts them
+// in use together. Otherwise the current ones are kept and the error is returned. The given cause is reported in the
+// reload status.
+func (gateway *Gateway) Reload(cause string) error {
+	gateway.Lock()
+	defer gateway.Unlock()
+	gateway.status.LastAttempt = time.Now()
+	gateway.status.LastCause = cause
+	err := gateway.reload()
+	if err != nil {
+		gateway.status.LastFailure = gateway.status.LastAttempt
+		gateway.status.LastError = err.Error()
+		// the files are reloaded again only when they are modified again
+		for file := range gateway.watchedFiles {
+			gateway.watchedFiles[file] = modificationTimes(file)[file]
+		}
+		log.Println("Configuration reload (" + cause + ") failed: " + err.Error())
+		return err
+	}
+	gateway.status.Generation++
+	gateway.status.LastSuccess = gateway.status.LastAttempt
+	gateway.status.LastError = ""
+	log.Println("Configuration reloaded (" + cause + ")")
+	return nil
+}
+
+// reload validates the new configuration and swaps it with the current one. The caller must hold the lock of the
+// gateway.
+func (gateway *Gateway) reload() error {
+	newConfiguration, err := gateway.readConfiguration()
+	if err != nil {
+		return err
+	}
+	routes, err := readRouteTable(newConfiguration)
+	if err != nil {
+		return err
+	}
+	newPolicy, err := readPolicy(newConfiguration.PolicyFile, routes)
+	if err != nil {
+		return err
+	}
+	newDiscovery, interval, err := discoveryOf(newConfiguration)
+	if err != nil {
+		return err
+	}
+	err = newDiscovery.Refresh()
+	if err != nil {
+		return err
+	}
+	snapshot := &gatewaySnapshot{configuration: newConfiguration, policy: newPolicy, router: newGatewayRouter(routes)}
+
+	oldConfiguration := config.Get()
+	// The current configuration and access policy are updated too for the components that do not serve a request,
+	// e.g. the health checks
+	config.Swap(newConfiguration)
+	usePolicy(newPolicy)
+	gateway.snapshot.Store(snapshot)
+	// The clients, the balancers and the breakers of the micro-services are created again according to the new
+	// settings, while the requests in flight keep using the old ones
+	if !reflect.DeepEqual(oldConfiguration.Upstreams, newConfiguration.Upstreams) {
+		ResetUpstreamClients()
+		ResetLoadBalancers()
+		ResetCircuitBreakers()
+	}
+	err = UseDiscovery(newDiscovery, interval)
+	if err != nil {
+		log.Println("Service discovery not updated: " + err.Error())
+	}
+	gateway.watchedFiles = modificationTimes(newConfiguration.ConfigFile, newConfiguration.PolicyFile, newConfiguration.RouteFile)
+	return nil
+}
+
+// modificationTimes returns the modification time of the given files, indexed by name. The files that cannot be read
+// have the zero time.
+func modificationTimes(files ...string) map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			times[file] = time.Time{}
+			continue
+		}
+		times[file] = info.ModTime()
+	}
+	return times
+}
+
+// changedFiles returns true if one of the watched files has been modified since the last reload
+func (gateway *Gateway) changedFiles() bool {
+	gateway.Lock()
+	defer gateway.Unlock()
+	for file, modified := range gateway.watchedFiles {
+		if !modificationTimes(file)[file].Equal(modified) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the configuration when the api gateway receives SIGHUP and when the configuration file, the access
+// policy or the route table are modified. It never returns.
+func (gateway *Gateway) Watch() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	ticker := time.NewTicker(configurationWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-signals:
+			_ = gateway.Reload(signalReload)
+		case <-ticker.C:
+			if gateway.changedFiles() {
+				_ = gateway.Reload(fileChangeReload)
+			}
+		}
+	}
+}
+
+// Status returns the outcome of the reloads
+func (gateway *Gateway) Status() ReloadStatus {
+	gateway.Lock()
+	defer gateway.Unlock()
+	return gateway.status
+}
+
+// GetReloadStatus returns to an administrator the outcome of the last reload of the configuration
+func (gateway *Gateway) GetReloadStatus(w http.ResponseWriter, _ *http.Request) {
+	writeJSONResponse(w, http.StatusOK, gateway.Status())
+}
+
+// ListRoutes lists to an administrator the routes of the router in use
+func (gateway *Gateway) ListRoutes(w http.ResponseWriter, r *http.Request) {
+	ListRoutes(gateway.Router())(w, r)
+}
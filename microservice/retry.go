@@ -0,0 +1,170 @@
+package microservice
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Default retry policy of the requests sent to the micro-services
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = 50 * time.Millisecond
+	defaultRetryMaxBackoff     = 1 * time.Second
+)
+
+// Classes of errors that can be retried
+const (
+	connectionErrorClass = "connection"
+	timeoutErrorClass    = "timeout"
+)
+
+// Key of the retry policy applied to the routes without a policy of their own
+const defaultRetryPolicyKey = "*"
+
+// Header through which the client marks a request as safe to be repeated
+const idempotencyKeyHeader = "Idempotency-Key"
+
+var defaultRetryableStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+var defaultRetryableErrors = []string{connectionErrorClass}
+
+// Metrics of the retries, indexed by micro-service: the requests repeated and the ones that failed after the last attempt
+var upstreamRetries = expvar.NewMap("upstreamRetries")
+var upstreamRetriesExhausted = expvar.NewMap("upstreamRetriesExhausted")
+
+// Key of the request context where the path template of the route serving the request is stored
+type routeContextKey struct{}
+
+// retryPolicy says how many times and how often a request to a micro-service is repeated, and which outcomes are
+// worth a new attempt
+type retryPolicy struct {
+	maxAttempts       int
+	initialBackoff    time.Duration
+	maxBackoff        time.Duration
+	retryableStatuses []int
+	retryableErrors   []string
+}
+
+// retryPolicyOf returns the retry policy of the route whose path template is stored in the given context. The routes
+// without a policy of their own use the default one.
+func retryPolicyOf(ctx context.Context) retryPolicy {
+	route, _ := ctx.Value(routeContextKey{}).(string)
+	retryPolicies := configurationOf(ctx).RetryPolicies
+	settings, present := retryPolicies[route]
+	if !present {
+		settings = retryPolicies[defaultRetryPolicyKey]
+	}
+	policy := retryPolicy{
+		maxAttempts:       settings.MaxAttempts,
+		initialBackoff:    durationSetting(settings.InitialBackoffMs, defaultRetryInitialBackoff),
+		maxBackoff:        durationSetting(settings.MaxBackoffMs, defaultRetryMaxBackoff),
+		retryableStatuses: settings.RetryableStatuses,
+		retryableErrors:   settings.RetryableErrors,
+	}
+	if policy.maxAttempts <= 0 {
+		policy.maxAttempts = defaultRetryMaxAttempts
+	}
+	if policy.retryableStatuses == nil {
+		policy.retryableStatuses = defaultRetryableStatuses
+	}
+	if policy.retryableErrors == nil {
+		policy.retryableErrors = defaultRetryableErrors
+	}
+	return policy
+}
+
+// isRetryableRequest returns true if a request with the given method and headers can be repeated without side effects:
+// the GET, PUT and DELETE requests are idempotent, while the POST requests are only if the client gave them an
+// idempotency key
+func isRetryableRequest(method string, header http.Header) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return header.Get(idempotencyKeyHeader) != ""
+}
+
+// errorClass returns the class of the given error occurred sending a request to a micro-service
+func errorClass(err error) string {
+	if netError, ok := err.(net.Error); ok && netError.Timeout() {
+		return timeoutErrorClass
+	}
+	return connectionErrorClass
+}
+
+// isRetryableOutcome returns true if the given outcome of an attempt is worth a new attempt according to the policy
+func (policy retryPolicy) isRetryableOutcome(resp *http.Response, err error) bool {
+	if err == CircuitOpen {
+		return false
+	}
+	if err != nil {
+		return containsString(policy.retryableErrors, errorClass(err))
+	}
+	for _, statusCode := range policy.retryableStatuses {
+		if resp.StatusCode == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the time to wait before the given attempt, chosen at random up to an exponentially growing limit
+func (policy retryPolicy) backoff(attempt int) time.Duration {
+	limit := policy.initialBackoff
+	for i := 2; i < attempt && limit < policy.maxBackoff; i++ {
+		limit *= 2
+	}
+	if limit > policy.maxBackoff {
+		limit = policy.maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// sendUpstreamWithRetries sends to the given micro-service the requests built by newRequest, each one to the instance
+// chosen for it, repeating them according to the retry policy of the route as long as the outcome is retryable. The
+// requests are not repeated if they are not idempotent or if the given context is canceled. The outcome of the last
+// attempt is returned.
+func sendUpstreamWithRetries(ctx context.Context, name string, method string, header http.Header, streamed bool,
+	newRequest func() (*http.Request, *upstreamInstance, error)) (*http.Response, error) {
+
+	policy := retryPolicyOf(ctx)
+	if !isRetryableRequest(method, header) {
+		policy.maxAttempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		request, instance, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := sendUpstream(name, instance, request, streamed)
+		if attempt >= policy.maxAttempts || ctx.Err() != nil || !policy.isRetryableOutcome(resp, err) {
+			if attempt > 1 && policy.isRetryableOutcome(resp, err) {
+				upstreamRetriesExhausted.Add(name, 1)
+				log.Println("Request to " + name + " failed after " + strconv.Itoa(attempt) + " attempts")
+			}
+			return resp, err
+		}
+		outcome := "error " + errorClass(err)
+		if err == nil {
+			outcome = "status " + strconv.Itoa(resp.StatusCode)
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		wait := policy.backoff(attempt + 1)
+		log.Println("Retrying request to " + name + " after " + outcome + " (attempt " + strconv.Itoa(attempt+1) +
+			" of " + strconv.Itoa(policy.maxAttempts) + ") in " + wait.String())
+		upstreamRetries.Add(name, 1)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
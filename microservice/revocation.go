@@ -0,0 +1,225 @@
+package microservice
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var RevokedToken = errors.New("revoked token")
+
+// revocationStore keeps track of the access tokens that have been revoked before their expiration. Single tokens are
+// identified by their jti claim and are remembered until they expire. When all the tokens of an user are revoked, the
+// revocation time is stored, so that every token issued until that moment is rejected.
+type revocationStore struct {
+	sync.Mutex
+	Tokens map[string]int64 `json:"tokens"` // jti -> expiration time of the token
+	Users  map[string]int64 `json:"users"`  // username -> time of the revocation in nanoseconds
+}
+
+var revocations = revocationStore{Tokens: make(map[string]int64), Users: make(map[string]int64)}
+
+// LoadRevokedTokens reads the revoked tokens from the file specified in the configuration, if any. It is meant to be
+// called at startup, so that a restart of the api gateway does not make the revoked tokens valid again.
+func LoadRevokedTokens() error {
+	if config.Get().RevocationStoreFile == "" {
+		return nil
+	}
+	bytes, err := ioutil.ReadFile(config.Get().RevocationStoreFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	revocations.Lock()
+	defer revocations.Unlock()
+	err = json.Unmarshal(bytes, &revocations)
+	if err != nil {
+		return err
+	}
+	if revocations.Tokens == nil {
+		revocations.Tokens = make(map[string]int64)
+	}
+	if revocations.Users == nil {
+		revocations.Users = make(map[string]int64)
+	}
+	return nil
+}
+
+// persist writes the revoked tokens in the file specified in the configuration, if any. The expired tokens are
+// discarded because they are rejected anyway. The caller must hold the lock.
+func (store *revocationStore) persist() error {
+	now := time.Now().Unix()
+	for jti, expiresAt := range store.Tokens {
+		if expiresAt < now {
+			delete(store.Tokens, jti)
+		}
+	}
+	if config.Get().RevocationStoreFile == "" {
+		return nil
+	}
+	bytes, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+	// The file is replaced atomically, so that a crash during the write does not corrupt it
+	tmpFile := config.Get().RevocationStoreFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, bytes, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, config.Get().RevocationStoreFile)
+}
+
+// revokeToken revokes the token with the given claims until its expiration
+func (store *revocationStore) revokeToken(claims Claims) error {
+	store.Lock()
+	defer store.Unlock()
+	store.Tokens[claims.Id] = claims.ExpiresAt
+	return store.persist()
+}
+
+// revokeUser revokes all the tokens issued to the given user until now
+func (store *revocationStore) revokeUser(username string) error {
+	store.Lock()
+	defer store.Unlock()
+	store.Users[username] = time.Now().UnixNano()
+	return store.persist()
+}
+
+// removeExpired removes the revocations that are no longer needed: the revoked tokens that have expired and the
+// revocations of users older than the lifetime of the access tokens, since the tokens issued before them have expired
+// too. It returns the number of revocations removed.
+func (store *revocationStore) removeExpired() (int, error) {
+	store.Lock()
+	defer store.Unlock()
+	now := time.Now()
+	removed := 0
+	for jti, expiresAt := range store.Tokens {
+		if expiresAt < now.Unix() {
+			delete(store.Tokens, jti)
+			removed++
+		}
+	}
+	for username, revokedAt := range store.Users {
+		if revokedAt < now.Add(-accessTokenLifetime).UnixNano() {
+			delete(store.Users, username)
+			removed++
+		}
+	}
+	return removed, store.persist()
+}
+
+// isRevoked checks if the token with the given claims has been revoked, either singularly or together with all the
+// tokens of its user. The issue time is compared in nanoseconds, so that the tokens issued in the same second after
+// the revocation are valid.
+func (store *revocationStore) isRevoked(claims Claims) bool {
+	store.Lock()
+	defer store.Unlock()
+	if _, present := store.Tokens[claims.Id]; present {
+		return true
+	}
+	revokedAt, present := store.Users[claims.Subject]
+	issuedAt := claims.IssuedAtNano
+	if issuedAt == 0 {
+		// The token does not carry the issue time in nanoseconds, so every token issued in the second of the
+		// revocation is considered revoked
+		issuedAt = time.Unix(claims.IssuedAt, 0).UnixNano()
+		revokedAt = time.Unix(0, revokedAt).Truncate(time.Second).UnixNano()
+	}
+	return present && issuedAt <= revokedAt
+}
+
+// revokeUser removes all the refresh tokens issued to the given user
+func (store *refreshTokenStore) revokeUser(username string) {
+	store.Lock()
+	defer store.Unlock()
+	for key, session := range store.sessions {
+		if session.User.Username == username {
+			delete(store.sessions, key)
+		}
+	}
+}
+
+// revokeToken removes the family of the given refresh token, if it has been issued by the api gateway
+func (store *refreshTokenStore) revokeToken(token string) {
+	store.Lock()
+	defer store.Unlock()
+	session, present := store.sessions[digest(token)]
+	if present {
+		store.revokeFamily(session.Family)
+	}
+}
+
+// clearTokenCookies asks the client to delete the cookies containing the access token and the refresh token
+func clearTokenCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   "token",
+		Value:  "",
+		MaxAge: -1,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    "",
+		Path:     refreshTokenCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// LogoutUser processes the logout request of the client. The access token provided by the client is revoked, so that
+// it can not be used anymore even if it has not expired yet. If the client provides also its refresh token, in the cookie
+// or in the JSON body, all the refresh tokens of the session are revoked too.
+func LogoutUser(w http.ResponseWriter, r *http.Request) {
+
+	/* For authentication purpose the access token is read from the request and validated */
+	decodedToken, err := AuthenticateRequest(w, r)
+	if err != nil {
+		return
+	}
+
+	err = revocations.revokeToken(decodedToken)
+	if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+		log.Println("Api Gateway - Internal Server Error")
+		return
+	}
+	// The refresh token is taken from the same sources as for the refresh, so that the clients that do not use the
+	// cookies can end their session too
+	refreshToken, err := getRefreshToken(r)
+	if err == nil {
+		refreshTokens.revokeToken(refreshToken)
+	}
+
+	clearTokenCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeUserTokens processes the request of an administrator of revoking all the tokens issued to the user specified
+// in the URL, both access tokens and refresh tokens. As a consequence the user has to login again.
+func RevokeUserTokens(w http.ResponseWriter, r *http.Request) {
+
+	/* For authentication purpose the access token is read from the request and validated */
+	decodedToken, err := AuthenticateRequest(w, r)
+	if err != nil {
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	err = revocations.revokeUser(username)
+	if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+		log.Println("Api Gateway - Internal Server Error")
+		return
+	}
+	refreshTokens.revokeUser(username)
+	auditLog("tokens_revoked", map[string]string{"username": username, "admin": decodedToken.Subject})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,200 @@
+package microservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Variables of a path template, e.g. {courseId} or {id:[0-9]+}
+var pathVariable = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// RouteTable lists the routes of the api gateway
+type RouteTable struct {
+	Routes []RouteDefinition `json:"routes" yaml:"routes"`
+}
+
+// RouteDefinition describes a route of the api gateway, registered with the given path template and methods. The
+// requests are either proxied to the given path of the given micro-service, where the variables of the path template
+// are replaced by their values, or served by the Go handler with the given name, for the flows that involve more than
+// a request to a micro-service. A route declaring roles or being public adds its entry to the access policy; the
+// routes needing conditions leave both out and are covered by the policy file.
+type RouteDefinition struct {
+	Path         string   `json:"path" yaml:"path"`
+	Methods      []string `json:"methods" yaml:"methods"`
+	Upstream     string   `json:"upstream" yaml:"upstream"`
+	UpstreamPath string   `json:"upstreamPath" yaml:"upstreamPath"`
+	Handler      string   `json:"handler" yaml:"handler"`
+	Public       bool     `json:"public" yaml:"public"`
+	Roles        []string `json:"roles" yaml:"roles"`
+}
+
+// customHandlers contains the Go handlers that the routes can refer to, indexed by name
+var customHandlers = map[string]http.HandlerFunc{
+	"RegisterUser":                 RegisterUser,
+	"LoginUser":                    LoginUser,
+	"LogoutUser":                   LogoutUser,
+	"RefreshAccessToken":           RefreshAccessToken,
+	"CreateCourse":                 CreateCourse,
+	"DeleteCourse":                 DeleteCourse,
+	"GetOperation":                 GetOperation,
+	"FindStudentCourses":           FindStudentCourses,
+	"FindCourse":                   FindCourse,
+	"UnsubscribeStudentFromCourse": UnsubscribeStudentFromCourse,
+	"AddCourseToStudent":           AddCourseToStudent,
+	"CreateExam":                   CreateExam,
+	"ReserveExam":                  ReserveExam,
+	"FindExamByCourse":             FindExamByCourse,
+	"FindTeachingMaterialByCourse": FindTeachingMaterialByCourse,
+	"GetDownloadLinkToFile":        GetDownloadLinkToFile,
+	"PushCourseNotification":       PushCourseNotification,
+	"GetJSONWebKeySet":             GetJSONWebKeySet,
+	"Liveness":                     Liveness,
+	"Readiness":                    Readiness,
+}
+
+// readRouteTable reads the route table from the file of the given configuration, in YAML if its extension is .yaml or
+// .yml and in JSON otherwise, and validates it against the micro-services of the same configuration. If no file is
+// given the table is empty.
+func readRouteTable(configuration config.Config) ([]RouteDefinition, error) {
+	routeFile := configuration.RouteFile
+	if routeFile == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(routeFile)
+	if err != nil {
+		return nil, err
+	}
+	var table RouteTable
+	switch strings.ToLower(filepath.Ext(routeFile)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &table)
+	default:
+		err = json.Unmarshal(content, &table)
+	}
+	if err != nil {
+		return nil, err
+	}
+	registered := make(map[string]bool)
+	for _, route := range table.Routes {
+		err = validateRouteDefinition(route, upstreamAddressesOf(configuration))
+		if err != nil {
+			return nil, err
+		}
+		for _, method := range route.Methods {
+			key := method + " " + route.Path
+			if registered[key] {
+				return nil, fmt.Errorf("duplicate route %s", key)
+			}
+			registered[key] = true
+		}
+	}
+	return table.Routes, nil
+}
+
+// validateRouteDefinition checks that the given route can be registered, given the base addresses of the
+// micro-services indexed by name
+func validateRouteDefinition(route RouteDefinition, addresses map[string]string) error {
+	if route.Path == "" || len(route.Methods) == 0 {
+		return errors.New("route without path or methods")
+	}
+	if (route.Upstream == "") == (route.Handler == "") {
+		return fmt.Errorf("route %s needs either an upstream or a handler", route.Path)
+	}
+	if route.Handler != "" {
+		if _, present := customHandlers[route.Handler]; !present {
+			return fmt.Errorf("unknown handler %q for route %s", route.Handler, route.Path)
+		}
+	} else {
+		if _, present := addresses[route.Upstream]; !present {
+			return fmt.Errorf("unknown upstream %q for route %s", route.Upstream, route.Path)
+		}
+		variables := make(map[string]bool)
+		for _, match := range pathVariable.FindAllStringSubmatch(route.Path, -1) {
+			variables[match[1]] = true
+		}
+		for _, match := range pathVariable.FindAllStringSubmatch(route.UpstreamPath, -1) {
+			if !variables[match[1]] {
+				return fmt.Errorf("unknown variable %q in the upstream path of route %s", match[1], route.Path)
+			}
+		}
+	}
+	if route.Public && len(route.Roles) > 0 {
+		return fmt.Errorf("public route %s with roles", route.Path)
+	}
+	return nil
+}
+
+// routeTablePolicies returns the access policy of the routes of the table that declare it
+func routeTablePolicies(routes []RouteDefinition) []RoutePolicy {
+	var policies []RoutePolicy
+	for _, route := range routes {
+		if !route.Public && len(route.Roles) == 0 {
+			continue
+		}
+		routePolicy := RoutePolicy{Path: route.Path, Methods: route.Methods, Public: route.Public}
+		if len(route.Roles) > 0 {
+			routePolicy.Grants = []Grant{{Roles: route.Roles}}
+		}
+		policies = append(policies, routePolicy)
+	}
+	return policies
+}
+
+// rewriteUpstreamPath returns the given upstream path, with the variables replaced by the given values
+func rewriteUpstreamPath(upstreamPath string, vars map[string]string) string {
+	return pathVariable.ReplaceAllStringFunc(upstreamPath, func(variable string) string {
+		return vars[pathVariable.FindStringSubmatch(variable)[1]]
+	})
+}
+
+// proxyHandler returns the handler that proxies the requests of the given route to its micro-service
+func proxyHandler(route RouteDefinition) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !route.Public {
+			/* For authentication purpose the access token is read from the request and validated */
+			_, err := AuthenticateRequest(w, r)
+			if err != nil {
+				return
+			}
+		}
+		err := ProxyToUpstream(route.Upstream, rewriteUpstreamPath(route.UpstreamPath, mux.Vars(r)), w, r)
+		if err != nil {
+			makeUpstreamErrorResponse(w, err)
+			return
+		}
+	}
+}
+
+// RegisterRoutes reads the route table from the configured file and registers its routes in the given router
+func RegisterRoutes(router *mux.Router) error {
+	configuration := config.Get()
+	routes, err := readRouteTable(configuration)
+	if err != nil {
+		return err
+	}
+	registerRouteTable(router, routes)
+	log.Println(strconv.Itoa(len(routes)) + " routes registered from " + configuration.RouteFile)
+	return nil
+}
+
+// registerRouteTable registers the given routes in the given router
+func registerRouteTable(router *mux.Router, routes []RouteDefinition) {
+	for _, route := range routes {
+		handler := customHandlers[route.Handler]
+		if route.Upstream != "" {
+			handler = proxyHandler(route)
+		}
+		router.HandleFunc(route.Path, handler).Methods(route.Methods...)
+	}
+}
@@ -0,0 +1,281 @@
+package microservice
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// SagaParameters contains the data of the request of the client that the steps of a saga need, indexed by name
+type SagaParameters map[string]string
+
+// SagaStep is a local transaction of a saga, executed by a micro-service. The action is completed when the
+// micro-service answers with the success status. The compensation undoes a completed action, given the body of the
+// response to the action; a step without compensation cannot be undone, so it should be the last one of a sequential
+// saga.
+type SagaStep struct {
+	Name          string
+	Upstream      string
+	SuccessStatus int
+	// Statuses that complete the step too when its action is executed again after a restart, because the first
+	// execution may have succeeded, e.g. 404 Not Found for a deletion
+	ResumedStatuses []int
+	Action          func(ctx context.Context, parameters SagaParameters) (*http.Response, error)
+	Compensation    func(ctx context.Context, parameters SagaParameters, result []byte) error
+}
+
+// Saga describes an operation that involves more micro-services, as a list of steps that succeeds only if every
+// step succeeds. The steps are executed in parallel or in the given order; in the latter case the steps following a
+// failed one are not executed. When a step fails the completed ones are compensated, in reverse order. The response
+// of the step with the given name is returned to the client on success. Committed, if set, is called with the
+// parameters of an execution once it has been committed, also after a restart.
+type Saga struct {
+	Name      string
+	Parallel  bool
+	Steps     []SagaStep
+	Response  string
+	Committed func(parameters SagaParameters)
+}
+
+// stepOutcome encapsulates the outcome of the action of a step. The error is set if no response was received from
+// the micro-service.
+type stepOutcome struct {
+	executed bool
+	status   int
+	body     []byte
+	err      error
+}
+
+// completed returns true if the action of the given step was executed successfully
+func (outcome stepOutcome) completed(step SagaStep) bool {
+	return outcome.executed && outcome.err == nil && outcome.status == step.SuccessStatus
+}
+
+// resumed returns true if the action of the given step, executed again after a restart, has been completed
+func (outcome stepOutcome) resumed(step SagaStep) bool {
+	if outcome.completed(step) {
+		return true
+	}
+	for _, status := range step.ResumedStatuses {
+		if outcome.executed && outcome.err == nil && outcome.status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// executeStep executes the action of the given step and reads the response of the micro-service. A panic of the
+// action is turned into an error, so that it cannot crash the api gateway when the steps run in parallel.
+func executeStep(ctx context.Context, step SagaStep, parameters SagaParameters) (outcome stepOutcome) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			outcome = stepOutcome{executed: true, err: errors.New("action panicked: " + panicDescription(recovered))}
+		}
+	}()
+	response, err := step.Action(ctx, parameters)
+	if err != nil {
+		return stepOutcome{executed: true, err: err}
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return stepOutcome{executed: true, err: err}
+	}
+	return stepOutcome{executed: true, status: response.StatusCode, body: body}
+}
+
+// executeLoggedStep executes the given step of the execution with the given id, recording its outcome in the saga log
+func executeLoggedStep(ctx context.Context, id string, step SagaStep, parameters SagaParameters) stepOutcome {
+	sagas.recordEvent(id, stepStarted, step.Name, nil)
+	outcome := executeStep(ctx, step, parameters)
+	if outcome.completed(step) {
+		sagas.recordEvent(id, stepCompleted, step.Name, outcome.body)
+	} else {
+		sagas.recordEvent(id, stepFailed, step.Name, nil)
+	}
+	return outcome
+}
+
+// run executes the steps of the saga and, if one of them fails, compensates the completed ones. The execution is
+// recorded in the saga log with the given id. The outcomes of the steps are returned in the order of the steps.
+func (saga *Saga) run(ctx context.Context, id string, parameters SagaParameters) []stepOutcome {
+	outcomes := make([]stepOutcome, len(saga.Steps))
+	failed := false
+	if saga.Parallel {
+		type indexedOutcome struct {
+			index   int
+			outcome stepOutcome
+		}
+		c := make(chan indexedOutcome, len(saga.Steps))
+		for i, step := range saga.Steps {
+			go func(i int, step SagaStep) {
+				c <- indexedOutcome{i, executeLoggedStep(ctx, id, step, parameters)}
+			}(i, step)
+		}
+		for range saga.Steps {
+			result := <-c
+			outcomes[result.index] = result.outcome
+			failed = failed || !result.outcome.completed(saga.Steps[result.index])
+		}
+	} else {
+		for i, step := range saga.Steps {
+			outcomes[i] = executeLoggedStep(ctx, id, step, parameters)
+			if !outcomes[i].completed(step) {
+				failed = true
+				break
+			}
+		}
+	}
+	if failed {
+		saga.compensate(id, parameters, outcomes)
+	} else {
+		saga.commit(id, parameters)
+	}
+	return outcomes
+}
+
+// commit records in the saga log that the execution of the saga with the given id has been committed
+func (saga *Saga) commit(id string, parameters SagaParameters) {
+	sagas.recordEvent(id, sagaCommitted, "", nil)
+	if saga.Committed != nil {
+		saga.Committed(parameters)
+	}
+}
+
+// compensate undoes the completed steps of the execution of the saga with the given id, in reverse order. The
+// compensations are not bound to the request of the client, so that they are completed even if the client
+// disconnects. A failed compensation is put in the compensation queue, to be retried in background.
+func (saga *Saga) compensate(id string, parameters SagaParameters, outcomes []stepOutcome) {
+	for i := len(saga.Steps) - 1; i >= 0; i-- {
+		step := saga.Steps[i]
+		if !outcomes[i].completed(step) || step.Compensation == nil {
+			continue
+		}
+		compensateStep(saga, id, step, parameters, outcomes[i].body)
+	}
+	sagas.recordEvent(id, sagaCompensated, "", nil)
+}
+
+// compensateStep undoes the given step of the execution of the saga with the given id. If the compensation fails it
+// is put in the compensation queue, that takes charge of it.
+func compensateStep(saga *Saga, id string, step SagaStep, parameters SagaParameters, result []byte) {
+	err := safeCompensation(step, parameters, result)
+	if err == nil {
+		sagas.recordEvent(id, stepCompensated, step.Name, nil)
+		return
+	}
+	log.Println("Saga " + saga.Name + " " + id + " - compensation of " + step.Name + " failed: " + err.Error())
+	sagas.recordEvent(id, compensationFailed, step.Name, nil)
+	err = compensations.enqueue(saga, id, step.Name, parameters, result, err)
+	if err != nil {
+		log.Println("Saga " + saga.Name + " " + id + " - compensation of " + step.Name + " not queued: " + err.Error())
+	}
+}
+
+// start records in the saga log the start of a new execution of the saga with the given parameters and returns its id
+func (saga *Saga) start(parameters SagaParameters) (string, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	err = sagas.record(sagaLogRecord{Id: id, Saga: saga.Name, Event: sagaStarted, Parameters: parameters})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// upstreams returns the names of the micro-services involved in the saga
+func (saga *Saga) upstreams() []string {
+	var names []string
+	for _, step := range saga.Steps {
+		names = append(names, step.Upstream)
+	}
+	return names
+}
+
+// ExecuteSaga executes the given saga on behalf of the client and returns the outcome to the client. The saga does not
+// start if one of the micro-services is known to be failing, so that nothing has to be undone. If the client asks for
+// it through the Prefer: respond-async header, the saga is executed in background and the client receives the id of
+// the operation, whose state can be queried until the outcome is known.
+func ExecuteSaga(w http.ResponseWriter, r *http.Request, saga *Saga, parameters SagaParameters) {
+
+	unavailable := unavailableUpstream(saga.upstreams()...)
+	if unavailable != "" {
+		log.Println("Circuit breaker of " + unavailable + " open")
+		makeUpstreamErrorResponse(w, CircuitOpen)
+		return
+	}
+
+	async := respondAsync(r)
+	owner := ""
+	if async {
+		/* The operation can be queried only by the client that requested it */
+		decodedToken, err := AuthenticateRequest(w, r)
+		if err != nil {
+			return
+		}
+		owner = decodedToken.CallerUsername()
+	}
+
+	// The execution is not started if it cannot be recorded, because it could not be recovered after a crash
+	id, err := saga.start(parameters)
+	if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+		log.Println("Saga " + saga.Name + " not started: " + err.Error())
+		return
+	}
+	if async {
+		executeSagaAsync(w, r, saga, id, parameters, owner)
+		return
+	}
+	// As in asynchronous mode, the saga is not cancelled if the client disconnects: the steps already sent to the
+	// micro-services could be committed, and they would not be compensated
+	outcomes := saga.run(detachedContext{r.Context()}, id, parameters)
+	status, body := saga.response(id, outcomes)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(body)
+	if err != nil {
+		log.Println("Api Gateway - Internal Server Error")
+	}
+}
+
+// response returns the status and the body of the response for the client of the execution with the given id of the
+// saga, given the outcomes of its steps. If a micro-service answered with an error, the response of the last failed
+// step is returned; if a micro-service did not answer, an Internal Server Error is returned.
+func (saga *Saga) response(id string, outcomes []stepOutcome) (int, []byte) {
+	var response *stepOutcome // The response for the client
+	for i, step := range saga.Steps {
+		outcome := outcomes[i]
+		if !outcome.executed || outcome.completed(step) {
+			continue
+		}
+		if outcome.err != nil {
+			// Any error occurred during forwarding of request: the client receive an Internal Server Error
+			log.Println("Saga " + saga.Name + " " + id + " - " + step.Name + " failed: " + outcome.err.Error())
+			log.Println("Api Gateway - Internal Server Error")
+			return http.StatusInternalServerError, errorPayload("Api Gateway - Internal Server Error")
+		}
+		// Failure: the client receive the last error response that the api-gateway obtained from micro-services
+		log.Println("Saga " + saga.Name + " " + id + " - " + step.Name + " failed with status " + strconv.Itoa(outcome.status))
+		response = &outcomes[i]
+	}
+	if response == nil {
+		// Success: the client receive the response of the designated micro-service
+		for i, step := range saga.Steps {
+			if step.Name == saga.Response {
+				response = &outcomes[i]
+			}
+		}
+	}
+	if response == nil {
+		log.Println("Api Gateway - Internal Server Error")
+		return http.StatusInternalServerError, errorPayload("Api Gateway - Internal Server Error")
+	}
+	return response.status, response.body
+}
@@ -0,0 +1,300 @@
+package microservice
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Events recorded in the saga log
+const (
+	sagaStarted        = "started"
+	stepStarted        = "step started"
+	stepCompleted      = "step completed"
+	stepFailed         = "step failed"
+	stepCompensated    = "step compensated"
+	compensationFailed = "compensation failed"
+	sagaCommitted      = "committed"
+	sagaCompensated    = "compensated"
+)
+
+// States of a step of a saga, as rebuilt from the saga log. A started step has an unknown outcome.
+const (
+	stepPending            = "pending"
+	stepRunning            = "started"
+	stepDone               = "completed"
+	stepRejected           = "failed"
+	stepUndone             = "compensated"
+	stepCompensationFailed = "compensation failed"
+)
+
+// Permissions of the saga log, that contains the data of the requests of the clients
+const sagaLogFilePermissions = 0600
+
+// sagaDefinitions contains the sagas whose executions can be recovered, indexed by name
+var sagaDefinitions = map[string]*Saga{
+	createCourseSaga.Name:       createCourseSaga,
+	deleteCourseSaga.Name:       deleteCourseSaga,
+	subscribeStudentSaga.Name:   subscribeStudentSaga,
+	unsubscribeStudentSaga.Name: unsubscribeStudentSaga,
+}
+
+// sagaLogRecord is an entry of the saga log, recording an event of an execution of a saga. The parameters are
+// recorded when the execution starts, the result when a step is completed.
+type sagaLogRecord struct {
+	Id         string         `json:"id"`
+	Saga       string         `json:"saga,omitempty"`
+	Event      string         `json:"event"`
+	Step       string         `json:"step,omitempty"`
+	Parameters SagaParameters `json:"parameters,omitempty"`
+	Result     []byte         `json:"result,omitempty"`
+	Time       time.Time      `json:"time"`
+}
+
+// sagaExecution is the state of an execution of a saga, as rebuilt from the saga log
+type sagaExecution struct {
+	Id         string
+	Saga       string
+	Parameters SagaParameters
+	Steps      map[string]string
+	Results    map[string][]byte
+	Started    time.Time
+}
+
+// sagaExecutions contains the unfinished executions of the sagas, indexed by id
+type sagaExecutions map[string]*sagaExecution
+
+// sagaLog records the events of the executions of the sagas in an append-only file, so that the executions interrupted
+// by a crash can be recovered at the next startup. The unfinished executions are kept in memory too.
+type sagaLog struct {
+	sync.Mutex
+	file       *os.File
+	executions sagaExecutions
+}
+
+var sagas = sagaLog{executions: make(sagaExecutions)}
+
+// apply updates the state of the executions with the given record. The finished executions are forgotten.
+func (executions sagaExecutions) apply(record sagaLogRecord) {
+	execution, present := executions[record.Id]
+	if !present {
+		if record.Event != sagaStarted {
+			return
+		}
+		execution = &sagaExecution{Id: record.Id, Saga: record.Saga, Parameters: record.Parameters,
+			Steps: make(map[string]string), Results: make(map[string][]byte), Started: record.Time}
+		executions[record.Id] = execution
+	}
+	switch record.Event {
+	case sagaStarted:
+		if definition, present := sagaDefinitions[record.Saga]; present {
+			for _, step := range definition.Steps {
+				execution.Steps[step.Name] = stepPending
+			}
+		}
+	case stepStarted:
+		execution.Steps[record.Step] = stepRunning
+	case stepCompleted:
+		execution.Steps[record.Step] = stepDone
+		execution.Results[record.Step] = record.Result
+	case stepFailed:
+		execution.Steps[record.Step] = stepRejected
+	case stepCompensated:
+		execution.Steps[record.Step] = stepUndone
+	case compensationFailed:
+		execution.Steps[record.Step] = stepCompensationFailed
+	case sagaCommitted, sagaCompensated:
+		delete(executions, record.Id)
+	}
+}
+
+// record appends the given record to the saga log. The record is written to disk before returning, so that it
+// survives a crash.
+func (sagaLog *sagaLog) record(record sagaLogRecord) error {
+	record.Time = time.Now()
+	sagaLog.Lock()
+	defer sagaLog.Unlock()
+	sagaLog.executions.apply(record)
+	operations.apply(record)
+	if sagaLog.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = sagaLog.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return sagaLog.file.Sync()
+}
+
+// recordEvent appends a record of the given event of the execution with the given id. A failed write is logged,
+// because the execution goes on anyway.
+func (sagaLog *sagaLog) recordEvent(id string, event string, step string, result []byte) {
+	err := sagaLog.record(sagaLogRecord{Id: id, Event: event, Step: step, Result: result})
+	if err != nil {
+		log.Println("Saga log not written: " + err.Error())
+	}
+}
+
+// unfinished returns the executions that have not been committed or compensated
+func (sagaLog *sagaLog) unfinished() []sagaExecution {
+	sagaLog.Lock()
+	defer sagaLog.Unlock()
+	var executions []sagaExecution
+	for _, execution := range sagaLog.executions {
+		copied := *execution
+		copied.Steps = make(map[string]string)
+		for step, state := range execution.Steps {
+			copied.Steps[step] = state
+		}
+		copied.Results = make(map[string][]byte)
+		for step, result := range execution.Results {
+			copied.Results[step] = result
+		}
+		executions = append(executions, copied)
+	}
+	return executions
+}
+
+// LoadSagaLog reads the saga log from the file specified in the configuration, if any, and opens it to record the
+// new executions. The log is compacted, keeping only the unfinished executions, that RecoverSagas completes. It is
+// meant to be called at startup.
+func LoadSagaLog() error {
+	sagaLogFile := config.Get().SagaLogFile
+	if sagaLogFile == "" {
+		return nil
+	}
+	executions := make(sagaExecutions)
+	var records []sagaLogRecord
+	file, err := os.Open(sagaLogFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var record sagaLogRecord
+			// A crash during a write can leave a truncated last line, that is skipped
+			if json.Unmarshal(scanner.Bytes(), &record) != nil {
+				continue
+			}
+			executions.apply(record)
+			records = append(records, record)
+		}
+		file.Close()
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+	}
+
+	// The file is replaced atomically with the records of the unfinished executions, so that a crash during the
+	// compaction does not lose them
+	var content []byte
+	for _, record := range records {
+		if _, unfinished := executions[record.Id]; !unfinished {
+			continue
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, line...), '\n')
+	}
+	tmpFile := sagaLogFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, content, sagaLogFilePermissions)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile, sagaLogFile)
+	if err != nil {
+		return err
+	}
+	file, err = os.OpenFile(sagaLogFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, sagaLogFilePermissions)
+	if err != nil {
+		return err
+	}
+
+	sagas.Lock()
+	defer sagas.Unlock()
+	if sagas.file != nil {
+		sagas.file.Close()
+	}
+	sagas.file = file
+	sagas.executions = executions
+	log.Println(strconv.Itoa(len(executions)) + " unfinished sagas found in " + sagaLogFile)
+	return nil
+}
+
+// RecoverSagas completes the executions of the sagas interrupted by a crash. An execution whose steps are all
+// completed is committed. The steps with an unknown outcome that cannot be compensated are executed again: if they
+// succeed, and so every step is completed, the execution is committed. Otherwise the steps that may have been
+// completed are compensated, and the failed compensations are put in the compensation queue, unless they are
+// already there. The executions of unknown sagas stay in the log.
+func RecoverSagas() {
+	for _, execution := range sagas.unfinished() {
+		err := recoverSaga(execution)
+		if err != nil {
+			log.Println("Saga " + execution.Saga + " " + execution.Id + " not recovered: " + err.Error())
+			continue
+		}
+		log.Println("Saga " + execution.Saga + " " + execution.Id + " recovered")
+	}
+}
+
+// recoverSaga completes the given execution of a saga
+func recoverSaga(execution sagaExecution) error {
+	saga, present := sagaDefinitions[execution.Saga]
+	if !present {
+		return errors.New("unknown saga " + execution.Saga)
+	}
+	completed := true
+	for _, step := range saga.Steps {
+		if execution.Steps[step.Name] == stepRunning && step.Compensation == nil {
+			// The step is resumed, executing its action again
+			sagas.recordEvent(execution.Id, stepStarted, step.Name, nil)
+			outcome := executeStep(context.Background(), step, execution.Parameters)
+			if outcome.resumed(step) {
+				execution.Steps[step.Name] = stepDone
+				sagas.recordEvent(execution.Id, stepCompleted, step.Name, outcome.body)
+			} else {
+				execution.Steps[step.Name] = stepRejected
+				sagas.recordEvent(execution.Id, stepFailed, step.Name, nil)
+			}
+		}
+		completed = completed && execution.Steps[step.Name] == stepDone
+	}
+	if completed {
+		saga.commit(execution.Id, execution.Parameters)
+		return nil
+	}
+	for i := len(saga.Steps) - 1; i >= 0; i-- {
+		step := saga.Steps[i]
+		switch execution.Steps[step.Name] {
+		case stepDone, stepRunning, stepCompensationFailed:
+		default:
+			continue
+		}
+		if step.Compensation == nil {
+			continue
+		}
+		if execution.Steps[step.Name] == stepCompensationFailed && compensations.queued(execution.Id, step.Name) {
+			// The failed compensation is already retried by the compensation queue
+			continue
+		}
+		compensateStep(saga, execution.Id, step, execution.Parameters, execution.Results[step.Name])
+	}
+	sagas.recordEvent(execution.Id, sagaCompensated, "", nil)
+	return nil
+}
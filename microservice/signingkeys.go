@@ -0,0 +1,293 @@
+package microservice
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var UnknownSigningKey = errors.New("unknown signing key")
+var UnsupportedSigningAlgorithm = errors.New("unsupported signing algorithm")
+
+// signingKey encapsulates a private key used to sign the access tokens. The key is identified by the kid header of
+// the tokens it signs. A retired key is no more used to sign new tokens, but it keeps verifying the tokens it signed
+// until they expire.
+type signingKey struct {
+	Kid        string
+	Method     jwt.SigningMethod
+	PrivateKey crypto.Signer
+	RetiredAt  time.Time
+}
+
+// keyRing contains the keys currently used by the api gateway when the tokens are signed with an asymmetric
+// algorithm (RS256 or ES256). When the tokens are signed with HS256 the key ring is empty and the shared secret
+// specified in the configuration is used instead.
+type keyRing struct {
+	sync.RWMutex
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+var signingKeys = keyRing{keys: make(map[string]*signingKey)}
+
+// signingMethod returns the signing method specified in the configuration. HS256 is the default one.
+func signingMethod() (jwt.SigningMethod, error) {
+	switch config.Get().TokenSigningAlgorithm {
+	case "", "HS256":
+		return jwt.SigningMethodHS256, nil
+	case "RS256":
+		return jwt.SigningMethodRS256, nil
+	case "ES256":
+		return jwt.SigningMethodES256, nil
+	}
+	return nil, UnsupportedSigningAlgorithm
+}
+
+// LoadSigningKeys initializes the key ring according to the configuration. If an asymmetric algorithm is configured
+// the private keys are read from the configured directory or, if no directory is given, a new key is generated.
+// If the key rotation is enabled, a goroutine that periodically rotates the keys is started.
+func LoadSigningKeys() error {
+	method, err := signingMethod()
+	if err != nil {
+		return err
+	}
+	if method == jwt.SigningMethodHS256 {
+		return nil
+	}
+	err = RotateSigningKeys()
+	if err != nil {
+		return err
+	}
+	if config.Get().TokenKeyRotationHours > 0 {
+		go func() {
+			interval := time.Duration(config.Get().TokenKeyRotationHours) * time.Hour
+			for range time.Tick(interval) {
+				err := RotateSigningKeys()
+				if err != nil {
+					log.Println("Signing keys rotation failed: " + err.Error())
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// RotateSigningKeys replaces the active signing key. If a keys directory is configured, the keys are read again from
+// it and the most recent one (the last in lexicographic order of kid) becomes the active key: in this way a new key
+// can be deployed simply adding its file to the directory. Otherwise a new key is generated in memory. The previous
+// active key and the keys removed from the directory are retired, so they keep verifying the tokens they signed until
+// those tokens expire.
+func RotateSigningKeys() error {
+	method, err := signingMethod()
+	if err != nil {
+		return err
+	}
+	var newKeys []*signingKey
+	if config.Get().TokenSigningKeysDirectory != "" {
+		newKeys, err = readSigningKeys(config.Get().TokenSigningKeysDirectory, method)
+	} else {
+		var key *signingKey
+		key, err = generateSigningKey(method)
+		newKeys = []*signingKey{key}
+	}
+	if err != nil {
+		return err
+	}
+	if len(newKeys) == 0 {
+		return errors.New("no signing key found")
+	}
+
+	signingKeys.Lock()
+	defer signingKeys.Unlock()
+	now := time.Now()
+	present := make(map[string]bool)
+	for _, key := range newKeys {
+		present[key.Kid] = true
+		signingKeys.keys[key.Kid] = key
+	}
+	for kid, key := range signingKeys.keys {
+		if !present[kid] && key.RetiredAt.IsZero() {
+			key.RetiredAt = now
+		} else if !key.RetiredAt.IsZero() && now.Sub(key.RetiredAt) > accessTokenLifetime {
+			// All the tokens signed with the key have expired
+			delete(signingKeys.keys, kid)
+		}
+	}
+	signingKeys.active = newKeys[len(newKeys)-1]
+	log.Println("Active signing key: " + signingKeys.active.Kid)
+	return nil
+}
+
+// readSigningKeys reads the PEM encoded private keys contained in the given directory. The kid of each key is the
+// name of its file without extension. The keys are returned sorted by kid.
+func readSigningKeys(directory string, method jwt.SigningMethod) ([]*signingKey, error) {
+	files, err := filepath.Glob(filepath.Join(directory, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var keys []*signingKey
+	for _, file := range files {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var privateKey crypto.Signer
+		if method == jwt.SigningMethodRS256 {
+			privateKey, err = jwt.ParseRSAPrivateKeyFromPEM(bytes)
+		} else {
+			var ecKey *ecdsa.PrivateKey
+			ecKey, err = jwt.ParseECPrivateKeyFromPEM(bytes)
+			if err == nil && ecKey.Curve != elliptic.P256() {
+				err = errors.New("ES256 requires a P-256 key")
+			}
+			privateKey = ecKey
+		}
+		if err != nil {
+			return nil, errors.New(file + ": " + err.Error())
+		}
+		kid := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		keys = append(keys, &signingKey{Kid: kid, Method: method, PrivateKey: privateKey})
+	}
+	return keys, nil
+}
+
+// generateSigningKey generates a new private key for the given signing method. The kid is derived from the time of
+// generation.
+func generateSigningKey(method jwt.SigningMethod) (*signingKey, error) {
+	var privateKey crypto.Signer
+	var err error
+	if method == jwt.SigningMethodRS256 {
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	kid := time.Now().UTC().Format("20060102T150405.000000000")
+	return &signingKey{Kid: kid, Method: method, PrivateKey: privateKey}, nil
+}
+
+// SignAccessToken builds the JWT token to be returned to the client, signed according to the configured algorithm.
+// With an asymmetric algorithm the active key of the key ring is used and its identifier is written in the kid header.
+func SignAccessToken(user User) (string, error) {
+	signingKeys.RLock()
+	active := signingKeys.active
+	signingKeys.RUnlock()
+	if active == nil {
+		return GenerateAccessToken(user, []byte(config.Get().TokenPrivateKey))
+	}
+	claims, err := makeClaims(user)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(active.Method, claims)
+	token.Header["kid"] = active.Kid
+	return token.SignedString(active.PrivateKey)
+}
+
+// verificationKey returns the key to be used to verify the signature of the given token. When the key ring is in use,
+// the key is chosen according to the kid header and the algorithm of the token must match the one of the key,
+// otherwise the shared secret is returned and the token must be signed with HS256.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	signingKeys.RLock()
+	defer signingKeys.RUnlock()
+	if signingKeys.active == nil {
+		if _, isHMAC := token.Method.(*jwt.SigningMethodHMAC); !isHMAC {
+			return nil, UnsupportedSigningAlgorithm
+		}
+		return []byte(config.Get().TokenPrivateKey), nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, present := signingKeys.keys[kid]
+	if !present || token.Method.Alg() != key.Method.Alg() {
+		return nil, UnknownSigningKey
+	}
+	return key.PrivateKey.Public(), nil
+}
+
+// jsonWebKey encapsulates the public part of a signing key according to the JWK standard (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// encodeInt encodes the given integer as required by JWK, left padding it with zeros to the given size
+func encodeInt(value *big.Int, size int) string {
+	bytes := value.Bytes()
+	if len(bytes) < size {
+		bytes = append(make([]byte, size-len(bytes)), bytes...)
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// makeJSONWebKey builds the JWK representation of the public part of the given key
+func makeJSONWebKey(key *signingKey) jsonWebKey {
+	jwk := jsonWebKey{Kid: key.Kid, Use: "sig", Alg: key.Method.Alg()}
+	switch publicKey := key.PrivateKey.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeInt(publicKey.N, 0)
+		jwk.E = encodeInt(big.NewInt(int64(publicKey.E)), 0)
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = encodeInt(publicKey.X, 32)
+		jwk.Y = encodeInt(publicKey.Y, 32)
+	}
+	return jwk
+}
+
+// GetJSONWebKeySet returns to the client the public keys that can be used to verify the access tokens issued by the
+// api gateway, including the retired keys whose tokens may still be valid. In this way the other microservices can
+// verify the tokens on their own. If the tokens are signed with HS256 the key set is empty.
+func GetJSONWebKeySet(w http.ResponseWriter, _ *http.Request) {
+	signingKeys.RLock()
+	var kids []string
+	for kid := range signingKeys.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	keySet := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{Keys: []jsonWebKey{}}
+	for _, kid := range kids {
+		keySet.Keys = append(keySet.Keys, makeJSONWebKey(signingKeys.keys[kid]))
+	}
+	signingKeys.RUnlock()
+
+	responseBody, err := json.Marshal(keySet)
+	if err != nil {
+		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+		log.Println("Api Gateway - Internal Server Error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(responseBody)
+}
@@ -3,23 +3,30 @@ package microservice
 import (
 	"errors"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/redefik/sdccproject/apigateway/config"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
 // Claims encapsulates the payload that will be encoded to build the access token
 // according to JWT standard
 type Claims struct {
-	Name    string
-	Surname string
-	Type    string
-	Mail    string
+	Name     string
+	Surname  string
+	Username string
+	Type     string
+	Mail     string
+	// Issue time in nanoseconds, since the iat claim has the precision of seconds
+	IssuedAtNano int64
 	jwt.StandardClaims
 }
 
 var ExpiredToken = errors.New("expired token")
+var InvalidToken = errors.New("invalid token")
+
+// Lifetime of the access tokens
+const accessTokenLifetime = 10 * time.Minute
 
 // makeClaims builds the payload of the JWT token. The payload will contain:
 // - user Name
@@ -27,21 +34,38 @@ var ExpiredToken = errors.New("expired token")
 // - user Type (student or teacher)
 // - user email
 // - token expiration time
-func makeClaims(user User) Claims {
-	expirationTime := time.Now().Add(time.Duration(10 * time.Minute)).Unix()
+// - token identifier (jti), used to revoke the token
+// - token subject (the username) and issue time, in seconds and in nanoseconds, used to revoke all the tokens of an user
+func makeClaims(user User) (Claims, error) {
+	now := time.Now()
+	expirationTime := now.Add(accessTokenLifetime).Unix()
+	tokenId, err := randomToken(16)
+	if err != nil {
+		return Claims{}, err
+	}
 	claims := Claims{
-		Name:           user.Name,
-		Surname:        user.Surname,
-		Type:           user.Type,
-		StandardClaims: jwt.StandardClaims{ExpiresAt: expirationTime},
-		Mail:           user.Mail,
+		Name:     user.Name,
+		Surname:  user.Surname,
+		Username: user.Username,
+		Type:     user.Type,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expirationTime,
+			Id:        tokenId,
+			IssuedAt:  now.Unix(),
+			Subject:   user.Username,
+		},
+		Mail:         user.Mail,
+		IssuedAtNano: now.UnixNano(),
 	}
-	return claims
+	return claims, nil
 }
 
 // GenerateAccessToken builds the JWT token to be returned to the client.
 func GenerateAccessToken(user User, signingKey []byte) (string, error) {
-	claims := makeClaims(user)
+	claims, err := makeClaims(user)
+	if err != nil {
+		return "", err
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(signingKey)
 }
@@ -50,34 +74,47 @@ func GenerateAccessToken(user User, signingKey []byte) (string, error) {
 // a Claims struct containing token payload and an error, not nil if the validation goes wrong
 func ValidateToken(tokenString string, w http.ResponseWriter) (Claims, error) {
 	claims := Claims{}
-	jwtKey := []byte(config.Configuration.TokenPrivateKey)
-
-	// The token string is parsed, decoded and stored into the given Claims struct
-	token, err := jwt.ParseWithClaims(tokenString, &claims,
-		func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-
-	// Check if the token has expired according to the expiry time fixed during the sign in
-	if !token.Valid {
-		err = ExpiredToken
-		MakeErrorResponse(w, http.StatusUnauthorized, err.Error())
-		log.Println(err.Error())
-		return claims, err
-	}
 
-	// Check if the token has been signed with the private key of the api gateway
+	// The token string is parsed, decoded and stored into the given Claims struct. The key used to verify the
+	// signature depends on the configured signing algorithm and, for asymmetric algorithms, on the kid of the token
+	token, err := jwt.ParseWithClaims(tokenString, &claims, verificationKey)
+
 	if err != nil {
-		if err == jwt.ErrSignatureInvalid {
-			// If the token is expired or has not been signed according to the api gateway key, an Unauthorization code
-			// is returned in both cases, but a different message is provided to the client.
-			MakeErrorResponse(w, http.StatusUnauthorized, "Wrong credentials")
-			log.Println("Wrong credentials")
+		validationError, isValidationError := err.(*jwt.ValidationError)
+		// A token that cannot be decoded is rejected as a bad request
+		if isValidationError && validationError.Errors&jwt.ValidationErrorMalformed != 0 {
+			MakeErrorResponse(w, http.StatusBadRequest, "Malformed token")
+			log.Println("Malformed token")
 			return claims, err
 		}
+		// Check if the token has expired according to the expiry time fixed during the sign in. The signature is
+		// verified before the expiry time, so an expired token has been signed by the api gateway.
+		if isValidationError && validationError.Errors == jwt.ValidationErrorExpired {
+			err = ExpiredToken
+			MakeErrorResponse(w, http.StatusUnauthorized, "Expired token")
+			log.Println("Expired token")
+			return claims, err
+		}
+		// Otherwise the token has not been signed with a key of the api gateway (e.g. the signature is wrong or the
+		// kid unknown) or its claims are not valid. An Unauthorization code is returned as for an expired token, but a
+		// different message is provided to the client.
+		log.Println("Invalid token: " + err.Error())
+		err = InvalidToken
+		MakeErrorResponse(w, http.StatusUnauthorized, "Wrong credentials")
+		return claims, err
+	}
+	if token == nil || !token.Valid {
+		err = InvalidToken
+		MakeErrorResponse(w, http.StatusUnauthorized, "Wrong credentials")
+		log.Println("Invalid token")
+		return claims, err
+	}
 
-		MakeErrorResponse(w, http.StatusBadRequest, "Malformed token")
-		log.Println("Malformed token")
+	// Check if the token has been revoked before its expiration, e.g. because the user logged out
+	if revocations.isRevoked(claims) {
+		err = RevokedToken
+		MakeErrorResponse(w, http.StatusUnauthorized, "Revoked token")
+		log.Println("Revoked token")
 		return claims, err
 	}
 
@@ -85,24 +122,78 @@ func ValidateToken(tokenString string, w http.ResponseWriter) (Claims, error) {
 
 }
 
-/*GetToken return the string representing the token inserted in the field cookie of the header of http request.
+var NoTokenProvided = errors.New("no token provided")
+var MalformedAuthorization = errors.New("malformed authorization header")
+
+// getBearerToken returns the token carried by the Authorization header of the request according to the Bearer scheme.
+// An error is returned if the header is missing or uses a different scheme.
+func getBearerToken(r *http.Request) (string, error) {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return "", NoTokenProvided
+	}
+	fields := strings.Fields(authorization)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "Bearer") {
+		// Other authorization schemes do not carry an access token
+		return "", NoTokenProvided
+	}
+	if len(fields) != 2 {
+		return "", MalformedAuthorization
+	}
+	return fields[1], nil
+}
+
+// getCookieToken returns the token carried by the 'token' cookie of the request
+func getCookieToken(r *http.Request) (string, error) {
+	cookie, err := r.Cookie("token")
+	if err == http.ErrNoCookie {
+		return "", NoTokenProvided
+	} else if err != nil {
+		return "", err
+	}
+	return cookie.Value, nil
+}
+
+/*GetToken return the string representing the token inserted in the field cookie of the header of http request or in the
+  Authorization header according to the Bearer scheme. When both are present, the configured precedence is applied.
   If token is not present or there are other problem in its retrieval an error response is send to client*/
 func GetToken(w http.ResponseWriter, r *http.Request) (string, error) {
 
-	cookie, err := r.Cookie("token")
-	if err != nil {
-		if err == http.ErrNoCookie {
-			// If there is no cookie in the request the client is not authorized to proceed
-			MakeErrorResponse(w, http.StatusUnauthorized, "No token provided")
-			log.Println("No token provided")
+	sources := []func(*http.Request) (string, error){getCookieToken, getBearerToken}
+	if configurationOf(r.Context()).TokenSourcePrecedence == "header" {
+		sources = []func(*http.Request) (string, error){getBearerToken, getCookieToken}
+	}
+
+	for _, source := range sources {
+		token, err := source(r)
+		if err == nil {
+			return token, nil
+		}
+		if err != NoTokenProvided {
+			// Any other error occurring during the token read results in a Bad request error
+			MakeErrorResponse(w, http.StatusBadRequest, "Bad request")
+			log.Println("Bad request")
 			return "", err
 		}
-
-		// Any other error occurring during the cookie read results in a Bad request error
-		MakeErrorResponse(w, http.StatusBadRequest, "Bad request")
-		log.Println("Bad request")
-		return "", err
 	}
 
-	return cookie.Value, nil
+	// If there is no token in the request the client is not authorized to proceed
+	MakeErrorResponse(w, http.StatusUnauthorized, "No token provided")
+	log.Println("No token provided")
+	return "", NoTokenProvided
+}
+
+// AuthenticateRequest reads the access token of the request, from the cookie or from the Authorization header, and
+// validates it. It returns the claims of the token. If the authentication fails an error response is sent to the
+// client and a not nil error is returned, so the caller has just to stop processing the request. If the request has
+// already been authenticated by the AuthorizationMiddleware, the claims stored in the request context are returned.
+func AuthenticateRequest(w http.ResponseWriter, r *http.Request) (Claims, error) {
+	if claims, present := r.Context().Value(claimsContextKey{}).(Claims); present {
+		return claims, nil
+	}
+	tokenString, err := GetToken(w, r)
+	if err != nil {
+		return Claims{}, err
+	}
+	return ValidateToken(tokenString, w)
 }
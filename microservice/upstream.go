@@ -0,0 +1,209 @@
+package microservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/redefik/sdccproject/apigateway/config"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the micro-services the api gateway forwards the requests to
+const (
+	UserManagement             = "userManagement"
+	CourseManagement           = "courseManagement"
+	TeachingMaterialManagement = "teachingMaterialManagement"
+	NotificationManagement     = "notificationManagement"
+)
+
+// Default settings of the clients used to contact the micro-services
+const (
+	defaultConnectTimeout        = 2 * time.Second
+	defaultResponseHeaderTimeout = 10 * time.Second
+	defaultRequestTimeout        = 30 * time.Second
+	defaultMaxIdleConnsPerHost   = 16
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultKeepAlive             = 30 * time.Second
+)
+
+var UnknownUpstream = errors.New("unknown upstream")
+
+// upstreamClientRegistry contains the client used to contact each micro-service, indexed by name. The clients are
+// created the first time they are needed and shared by all the requests, so that the connections are reused.
+type upstreamClientRegistry struct {
+	sync.Mutex
+	clients map[string]*http.Client
+}
+
+var upstreamClients = upstreamClientRegistry{clients: make(map[string]*http.Client)}
+
+// upstreamAddresses returns the base addresses of the micro-services in the current configuration, indexed by name
+func upstreamAddresses() map[string]string {
+	return upstreamAddressesOf(config.Get())
+}
+
+// upstreamAddressesOf returns the base addresses of the micro-services in the given configuration, indexed by name
+func upstreamAddressesOf(configuration config.Config) map[string]string {
+	return map[string]string{
+		UserManagement:             configuration.UserManagementAddress,
+		CourseManagement:           configuration.CourseManagementAddress,
+		TeachingMaterialManagement: configuration.TeachingMaterialManagementAddress,
+		NotificationManagement:     configuration.NotificationManagementAddress,
+	}
+}
+
+// durationSetting returns the given configured number of milliseconds as a duration, or the default duration if the
+// value is not configured
+func durationSetting(milliseconds int, defaultValue time.Duration) time.Duration {
+	if milliseconds > 0 {
+		return time.Duration(milliseconds) * time.Millisecond
+	}
+	return defaultValue
+}
+
+// newUpstreamClient creates a client tuned according to the given settings
+func newUpstreamClient(settings config.UpstreamConfig) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   durationSetting(settings.ConnectTimeoutMs, defaultConnectTimeout),
+		KeepAlive: durationSetting(settings.KeepAliveMs, defaultKeepAlive),
+	}
+	maxIdleConnsPerHost := settings.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ResponseHeaderTimeout: durationSetting(settings.ResponseHeaderTimeoutMs, defaultResponseHeaderTimeout),
+		MaxIdleConns:          settings.MaxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       settings.MaxConnsPerHost,
+		IdleConnTimeout:       durationSetting(settings.IdleConnTimeoutMs, defaultIdleConnTimeout),
+		DisableKeepAlives:     settings.DisableKeepAlives,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   durationSetting(settings.TimeoutMs, defaultRequestTimeout),
+	}
+}
+
+// upstreamClient returns the client used to contact the given micro-service
+func upstreamClient(name string) *http.Client {
+	upstreamClients.Lock()
+	defer upstreamClients.Unlock()
+	client, present := upstreamClients.clients[name]
+	if !present {
+		client = newUpstreamClient(config.Get().Upstreams[name])
+		upstreamClients.clients[name] = client
+	}
+	return client
+}
+
+// ResetUpstreamClients discards the clients used to contact the micro-services, closing their idle connections, so
+// that the next requests use clients created according to the current configuration
+func ResetUpstreamClients() {
+	upstreamClients.Lock()
+	defer upstreamClients.Unlock()
+	for name, client := range upstreamClients.clients {
+		if transport, ok := client.Transport.(*http.Transport); ok {
+			transport.CloseIdleConnections()
+		}
+		delete(upstreamClients.clients, name)
+	}
+}
+
+// instanceURL returns the URL of the given path, relative to the given base address of an instance of a micro-service
+func instanceURL(address string, path string) string {
+	return strings.TrimSuffix(address, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// newInstanceRequest builds a request to the given path of the instance of a micro-service with the given base
+// address. The request is bound to the given context: the request to the micro-service is aborted when the context is
+// canceled, e.g. because the client that originated it has disconnected.
+func newInstanceRequest(ctx context.Context, address string, method string, path string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequest(method, instanceURL(address, path), body)
+	if err != nil {
+		return nil, err
+	}
+	return request.WithContext(ctx), nil
+}
+
+// doUpstream sends a request with the given method and body to the given path of the given micro-service, using the
+// client of the micro-service. If contentType is not empty, it is set as the content type of the body.
+func doUpstream(ctx context.Context, name string, method string, path string, contentType string, body io.Reader) (*http.Response, error) {
+	header := make(http.Header)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return doUpstreamWithHeader(ctx, name, method, path, header, body)
+}
+
+// doUpstreamWithHeader sends a request with the given method, headers and body to the given path of an instance of the
+// given micro-service, chosen by its load balancer, using the client of the micro-service. The request is repeated
+// according to the retry policy of the route, so the body is read in advance to be sent again.
+func doUpstreamWithHeader(ctx context.Context, name string, method string, path string, header http.Header,
+	body io.Reader) (*http.Response, error) {
+
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sendUpstreamWithRetries(ctx, name, method, header, false, func() (*http.Request, *upstreamInstance, error) {
+		instance, err := loadBalancerOf(name).pick(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		var requestBody io.Reader
+		if payload != nil {
+			requestBody = bytes.NewReader(payload)
+		}
+		request, err := newInstanceRequest(ctx, instance.address, method, path, requestBody)
+		if err != nil {
+			return nil, nil, err
+		}
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		return request, instance, nil
+	})
+}
+
+// sendUpstream sends the given request to the given instance of the given micro-service through the circuit breaker
+// of the micro-service. If the breaker is open the request is not sent and CircuitOpen is returned. The requests that
+// fail or that are answered with a server error count as failures, both for the breaker and for the instance, except
+// for the ones aborted because the client disconnected. The response of a streamed request is not bound to the
+// overall timeout of the client, so that large bodies can be transferred: only the connection and the wait for the
+// headers of the response are bounded, besides the context of the request.
+func sendUpstream(name string, instance *upstreamInstance, request *http.Request, streamed bool) (*http.Response, error) {
+	breaker := circuitBreakerOf(name)
+	err := breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	instance.acquire()
+	var resp *http.Response
+	if streamed {
+		resp, err = upstreamClient(name).Transport.RoundTrip(request)
+	} else {
+		resp, err = upstreamClient(name).Do(request)
+	}
+	if err != nil && request.Context().Err() == context.Canceled {
+		breaker.release()
+		instance.release(false, false)
+		return nil, err
+	}
+	success := err == nil && resp.StatusCode < http.StatusInternalServerError
+	breaker.record(success)
+	instance.release(true, success)
+	return resp, err
+}
@@ -2,17 +2,22 @@
 package microservice
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
-	"github.com/redefik/sdccproject/apigateway/config"
+	"errors"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
 )
 
-// LoginUser makes an http Get request to the user management microservice in order to receive all the information needed
-// to build the access token. Upon successful response, it generates the token and sends it to the client. In case of
-// not found user the gateway communicates to the client that it has not the required authorization to login. Otherwise,
-// it responds with a generic InternalServerError code.
+// LoginUser makes an http request to the user management microservice in order to receive all the information needed
+// to build the access token. The credentials are sent according to the configured verification mode. Upon successful
+// response, it generates the token and sends it to the client. In case of not found user the gateway communicates to
+// the client that it has not the required authorization to login. Otherwise, it responds with a generic
+// InternalServerError code.
 func LoginUser(w http.ResponseWriter, r *http.Request) {
 
 	var requestBody LoginRequestBody
@@ -26,12 +31,29 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Makes the get request to the microservice
-	query := config.Configuration.UserManagementAddress + "users/" + requestBody.Username + "/" + requestBody.Password
-	resp, err := http.Get(query)
+	// Reject the attempt if the username or the client address are locked out because of too many failures. Otherwise
+	// the attempt is counted as being verified until the credentials are verified.
+	address := clientAddress(r)
+	wait := loginAttempts.attempt(requestBody.Username, address)
+	if wait > 0 {
+		makeTooManyRequestsResponse(w, wait)
+		log.Println("Login attempt rejected - Too many failed login attempts")
+		return
+	}
+
+	// Makes the request to the microservice
+	resp, err := verifyCredentials(r.Context(), requestBody)
+	if err != nil {
+		loginAttempts.cancel(requestBody.Username, address)
+	}
+	if err == CircuitOpen || err == NoHealthyInstance {
+		makeUpstreamErrorResponse(w, err)
+		return
+	}
 	if err != nil {
 		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal server Error")
-		log.Panicln(err)
+		// The error is not logged because it may contain the URL of the request, and so the password
+		log.Println("Internal Server Error - Credentials verification failed")
 		return
 	}
 	log.Println("Response status Code from Microservice: " + strconv.Itoa(resp.StatusCode))
@@ -39,6 +61,7 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 
 	// Checks the response from the user management microservice
 	if resp.StatusCode == http.StatusOK {
+		loginAttempts.recordSuccess(requestBody.Username, address)
 		var responseBody LoginResponseBody
 
 		// Decode the microservice response
@@ -51,38 +74,92 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Generate the access token to be sent to the client
-		token, err := GenerateAccessToken(responseBody.User, []byte(config.Configuration.TokenPrivateKey))
+		token, err := SignAccessToken(responseBody.User)
 		if err != nil {
 			MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
 			log.Println("Internal Server Error")
 			return
 		}
-		// The token is written in the 'Set-Cookie' field of the HTTP answer for the client
-		http.SetCookie(w, &http.Cookie{
-			Name:  "token",
-			Value: token,
-		})
-		w.WriteHeader(http.StatusCreated)
+		// A long-lived refresh token is issued too, so that the client can renew the access token without login again
+		refreshToken, err := refreshTokens.issue(responseBody.User, "")
+		if err != nil {
+			MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
+			log.Println("Internal Server Error")
+			return
+		}
+		// The tokens are written in the 'Set-Cookie' fields and in the body of the HTTP answer for the client
+		writeTokenResponse(w, token, refreshToken)
 
 	} else if resp.StatusCode == http.StatusNotFound {
+		loginAttempts.recordFailure(requestBody.Username, address)
 		MakeErrorResponse(w, http.StatusUnauthorized, "Authentication failed - Wrong username or password")
 		log.Println("Authentication failed - Wrong username or password")
 
 	} else {
+		loginAttempts.cancel(requestBody.Username, address)
 		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal server Error")
 		log.Println("Internal Server Error")
 	}
 
 }
 
+// verifyCredentials asks the user management microservice for the user with the given credentials. The credentials
+// are sent according to the configured mode:
+// - "body" (default): in the JSON body of a POST request
+// - "basic": in the Authorization header of a GET request, according to the Basic scheme
+// - "path": in the URL path of a GET request. This mode has to be chosen explicitly and is kept for compatibility only,
+// because the password ends up in the access logs of the microservice and of any proxy between the api gateway and
+// the microservice.
+func verifyCredentials(ctx context.Context, credentials LoginRequestBody) (*http.Response, error) {
+	mode := configurationOf(ctx).CredentialVerificationMode
+	switch mode {
+	case "", "body":
+		body, err := json.Marshal(credentials)
+		if err != nil {
+			return nil, err
+		}
+		return doUpstream(ctx, UserManagement, http.MethodPost, "users/authentication", "application/json",
+			bytes.NewBuffer(body))
+	case "basic":
+		header := make(http.Header)
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials.Username+":"+
+			credentials.Password)))
+		return doUpstreamWithHeader(ctx, UserManagement, http.MethodGet, "users/authentication", header, nil)
+	case "path":
+		return doUpstream(ctx, UserManagement, http.MethodGet, "users/"+credentials.Username+"/"+credentials.Password,
+			"", nil)
+	}
+	return nil, errors.New("unknown credential verification mode " + mode)
+}
+
 // RegisterUser.md forwards the post request for registration to the user-management microservice,
 // collect the response and sends it to the client
 func RegisterUser(w http.ResponseWriter, r *http.Request) {
 
-	err := ForwardAndReturnPost(config.Configuration.UserManagementAddress+"users", "application/json", w, r)
+	// The users with an elevated role, such as the administrators, cannot register themselves
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		MakeErrorResponse(w, http.StatusInternalServerError, "Api Gateway - Internal Server Error")
 		log.Println("Api Gateway - Internal Server Error")
 		return
 	}
+	var user User
+	err = json.Unmarshal(body, &user)
+	if err != nil {
+		MakeErrorResponse(w, http.StatusBadRequest, "Bad Request")
+		log.Println("Bad Request")
+		return
+	}
+	if policyOf(r.Context()).isElevated(user.Type) {
+		MakeErrorResponse(w, http.StatusForbidden, "Unauthorized registration")
+		log.Println("Unauthorized registration of an user of type " + user.Type)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	err = ProxyToUpstream(UserManagement, "users", w, r)
+	if err != nil {
+		makeUpstreamErrorResponse(w, err)
+		return
+	}
 }
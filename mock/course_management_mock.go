@@ -75,6 +75,19 @@ func CourseManagementMockSearchCourse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if mux.Vars(r)["by"] == "name" && mux.Vars(r)["string"] == "seq" {
 		w.WriteHeader(http.StatusOK)
+	} else if mux.Vars(r)["by"] == "teacher" && mux.Vars(r)["string"] == "nome-cognome" {
+		// For the tests of exam creation and notification push, that are allowed to the teacher holding the course only
+		w.WriteHeader(http.StatusOK)
+		courses := []microservice.CourseMinimized{{Id: "IdCorso"}, {Id: "courseId"}}
+		response, err := json.Marshal(&courses)
+		if err != nil {
+			log.Panicln(err)
+		}
+		_, err = w.Write(response)
+		if err != nil {
+			log.Panicln(err)
+		}
+		return
 	} else if mux.Vars(r)["by"] == "notvalid" {
 		w.WriteHeader(http.StatusBadRequest)
 	} else if mux.Vars(r)["by"] == "teacher" && mux.Vars(r)["string"] == "Mr-Brown" {
@@ -2,6 +2,7 @@
 package mock
 
 import (
+	"encoding/json"
 	"github.com/bitly/go-simplejson"
 	"github.com/gorilla/mux"
 	"github.com/redefik/sdccproject/apigateway/config"
@@ -29,8 +30,12 @@ func UserManagementMockRegisterUser(w http.ResponseWriter, _ *http.Request) {
 // exists with username "admin" and password "admin_pass".
 func UserManagementMockLoginUser(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	username := params["username"]
-	password := params["password"]
+	makeLoginResponse(w, params["username"], params["password"])
+}
+
+// makeLoginResponse writes the response of the user-management microservice to a request for retrieving information
+// about the user with the given credentials
+func makeLoginResponse(w http.ResponseWriter, username string, password string) {
 	if username != "admin" || password != "admin_pass" {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -53,10 +58,34 @@ func UserManagementMockLoginUser(w http.ResponseWriter, r *http.Request) {
 	w.Write(responsePayload)
 }
 
+// UserManagementMockVerifyCredentials simulates the behaviour of the user-management microservice when receives a
+// request for retrieving information about an user whose credentials are sent in the JSON body of a POST request or
+// in the Authorization header of a GET request, according to the Basic scheme. As for UserManagementMockLoginUser, only
+// an user exists with username "admin" and password "admin_pass".
+func UserManagementMockVerifyCredentials(w http.ResponseWriter, r *http.Request) {
+	var credentials microservice.LoginRequestBody
+	if r.Method == http.MethodPost {
+		err := json.NewDecoder(r.Body).Decode(&credentials)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	} else {
+		username, password, present := r.BasicAuth()
+		if !present {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		credentials = microservice.LoginRequestBody{Username: username, Password: password}
+	}
+	makeLoginResponse(w, credentials.Username, credentials.Password)
+}
+
 // starts a user management microservice mock
 func LaunchUserManagementMock() {
 	r := mux.NewRouter()
 	r.HandleFunc("/user_management/api/v1.0/users", UserManagementMockRegisterUser).Methods(http.MethodPost)
+	r.HandleFunc("/user_management/api/v1.0/users/authentication", UserManagementMockVerifyCredentials).Methods(http.MethodPost, http.MethodGet)
 	r.HandleFunc("/user_management/api/v1.0/users/{username}/{password}", UserManagementMockLoginUser).Methods(http.MethodGet)
 	http.ListenAndServe(config.Configuration.ApiGatewayAddress, r)
 }